@@ -13,10 +13,27 @@ var _ = Service("toy", func() {
 
 		Result(Thing)
 
+		Error("not_found", ErrorResult, "Thing does not exist")
+
 		HTTP(func() {
 			GET("/things/{id}")
 			Param("id")
 			Response(StatusOK)
+			Response("not_found", StatusNotFound)
+		})
+	})
+
+	Method("create_thing", func() {
+		Payload(func() {
+			Attribute("name", String, "Thing name")
+			Required("name")
+		})
+
+		Result(Thing)
+
+		HTTP(func() {
+			POST("/things")
+			Response(StatusCreated)
 		})
 	})
 
@@ -3,6 +3,7 @@ module github.com/xeger/goa-vcr
 go 1.25.5
 
 require (
+	github.com/gorilla/websocket v1.5.3
 	goa.design/clue v1.2.3
 	goa.design/goa/v3 v3.23.4
 )
@@ -15,7 +16,6 @@ require (
 	github.com/go-logr/logr v1.4.3 // indirect
 	github.com/gohugoio/hashstructure v0.6.0 // indirect
 	github.com/google/uuid v1.6.0 // indirect
-	github.com/gorilla/websocket v1.5.3 // indirect
 	github.com/manveru/faker v0.0.0-20171103152722-9fbc68a78c4d // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/stretchr/testify v1.11.1 // indirect
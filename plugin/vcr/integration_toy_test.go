@@ -46,10 +46,13 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httputil"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/websocket"
 	toy "%[1]s/gen/toy"
@@ -156,6 +159,230 @@ func TestPlayback_UnaryFallbackAndLoopbackBypass(t *testing.T) {
 	}
 }
 
+func TestPlayback_ErrorStubsMapToDesignErrors(t *testing.T) {
+	stubRoot := t.TempDir()
+	if err := os.WriteFile(filepath.Join(stubRoot, vcrruntime.PolicyFileName), []byte("{\"upstream\":\"https://example.com\",\"endpoints\":{\"GetThing\":{\"variant\":{\"path\":true}}}}\n"), 0600); err != nil {
+		t.Fatalf("write policy: %%v", err)
+	}
+	store, err := vcrruntime.New(stubRoot)
+	if err != nil {
+		t.Fatalf("new store: %%v", err)
+	}
+
+	// A 404 whose body does not follow the Goa error shape, and an undeclared 503.
+	stubs := map[string]int{"missing": http.StatusNotFound, "busy": http.StatusServiceUnavailable}
+	for id, status := range stubs {
+		body := []byte("{\"error\":\"upstream says no\"}\n")
+		div := vcrruntime.RequestDiversifier(store.Policy, "GetThing", nil, map[string]string{"id": id}, nil, nil)
+		if err := store.WriteStub("GetThing", vcrruntime.RequestSpec{URL: "http://example.com/things/" + id}, vcrruntime.ResponseMeta{
+			Status:   status,
+			MimeType: "application/json",
+			Size:     len(body),
+		}, body, div); err != nil {
+			t.Fatalf("write stub: %%v", err)
+		}
+	}
+
+	h, err := toyvcr.NewPlaybackHandler(store, toyvcr.NewScenario(), toyvcr.PlaybackOptions{})
+	if err != nil {
+		t.Fatalf("handler: %%v", err)
+	}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	res := mustGet(t, srv.URL+"/things/missing", nil)
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("unexpected status for declared error: %%d", res.StatusCode)
+	}
+	if got := res.Header.Get("goa-error"); got != "not_found" {
+		t.Fatalf("unexpected goa-error: %%q", got)
+	}
+
+	res2 := mustGet(t, srv.URL+"/things/busy", nil)
+	_ = res2.Body.Close()
+	if res2.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status for undeclared error: %%d", res2.StatusCode)
+	}
+}
+
+func TestPlayback_PostSelectsStubByBody(t *testing.T) {
+	stubRoot := t.TempDir()
+	if err := os.WriteFile(filepath.Join(stubRoot, vcrruntime.PolicyFileName), []byte("{\"upstream\":\"https://example.com\"}\n"), 0600); err != nil {
+		t.Fatalf("write policy: %%v", err)
+	}
+	store, err := vcrruntime.New(stubRoot)
+	if err != nil {
+		t.Fatalf("new store: %%v", err)
+	}
+
+	for _, name := range []string{"alpha", "beta"} {
+		payload := []byte("{\"name\":\"" + name + "\"}")
+		body := []byte("{\"id\":\"" + name + "-id\"}\n")
+		div := vcrruntime.RequestDiversifier(store.Policy, "CreateThing", nil, nil, payload, nil)
+		if err := store.WriteStub("CreateThing", vcrruntime.RequestSpec{Method: http.MethodPost, URL: "http://example.com/things", Body: payload}, vcrruntime.ResponseMeta{
+			Status:   http.StatusCreated,
+			MimeType: "application/json",
+			Size:     len(body),
+		}, body, div); err != nil {
+			t.Fatalf("write stub: %%v", err)
+		}
+	}
+
+	h, err := toyvcr.NewPlaybackHandler(store, toyvcr.NewScenario(), toyvcr.PlaybackOptions{})
+	if err != nil {
+		t.Fatalf("handler: %%v", err)
+	}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	res, err := http.Post(srv.URL+"/things", "application/json", bytes.NewReader([]byte("{\"name\": \"beta\"}")))
+	if err != nil {
+		t.Fatalf("post: %%v", err)
+	}
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("unexpected status: %%d", res.StatusCode)
+	}
+	got := decodeThing(t, res.Body)
+	if got.ID != "beta-id" {
+		t.Fatalf("unexpected id: %%q", got.ID)
+	}
+}
+
+func TestPlayback_NewEpisodesRecordsMisses(t *testing.T) {
+	upstreamCalls := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls++
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, "{\"id\":\"live\"}")
+	}))
+	defer upstream.Close()
+
+	stubRoot := t.TempDir()
+	if err := os.WriteFile(filepath.Join(stubRoot, vcrruntime.PolicyFileName), []byte("{\"upstream\":\""+upstream.URL+"\",\"endpoints\":{\"GetThing\":{\"variant\":{\"path\":true}}}}\n"), 0600); err != nil {
+		t.Fatalf("write policy: %%v", err)
+	}
+	store, err := vcrruntime.New(stubRoot)
+	if err != nil {
+		t.Fatalf("new store: %%v", err)
+	}
+
+	recorder := vcrruntime.NewRecordingTransport(context.Background(), store, toyvcr.Endpoints(), nil, 0)
+	recorder.Mode = vcrruntime.RecordModeNewEpisodes
+	h, err := toyvcr.NewPlaybackHandler(store, toyvcr.NewScenario(), toyvcr.PlaybackOptions{
+		Mode:     vcrruntime.RecordModeNewEpisodes,
+		Upstream: recorder,
+	})
+	if err != nil {
+		t.Fatalf("handler: %%v", err)
+	}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	for i := 0; i < 2; i++ {
+		res := mustGet(t, srv.URL+"/things/42", nil)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status: %%d", res.StatusCode)
+		}
+		if got := decodeThing(t, res.Body); got.ID != "live" {
+			t.Fatalf("unexpected id: %%q", got.ID)
+		}
+	}
+	if upstreamCalls != 1 {
+		t.Fatalf("expected the second call to be served from the new stub, got %%d upstream calls", upstreamCalls)
+	}
+	div := vcrruntime.RequestDiversifier(store.Policy, "GetThing", nil, map[string]string{"id": "42"}, nil, nil)
+	if ok, _ := store.HasStub("GetThing", div); !ok {
+		t.Fatalf("expected miss to be recorded")
+	}
+}
+
+func TestPlayback_HeaderVariantSelectsStub(t *testing.T) {
+	stubRoot := t.TempDir()
+	if err := os.WriteFile(filepath.Join(stubRoot, vcrruntime.PolicyFileName), []byte("{\"upstream\":\"https://example.com\",\"endpoints\":{\"GetThing\":{\"variant\":{\"headers\":[\"Accept-Language\"]}}}}\n"), 0600); err != nil {
+		t.Fatalf("write policy: %%v", err)
+	}
+	store, err := vcrruntime.New(stubRoot)
+	if err != nil {
+		t.Fatalf("new store: %%v", err)
+	}
+
+	for _, lang := range []string{"en", "fr"} {
+		body := []byte("{\"id\":\"" + lang + "\"}\n")
+		div := vcrruntime.RequestDiversifier(store.Policy, "GetThing", nil, nil, nil, http.Header{"Accept-Language": []string{lang}})
+		if err := store.WriteStub("GetThing", vcrruntime.RequestSpec{URL: "http://example.com/things/1"}, vcrruntime.ResponseMeta{
+			Status:   http.StatusOK,
+			MimeType: "application/json",
+			Size:     len(body),
+		}, body, div); err != nil {
+			t.Fatalf("write stub: %%v", err)
+		}
+	}
+
+	h, err := toyvcr.NewPlaybackHandler(store, toyvcr.NewScenario(), toyvcr.PlaybackOptions{})
+	if err != nil {
+		t.Fatalf("handler: %%v", err)
+	}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	// Accept-Language is not part of the design, so only the incoming request carries it.
+	res := mustGet(t, srv.URL+"/things/1", http.Header{"Accept-Language": []string{"fr"}})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %%d", res.StatusCode)
+	}
+	if got := decodeThing(t, res.Body); got.ID != "fr" {
+		t.Fatalf("unexpected id: %%q", got.ID)
+	}
+}
+
+func TestPlayback_JournalRecordsCalls(t *testing.T) {
+	stubRoot := t.TempDir()
+	if err := os.WriteFile(filepath.Join(stubRoot, vcrruntime.PolicyFileName), []byte("{\"upstream\":\"https://example.com\"}\n"), 0600); err != nil {
+		t.Fatalf("write policy: %%v", err)
+	}
+	store, err := vcrruntime.New(stubRoot)
+	if err != nil {
+		t.Fatalf("new store: %%v", err)
+	}
+	body := []byte("{\"id\":\"123\"}\n")
+	if err := store.WriteStub("GetThing", vcrruntime.RequestSpec{URL: "http://example.com/things/123"}, vcrruntime.ResponseMeta{
+		Status:   200,
+		MimeType: "application/json",
+		Size:     len(body),
+	}, body); err != nil {
+		t.Fatalf("write stub: %%v", err)
+	}
+
+	sc := toyvcr.NewScenario()
+	journal := toyvcr.NewJournal()
+	h, err := toyvcr.NewPlaybackHandler(store, sc, toyvcr.PlaybackOptions{Journal: journal})
+	if err != nil {
+		t.Fatalf("handler: %%v", err)
+	}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	_ = mustGet(t, srv.URL+"/things/123", nil).Body.Close()
+	sc.SetGetThing(func(ctx context.Context, p *toy.GetThingPayload) (*toy.Thing, error) {
+		return &toy.Thing{ID: p.ID}, nil
+	})
+	_ = mustGet(t, srv.URL+"/things/999", nil).Body.Close()
+
+	journal.AssertCalled(t, "GetThing", 2)
+	journal.AssertNotCalled(t, "CreateThing")
+	calls := journal.CallsToGetThing()
+	if len(calls) != 2 {
+		t.Fatalf("unexpected calls: %%+v", calls)
+	}
+	if c := calls[0]; c.Source != vcrruntime.CallStub || c.Stub != "GetThing" || c.Vars["id"] != "123" || c.Status != http.StatusOK {
+		t.Fatalf("unexpected stub call: %%+v", c)
+	}
+	if c := calls[1]; c.Source != vcrruntime.CallScenario || c.Vars["id"] != "999" || c.Status != http.StatusOK {
+		t.Fatalf("unexpected scenario call: %%+v", c)
+	}
+}
+
 func TestPlayback_UnaryViewedResult_NoPanicAndRespectsView(t *testing.T) {
 	stubRoot := t.TempDir()
 	if err := os.WriteFile(filepath.Join(stubRoot, vcrruntime.PolicyFileName), []byte("{\"upstream\":\"https://example.com\",\"endpoints\":{\"GetThingViewed\":{\"variant\":{\"query\":false}}}}\n"), 0600); err != nil {
@@ -172,7 +399,7 @@ func TestPlayback_UnaryViewedResult_NoPanicAndRespectsView(t *testing.T) {
 		Status:   200,
 		MimeType: "application/json",
 		Size:     len(body),
-		Headers:  map[string]string{"goa-view": "extended"},
+		Headers:  http.Header{"Goa-View": []string{"extended"}},
 	}, body); err != nil {
 		t.Fatalf("write stub: %%v", err)
 	}
@@ -243,6 +470,58 @@ func TestPlayback_StreamingRequiresScenario(t *testing.T) {
 	}
 }
 
+func TestPlayback_SSEReplaysRecordedEvents(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		for _, typ := range []string{"created", "updated"} {
+			_, _ = io.WriteString(w, "data: {\"type\":\""+typ+"\",\"id\":\"123\"}\n\n")
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer upstream.Close()
+
+	stubRoot := t.TempDir()
+	if err := os.WriteFile(filepath.Join(stubRoot, vcrruntime.PolicyFileName), []byte("{\"upstream\":\""+upstream.URL+"\"}\n"), 0600); err != nil {
+		t.Fatalf("write policy: %%v", err)
+	}
+	store, err := vcrruntime.New(stubRoot)
+	if err != nil {
+		t.Fatalf("new store: %%v", err)
+	}
+
+	recorder := vcrruntime.NewRecordingTransport(context.Background(), store, toyvcr.Endpoints(), nil, 0)
+	res, err := (&http.Client{Transport: recorder}).Get(upstream.URL + "/things/123/stream-sse")
+	if err != nil {
+		t.Fatalf("record: %%v", err)
+	}
+	_, _ = io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if ok, _ := store.HasStub("StreamThingsSse", ""); !ok {
+		t.Fatalf("expected the event stream to be recorded")
+	}
+
+	h, err := toyvcr.NewPlaybackHandler(store, toyvcr.NewScenario(), toyvcr.PlaybackOptions{})
+	if err != nil {
+		t.Fatalf("handler: %%v", err)
+	}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	res2 := mustGet(t, srv.URL+"/things/123/stream-sse", nil)
+	if res2.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %%d", res2.StatusCode)
+	}
+	b, _ := io.ReadAll(res2.Body)
+	_ = res2.Body.Close()
+	if n := bytes.Count(b, []byte("data:")); n != 2 {
+		t.Fatalf("expected 2 replayed events, got %%d: %%q", n, string(b))
+	}
+	if !bytes.Contains(b, []byte("created")) || !bytes.Contains(b, []byte("updated")) {
+		t.Fatalf("unexpected replayed events: %%q", string(b))
+	}
+}
+
 func TestPlayback_WebSocketBidirectionalAndSendOnly(t *testing.T) {
 	stubRoot := t.TempDir()
 	if err := os.WriteFile(filepath.Join(stubRoot, vcrruntime.PolicyFileName), []byte("{\"upstream\":\"https://example.com\"}\n"), 0600); err != nil {
@@ -336,6 +615,85 @@ func TestPlayback_WebSocketBidirectionalAndSendOnly(t *testing.T) {
 	}
 }
 
+func TestPlayback_WebSocketReplaysRecordedConversation(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var sub map[string]any
+		if err := conn.ReadJSON(&sub); err != nil {
+			return
+		}
+		_ = conn.WriteJSON(map[string]any{"type": "echo", "id": "123"})
+		_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "done"))
+		_, _, _ = conn.ReadMessage()
+	}))
+	defer upstream.Close()
+
+	stubRoot := t.TempDir()
+	if err := os.WriteFile(filepath.Join(stubRoot, vcrruntime.PolicyFileName), []byte("{\"upstream\":\""+upstream.URL+"\",\"endpoints\":{\"StreamThingsWs\":{\"websocket\":{\"match\":true}}}}\n"), 0600); err != nil {
+		t.Fatalf("write policy: %%v", err)
+	}
+	store, err := vcrruntime.New(stubRoot)
+	if err != nil {
+		t.Fatalf("new store: %%v", err)
+	}
+
+	// Record through the reverse proxy used by "record".
+	upstreamURL, _ := url.Parse(upstream.URL)
+	proxy := httputil.NewSingleHostReverseProxy(upstreamURL)
+	proxy.Transport = vcrruntime.NewRecordingTransport(context.Background(), store, toyvcr.Endpoints(), nil, 0)
+	proxySrv := httptest.NewServer(proxy)
+	defer proxySrv.Close()
+
+	converse := func(base string, msg string) (string, error) {
+		conn, _, err := websocket.DefaultDialer.Dial(mustWSURL(t, base, "/things/123/stream-ws"), nil)
+		if err != nil {
+			t.Fatalf("ws dial: %%v", err)
+		}
+		defer conn.Close()
+		if err := conn.WriteJSON(map[string]any{"msg": msg}); err != nil {
+			t.Fatalf("ws write: %%v", err)
+		}
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return "", err
+		}
+		_, _, _ = conn.ReadMessage() // wait for the close
+		return string(data), nil
+	}
+	if got, err := converse(proxySrv.URL, "hi"); err != nil || !strings.Contains(got, "echo") {
+		t.Fatalf("unexpected recorded reply: %%q, %%v", got, err)
+	}
+	for i := 0; ; i++ {
+		if ok, _ := store.HasStub("StreamThingsWs", ""); ok {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("expected the conversation to be recorded")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	h, err := toyvcr.NewPlaybackHandler(store, toyvcr.NewScenario(), toyvcr.PlaybackOptions{})
+	if err != nil {
+		t.Fatalf("handler: %%v", err)
+	}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	if got, err := converse(srv.URL, "hi"); err != nil || !strings.Contains(got, "echo") {
+		t.Fatalf("unexpected replayed reply: %%q, %%v", got, err)
+	}
+	// websocket.match rejects a client message that differs from the recording.
+	if _, err := converse(srv.URL, "bye"); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatalf("expected policy violation close, got %%v", err)
+	}
+}
+
 func mustGet(t *testing.T, url string, hdr http.Header) *http.Response {
 	t.Helper()
 	req, err := http.NewRequest(http.MethodGet, url, nil)
@@ -397,10 +755,17 @@ func mustWSURL(t *testing.T, base string, path string) string {
 	writeFile(t, filepath.Join(tmp, "toy_cli_smoke_test.go"), fmt.Sprintf(`package toyint
 
 import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	toyvcr "%[1]s/gen/http/toy/vcr"
+	vcrruntime "github.com/xeger/goa-vcr/runtime"
 )
 
 func TestVCRCLI_Usage(t *testing.T) {
@@ -419,6 +784,62 @@ func TestVCRCLI_Usage(t *testing.T) {
 		t.Fatalf("unreachable")
 	}
 }
+
+func TestVCRCLI_RefreshKeepsStubKeyOfRedactedRequest(t *testing.T) {
+	body := "{\"id\":\"old\"}"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, body)
+	}))
+	defer upstream.Close()
+
+	dir := t.TempDir()
+	policy := "{\"upstream\":\"" + upstream.URL + "\",\"redact\":{\"headers\":[\"X-Tenant-ID\"]},\"endpoints\":{\"GetThing\":{\"variant\":{\"headers\":[\"X-Tenant-ID\"]}}}}\n"
+	if err := os.WriteFile(filepath.Join(dir, vcrruntime.PolicyFileName), []byte(policy), 0600); err != nil {
+		t.Fatalf("write policy: %%v", err)
+	}
+	store, err := vcrruntime.New(dir)
+	if err != nil {
+		t.Fatalf("new store: %%v", err)
+	}
+	recorder := vcrruntime.NewRecordingTransport(context.Background(), store, toyvcr.Endpoints(), nil, 0)
+	req, err := http.NewRequest(http.MethodGet, upstream.URL+"/things/42", nil)
+	if err != nil {
+		t.Fatalf("request: %%v", err)
+	}
+	req.Header.Set("X-Tenant-ID", "acme")
+	res, err := recorder.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("record: %%v", err)
+	}
+	res.Body.Close()
+	div := vcrruntime.RequestDiversifier(store.Policy, "GetThing", nil, map[string]string{"id": "42"}, nil, req.Header)
+
+	body = "{\"id\":\"fresh\"}"
+	code := toyvcr.RunCLI([]string{"refresh", "-token", "t", dir}, toyvcr.CLIConfig{AppName: "toy-vcr"})
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %%d", code)
+	}
+
+	store, err = vcrruntime.New(dir)
+	if err != nil {
+		t.Fatalf("new store: %%v", err)
+	}
+	keys, err := store.ListStubs()
+	if err != nil {
+		t.Fatalf("list stubs: %%v", err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("expected refresh to keep one stub, got %%v", keys)
+	}
+	_, got, err := store.ReadResponse("GetThing", div)
+	if err != nil {
+		t.Fatalf("read refreshed stub: %%v", err)
+	}
+	if !strings.Contains(string(got), "fresh") {
+		t.Fatalf("expected the recorded stub to be refreshed, got %%s", got)
+	}
+}
 `, mod))
 
 	// Compile + run the generated + smoke tests.
@@ -40,16 +40,35 @@ func BuildServiceSpec(genpkg string, svc *httpcodegen.ServiceData) ServiceSpec {
 			PayloadRef:                   payloadRef,
 			ResultRef:                    resultRef,
 			IsStreaming:                  httpcodegen.IsWebSocketEndpoint(ed) || httpcodegen.IsSSEEndpoint(ed),
+			IsSSE:                        httpcodegen.IsSSEEndpoint(ed),
 			ViewedResultInitName:         viewedInitName,
 			ViewedResultViewName:         viewedViewName,
 			SkipResponseBodyEncodeDecode: ed.Method.SkipResponseBodyEncodeDecode,
 		}
+		for _, eg := range ed.Errors {
+			for _, e := range eg.Errors {
+				// Only ErrorResult errors have a generated Make<Name> helper.
+				for _, ei := range ed.Method.Errors {
+					if ei.ErrName == e.Name {
+						ep.Errors = append(ep.Errors, ErrorSpec{
+							Name:       e.Name,
+							MakeName:   ei.Name,
+							StatusCode: eg.StatusCode,
+						})
+						break
+					}
+				}
+			}
+		}
 		for _, r := range ed.Routes {
 			if r.Verb == "OPTIONS" {
 				continue // Skip CORS preflight mounts.
 			}
 			ep.Routes = append(ep.Routes, RouteSpec{Verb: r.Verb, Path: r.Path})
 		}
+		if ep.IsSSE {
+			spec.HasSSE = true
+		}
 		spec.Endpoints = append(spec.Endpoints, ep)
 	}
 	return spec
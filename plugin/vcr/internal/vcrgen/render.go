@@ -29,7 +29,10 @@ func RenderServiceVCR(spec ServiceSpec) *codegen.File {
 		imports = append(imports, codegen.SimpleImport("reflect"))
 	}
 	if spec.HasWebSocket {
-		imports = append(imports, codegen.SimpleImport("github.com/gorilla/websocket"))
+		imports = append(imports, codegen.SimpleImport("github.com/gorilla/websocket"), codegen.SimpleImport("io/fs"))
+	}
+	if spec.HasSSE {
+		imports = append(imports, codegen.SimpleImport("io"))
 	}
 
 	// Keep imports stable for unit tests / diffs.
@@ -177,9 +180,14 @@ func viewFromPayload(p any) string {
 
 // NewBackgroundClient returns a protocol-agnostic service client backed by
 // stub responses. The returned client decodes stubbed HTTP responses into
-// concrete Goa result types.
+// concrete Goa result types, and recorded error responses into the Goa
+// service errors the design maps to their status.
 func NewBackgroundClient(store *vcrruntime.VCR) *{{ .ServicePkgName }}.Client {
-	doer := vcrruntime.NewStubDoer(store, Endpoints())
+	return newBackgroundClient(vcrruntime.NewStubDoer(store, Endpoints()))
+}
+
+// newBackgroundClient builds the background client on top of a stub doer.
+func newBackgroundClient(doer *vcrruntime.StubDoer) *{{ .ServicePkgName }}.Client {
 	// The scheme/host are irrelevant as StubDoer matches on verb+path.
 	scheme := "http"
 	host := "vcr.local"
@@ -190,15 +198,82 @@ func NewBackgroundClient(store *vcrruntime.VCR) *{{ .ServicePkgName }}.Client {
 	{{- end }}
 	return &{{ .ServicePkgName }}.Client{
 		{{- range .Endpoints }}
+		{{- if .IsStreaming }}
 		{{ .MethodVarName }}Endpoint: hc.{{ .MethodVarName }}(),
+		{{- else }}
+		{{ .MethodVarName }}Endpoint: withStubErrors(hc.{{ .MethodVarName }}(), stubError{{ .MethodVarName }}),
 		{{- end }}
+		{{- end }}
+	}
+}
+
+// withStubErrors wraps a background client endpoint so that failures caused by
+// recorded error stubs surface as Goa service errors instead of client
+// decoding errors (which the Goa server would answer with a generic 500).
+func withStubErrors(ep goa.Endpoint, toServiceError func(*vcrruntime.StubResult, error) error) goa.Endpoint {
+	return func(ctx context.Context, v any) (any, error) {
+		ctx, stub := vcrruntime.WithStubResult(ctx)
+		res, err := ep(ctx, v)
+		if err == nil || stub.Status < 400 {
+			return res, err
+		}
+		var clientErr *goahttp.ClientError
+		if !errors.As(err, &clientErr) {
+			// The recorded body already decoded into a design error.
+			return nil, err
+		}
+		return nil, toServiceError(stub, err)
 	}
 }
 
 // PlaybackOptions configures playback handler generation.
 type PlaybackOptions struct {
 	ScenarioName string
+	// Mode, if set, overrides the record mode of each endpoint in vcr.json,
+	// which selects how stub misses are handled; see vcrruntime.StubDoer.Mode.
+	Mode vcrruntime.RecordMode
+	// Upstream carries stub misses to the upstream when the record mode of
+	// the endpoint is not "none".
+	// Pass a vcrruntime.RecordingTransport to record them as new stubs.
+	Upstream http.RoundTripper
+	// StreamTiming replays recorded server-sent events with their original
+	// delays; see vcrruntime.StubDoer.StreamTiming.
+	StreamTiming bool
+	// Latency, if set, overrides the latency configured in the policy for
+	// responses served from stubs.
+	Latency *vcrruntime.Latency
+	// Faults, if set, overrides the fault profile configured in the policy
+	// for responses served from stubs.
+	Faults *vcrruntime.Faults
+	// FaultSeed, if set, seeds fault injection so a failing run can be
+	// reproduced; see vcrruntime.StubDoer.FaultSeed.
+	FaultSeed *uint64
+	// Strict records requests that are not answered from a stub; see
+	// vcrruntime.VCR.StrictReport.
+	Strict bool
+	// Journal, if set, records every request to a known endpoint.
+	Journal *Journal
+	// Admin, if set, also applies its latency and fault overrides to the
+	// handler's stub doer.
+	Admin *vcrruntime.Admin
+}
+
+// Journal records the calls served by a playback handler, with typed
+// accessors for each endpoint. See vcrruntime.Journal.
+type Journal struct {
+	*vcrruntime.Journal
+}
+
+// NewJournal returns an empty journal to pass as PlaybackOptions.Journal.
+func NewJournal() *Journal {
+	return &Journal{Journal: vcrruntime.NewJournal()}
+}
+{{ range .Endpoints }}
+// CallsTo{{ .MethodVarName }} returns the recorded calls to {{ .MethodVarName }}.
+func (j *Journal) CallsTo{{ .MethodVarName }}() []vcrruntime.Call {
+	return j.CallsTo({{ printf "%q" .MethodVarName }})
 }
+{{ end }}
 
 // NewPlaybackHandler returns a handler that serves stub-backed responses using
 // Goa-generated HTTP server code, dispatching to scenario handlers when present.
@@ -206,13 +281,37 @@ func NewPlaybackHandler(store *vcrruntime.VCR, scenario Scenario, opts PlaybackO
 	if store == nil {
 		return nil, errors.New("vcr: nil store")
 	}
-	bg := NewBackgroundClient(store)
+	doer := vcrruntime.NewStubDoer(store, Endpoints())
+	doer.Mode = opts.Mode
+	doer.Upstream = opts.Upstream
+	doer.StreamTiming = opts.StreamTiming
+	doer.Latency = opts.Latency
+	doer.Faults = opts.Faults
+	doer.FaultSeed = opts.FaultSeed
+	doer.Strict = opts.Strict
+	if opts.Journal != nil {
+		doer.Journal = opts.Journal.Journal
+	}
+	if opts.Admin != nil {
+		opts.Admin.Doers = append(opts.Admin.Doers, doer)
+	}
+	bg := newBackgroundClient(doer)
 	mux := goahttp.NewMuxer()
+	{{- if .HasWebSocket }}
+	upgrader := &websocket.Upgrader{
+		Subprotocols: []string{"ws", "wss", "auth.bearer"},
+		CheckOrigin:  func(*http.Request) bool { return true },
+	}
+	{{- end }}
 
 	eps := &{{ .ServicePkgName }}.Endpoints{
 		{{- range .Endpoints }}
+		{{- if and .IsStreaming (not .IsSSE) }}
+		{{ .MethodVarName }}: makeEndpoint{{ .MethodVarName }}(doer, scenario, upgrader),
+		{{- else }}
 		{{ .MethodVarName }}: makeEndpoint{{ .MethodVarName }}(store, scenario, bg, opts),
 		{{- end }}
+		{{- end }}
 	}
 
 	errHandler := func(ctx context.Context, w http.ResponseWriter, err error) {
@@ -224,18 +323,24 @@ func NewPlaybackHandler(store *vcrruntime.VCR, scenario Scenario, opts PlaybackO
 	}
 
 	{{- if .HasWebSocket }}
-	upgrader := &websocket.Upgrader{
-		Subprotocols: []string{"ws", "wss", "auth.bearer"},
-		CheckOrigin:  func(*http.Request) bool { return true },
-	}
 	server := httpserver.New(eps, mux, goahttp.RequestDecoder, goahttp.ResponseEncoder, errHandler, nil, upgrader, nil)
 	{{- else }}
 	server := httpserver.New(eps, mux, goahttp.RequestDecoder, goahttp.ResponseEncoder, errHandler, nil)
 	{{- end }}
 	server.Mount(mux)
 
-	// Mark loopback requests so endpoint dispatch can avoid scenario recursion.
-	return vcrruntime.LoopbackMiddleware(mux), nil
+	// Record requests that match no endpoint in strict mode, journal calls,
+	// let injected faults reach the connection, mark loopback requests so
+	// endpoint dispatch can avoid scenario recursion, and keep incoming headers
+	// around for header and cookie variants.
+	var h http.Handler = vcrruntime.StrictMiddleware(doer, mux)
+	h = vcrruntime.JournalMiddleware(doer, h)
+	{{- if .HasWebSocket }}
+	// WebSocket requests also keep their writer so conversations can be replayed.
+	h = vcrruntime.WebSocketMiddleware(h)
+	{{- end }}
+	h = vcrruntime.FaultMiddleware(h)
+	return vcrruntime.IncomingHeaderMiddleware(vcrruntime.LoopbackMiddleware(h)), nil
 }
 
 {{ range .Endpoints }}
@@ -259,8 +364,75 @@ func (s *Scenario) Add{{ .MethodVarName }}(f Service{{ .MethodVarName }}Func) {
 	s.Add("{{ .MethodVarName }}", f)
 }
 
-{{ if .IsStreaming }}
-func makeEndpoint{{ .MethodVarName }}(_ *vcrruntime.VCR, scenario Scenario, _ *{{ $.ServicePkgName }}.Client, _ PlaybackOptions) goa.Endpoint {
+{{- if not .IsStreaming }}
+
+// stubError{{ .MethodVarName }} maps a recorded {{ .MethodVarName }} error status onto the
+// design errors, falling back to a status-derived service error.
+func stubError{{ .MethodVarName }}(stub *vcrruntime.StubResult, err error) error {
+	{{- if .Errors }}
+	name := stub.Header.Get("goa-error")
+	switch {
+	{{- range .Errors }}
+	case stub.Status == {{ .StatusCode }} && (name == "" || name == {{ printf "%q" .Name }}):
+		return {{ $.ServicePkgName }}.{{ .MakeName }}(err)
+	{{- end }}
+	}
+	{{- end }}
+	return vcrruntime.StubStatusError(stub.Status, err)
+}
+{{- end }}
+
+{{ if .IsSSE }}
+func makeEndpoint{{ .MethodVarName }}(_ *vcrruntime.VCR, scenario Scenario, bg *{{ $.ServicePkgName }}.Client, _ PlaybackOptions) goa.Endpoint {
+	return func(ctx context.Context, v any) (any, error) {
+		in, ok := v.(*{{ $.ServicePkgName }}.{{ .MethodVarName }}EndpointInput)
+		if !ok || in == nil {
+			return nil, fmt.Errorf("vcr: unexpected {{ .MethodVarName }} input %T", v)
+		}
+		handler := scenario.Next("{{ .MethodVarName }}")
+		if handler == nil {
+			return nil, replay{{ .MethodVarName }}(ctx, bg, in)
+		}
+		f, ok := handler.(Service{{ .MethodVarName }}Func)
+		if !ok {
+			return nil, fmt.Errorf("vcr: scenario handler for {{ .MethodVarName }} has unexpected type %T", handler)
+		}
+		vcrruntime.MarkScenarioCall(ctx)
+		return nil, f(ctx, in.Payload, in.Stream)
+	}
+}
+
+// replay{{ .MethodVarName }} sends the events of the recorded {{ .MethodVarName }} stream
+// to the client.
+func replay{{ .MethodVarName }}(ctx context.Context, bg *{{ $.ServicePkgName }}.Client, in *{{ $.ServicePkgName }}.{{ .MethodVarName }}EndpointInput) error {
+	res, err := bg.{{ .MethodVarName }}Endpoint(ctx, in.Payload)
+	if err != nil {
+		return fmt.Errorf("vcr: no scenario handler or stub for {{ .MethodVarName }}: %w", err)
+	}
+	// The HTTP client stream reads the event stream served by the stub doer.
+	stream, ok := res.(interface {
+		Recv(context.Context) ({{ .ResultRef }}, error)
+		Close() error
+	})
+	if !ok {
+		return fmt.Errorf("vcr: unexpected {{ .MethodVarName }} client stream %T", res)
+	}
+	defer stream.Close()
+	for {
+		ev, err := stream.Recv(ctx)
+		if errors.Is(err, io.EOF) || (err == nil && ev == nil) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := in.Stream.SendWithContext(ctx, ev); err != nil {
+			return err
+		}
+	}
+}
+{{ else if .IsStreaming }}
+func makeEndpoint{{ .MethodVarName }}(doer *vcrruntime.StubDoer, scenario Scenario, upgrader *websocket.Upgrader) goa.Endpoint {
 	return func(ctx context.Context, v any) (any, error) {
 		in, ok := v.(*{{ $.ServicePkgName }}.{{ .MethodVarName }}EndpointInput)
 		if !ok || in == nil {
@@ -268,12 +440,18 @@ func makeEndpoint{{ .MethodVarName }}(_ *vcrruntime.VCR, scenario Scenario, _ *{
 		}
 		handler := scenario.Next("{{ .MethodVarName }}")
 		if handler == nil {
-			return nil, fmt.Errorf("vcr: no scenario handler for {{ .MethodVarName }}")
+			// Replay the recorded conversation on the raw connection.
+			err := doer.ReplayWebSocket(ctx, upgrader)
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil, fmt.Errorf("vcr: no scenario handler or stub for {{ .MethodVarName }}")
+			}
+			return nil, err
 		}
 		f, ok := handler.(Service{{ .MethodVarName }}Func)
 		if !ok {
 			return nil, fmt.Errorf("vcr: scenario handler for {{ .MethodVarName }} has unexpected type %T", handler)
 		}
+		vcrruntime.MarkScenarioCall(ctx)
 		return nil, f(ctx, in.Payload, in.Stream)
 	}
 }
@@ -291,6 +469,7 @@ func makeEndpoint{{ .MethodVarName }}(_ *vcrruntime.VCR, scenario Scenario, bg *
 			if !ok {
 				return nil, fmt.Errorf("vcr: scenario handler for {{ .MethodVarName }} has unexpected type %T", handler)
 			}
+			vcrruntime.MarkScenarioCall(ctx)
 			return f(ctx, v)
 		}
 		return bg.{{ .MethodVarName }}Endpoint(ctx, v)
@@ -318,6 +497,7 @@ func makeEndpoint{{ .MethodVarName }}(_ *vcrruntime.VCR, scenario Scenario, bg *
 				if !ok {
 					return nil, fmt.Errorf("vcr: scenario handler for {{ .MethodVarName }} has unexpected type %T", handler)
 				}
+				vcrruntime.MarkScenarioCall(ctx)
 				res, err = f(ctx, p)
 			} else {
 				res, err = bg.{{ .MethodVarName }}(ctx, p)
@@ -350,6 +530,7 @@ func makeEndpoint{{ .MethodVarName }}(_ *vcrruntime.VCR, scenario Scenario, bg *
 			if !ok {
 				return nil, fmt.Errorf("vcr: scenario handler for {{ .MethodVarName }} has unexpected type %T", handler)
 			}
+			vcrruntime.MarkScenarioCall(ctx)
 			return f(ctx, p)
 		}
 		return bg.{{ .MethodVarName }}(ctx, p)
@@ -371,6 +552,7 @@ func makeEndpoint{{ .MethodVarName }}(_ *vcrruntime.VCR, scenario Scenario, bg *
 			if !ok {
 				return nil, fmt.Errorf("vcr: scenario handler for {{ .MethodVarName }} has unexpected type %T", handler)
 			}
+			vcrruntime.MarkScenarioCall(ctx)
 			return nil, f(ctx, p)
 		}
 		return nil, bg.{{ .MethodVarName }}(ctx, p)
@@ -23,12 +23,15 @@ func RenderServiceVCRCLI(spec ServiceSpec) *codegen.File {
 		codegen.SimpleImport("os"),
 		codegen.SimpleImport("os/signal"),
 		codegen.SimpleImport("path/filepath"),
+		codegen.SimpleImport("sort"),
+		codegen.SimpleImport("strconv"),
 		codegen.SimpleImport("strings"),
 		codegen.SimpleImport("syscall"),
 		codegen.SimpleImport("time"),
 
 		codegen.NewImport("vcrruntime", "github.com/xeger/goa-vcr/runtime"),
 		codegen.NewImport("log", "goa.design/clue/log"),
+		codegen.NewImport("httpclient", filepath.ToSlash(filepath.Join(spec.GenPkg, "http", spec.ServicePathName, "client"))),
 	}
 
 	sort.SliceStable(imports, func(i, j int) bool {
@@ -74,7 +77,8 @@ func Usage(cfg CLIConfig) string {
 			"Commands:\n"+
 			"  play       Serve recorded VCR stubs as an HTTP API\n"+
 			"  record     Start a recording proxy to capture new VCR stubs\n"+
-			"  refresh    Refresh VCR stubs by re-fetching from upstream endpoints\n\n"+
+			"  refresh    Refresh VCR stubs by re-fetching from upstream endpoints\n"+
+			"  scan       Report likely secrets in recorded VCR stubs\n\n"+
 			"Run '%s <command> -h' for help on a specific command.\n",
 		cfg.AppName,
 		cfg.AppName,
@@ -111,6 +115,8 @@ func RunCLI(args []string, cfg CLIConfig) int {
 		return cmdPlay(rest[1:], cfg)
 	case "refresh":
 		return cmdRefresh(rest[1:], cfg)
+	case "scan":
+		return cmdScan(rest[1:], cfg)
 	case "-h", "--help", "help":
 		fs.Usage()
 		return 0
@@ -221,7 +227,8 @@ func vcrAccessLog(store *vcrruntime.VCR) func(http.Handler) http.Handler {
 			div := ""
 			hasStub := false
 			if ok {
-				div = vcrruntime.RequestDiversifier(store.Policy, endpointName, r.URL.Query(), vars)
+				body, _ := vcrruntime.ReadRequestBody(r)
+				div = vcrruntime.RequestDiversifier(store.CurrentPolicy(), endpointName, r.URL.Query(), vars, body, r.Header)
 				hasStub, _ = store.HasStub(endpointName, div)
 			}
 
@@ -266,10 +273,30 @@ func vcrAccessLog(store *vcrruntime.VCR) func(http.Handler) http.Handler {
 				}
 			}
 
-			next.ServeHTTP(rc, r)
+			ctx, match := vcrruntime.WithStubMatch(ctx)
+			next.ServeHTTP(rc, r.WithContext(ctx))
+
+			// Report which stub answered when the exact variant was missing.
+			if match.Fallback != "" {
+				kvs := []log.Fielder{
+					log.KV{K: "msg", V: "vcr stub fallback"},
+					log.KV{K: "vcr.endpoint", V: match.Endpoint},
+					log.KV{K: "vcr.stub", V: match.Stub},
+					log.KV{K: "vcr.fallback", V: string(match.Fallback)},
+					log.KV{K: "http.method", V: method},
+					log.KV{K: "http.path", V: path},
+				}
+				if match.Requested != "" {
+					kvs = append(kvs, log.KV{K: "vcr.var", V: match.Requested})
+				}
+				if rawQuery != "" {
+					kvs = append(kvs, log.KV{K: "http.query", V: rawQuery})
+				}
+				log.Info(ctx, kvs...)
+			}
 
 			// Emit an always-on warning when a unary request ends up unstubbed.
-			if ok && streamType == "" && !hasStub && rc.status == http.StatusNotImplemented {
+			if ok && streamType == "" && !hasStub && match.Stub == "" && rc.status == http.StatusNotImplemented {
 				kvs := []log.Fielder{
 					log.KV{K: "msg", V: "vcr unstubbed unary request (no stub on disk)"},
 					log.KV{K: "vcr.unstubbed", V: true},
@@ -322,6 +349,7 @@ func cmdRecord(args []string, cfg CLIConfig) int {
 	upstreamFlag.value = cfg.DefaultUpstream
 	fs.Var(&upstreamFlag, "upstream", "Upstream base URL when creating a policy")
 	maxVariantsFlag := fs.Int("max-variants", cfg.DefaultMaxVariants, "Max distinct query variants per endpoint before auto-ignoring query (heuristic)")
+	modeFlag := fs.String("mode", "", "Record mode overriding vcr.json: all, once, new_episodes, none or fallthrough")
 
 	fs.Usage = func() {
 		fmt.Fprintf(os.Stderr,
@@ -329,12 +357,20 @@ func cmdRecord(args []string, cfg CLIConfig) int {
 				"Start a recording proxy that captures upstream responses as VCR stubs.\n\n"+
 				"If vcr.json is missing, it will be created using -upstream.\n\n"+
 				"If vcr.json sets endpoints.<EndpointName>.variant.query=false, then query strings\n"+
-				"are ignored for that endpoint (stubs will be undiversified).\n\n"+
+				"are ignored for that endpoint (stubs will be undiversified). It may also be\n"+
+				"{\"include\": [...]} or {\"exclude\": [...]} to pick the parameters that matter.\n\n"+
 				"Heuristic: if an endpoint records more than -max-variants distinct query variants\n"+
 				"in one session and policy does not explicitly set variant.query, the recorder will:\n"+
-				"  - persist endpoints.<EndpointName>.variant.query=false\n"+
+				"  - persist endpoints.<EndpointName>.variant.query={\"exclude\": [<param>]} when a\n"+
+				"    single noisy parameter explains the explosion, or variant.query=false otherwise\n"+
 				"  - delete existing stubs for that endpoint\n"+
-				"  - wait for the next call to record the undiversified stub\n\n"+
+				"  - wait for the next call to record the narrowed stub\n\n"+
+				"Record modes (-mode, or mode / endpoints.<EndpointName>.record.mode in vcr.json):\n"+
+				"  all           always proxy and re-record (default)\n"+
+				"  once          record an endpoint only while it has no stubs\n"+
+				"  new_episodes  replay existing stubs, record new variants\n"+
+				"  none          replay existing stubs; misses fail with 501\n"+
+				"  fallthrough   replay existing stubs; proxy misses without recording\n\n"+
 				"Options:\n",
 			cfg.AppName,
 		)
@@ -367,6 +403,16 @@ func cmdRecord(args []string, cfg CLIConfig) int {
 	ctx := cmdContext(cfg.AppName)
 	ctx = log.With(ctx, log.KV{K: "subcmd", V: "record"})
 
+	var mode vcrruntime.RecordMode
+	if *modeFlag != "" {
+		m, err := vcrruntime.ParseRecordMode(*modeFlag)
+		if err != nil {
+			log.Errorf(ctx, err, "invalid mode")
+			return 1
+		}
+		mode = m
+	}
+
 	if err := ensurePolicy(outDir, upstreamFlag.value, upstreamFlag.set); err != nil {
 		log.Errorf(ctx, err, "failed to ensure policy")
 		return 1
@@ -395,15 +441,15 @@ func cmdRecord(args []string, cfg CLIConfig) int {
 	}
 
 	proxy := httputil.NewSingleHostReverseProxy(upstreamURL)
-	proxy.Transport = vcrruntime.NewRecordingTransport(ctx, store, endpoints, proxy.Transport, *maxVariantsFlag)
+	recorder := vcrruntime.NewRecordingTransport(ctx, store, endpoints, proxy.Transport, *maxVariantsFlag)
+	recorder.Mode = mode
+	proxy.Transport = recorder
 	originalDirector := proxy.Director
 	proxy.Director = func(req *http.Request) {
 		originalDirector(req)
 		req.Host = upstreamURL.Host
 		// Prefer uncompressed responses for stable recordings.
-		if req.Method == http.MethodGet {
-			req.Header.Del("Accept-Encoding")
-		}
+		req.Header.Del("Accept-Encoding")
 	}
 
 	addr := fmt.Sprintf(":%d", *portFlag)
@@ -440,14 +486,56 @@ func cmdPlay(args []string, cfg CLIConfig) int {
 	fs.SetOutput(os.Stderr)
 	portFlag := fs.Int("port", cfg.DefaultPort, "Port to listen on")
 	scenarioFlag := fs.String("scenario", cfg.DefaultScenario, "Scenario name (streaming + background-override endpoints)")
+	modeFlag := fs.String("mode", "", "Stub miss handling overriding vcr.json: none (501), fallthrough (proxy to the upstream), new_episodes or once (proxy and record)")
+	fallbackFlag := fs.Bool("fallback", false, "Answer misses with the nearest stub (same route params, most shared query parameters, or the undiversified stub); same as \"fallback\": true in vcr.json")
+	streamTimingFlag := fs.Bool("stream-timing", false, "Replay recorded server-sent events and WebSocket messages with their original delays")
+	latencyFlag := fs.String("latency", "", "Delay stub responses: a duration (250ms), a range (100ms-400ms), recorded (the recorded timings) or none; overrides latency in vcr.json")
+	faultsFlag := fs.String("faults", "", "Inject faults into stub responses, as percentages: error=5,reset=1,truncate=2,drip=10,timeout=1 (plus status=503, drip_rate=100); overrides faults in vcr.json")
+	strictFlag := fs.Bool("strict", false, "Fail (exit 1) at shutdown if a request was not answered from a stub or a stub was never served, and print a report")
+	faultSeedFlag := fs.String("fault-seed", "", "Seed for fault injection, to reproduce a run; overrides fault_seed in vcr.json (default: random, logged)")
+	noAdminFlag := fs.Bool("no-admin", false, "Do not serve the admin API under "+vcrruntime.AdminPrefix)
+	watchFlag := fs.Bool("watch", false, "Reload vcr.json and pick up stub changes in <background-dir> while serving, logging each change")
+	cacheFlag := fs.Bool("cache", false, "Preload stubs into memory instead of reading them from <background-dir> on every request; stub edits then need -watch")
 
 	fs.Usage = func() {
 		fmt.Fprintf(os.Stderr,
 			"Usage: %s play [options] <background-dir>\n\n"+
 				"Serve recorded VCR stubs as an HTTP API using Goa-generated server code and\n"+
 				"goa-vcr generated glue.\n\n"+
-				"Streaming endpoints (WebSocket/SSE) require a scenario handler; unary endpoints\n"+
-				"fall back to stubbed background behavior when no scenario handler is set.\n\n"+
+				"Endpoints without a scenario handler fall back to stubbed background behavior:\n"+
+				"SSE endpoints replay the recorded events and WebSocket endpoints the recorded\n"+
+				"conversation, all at once or, with -stream-timing, with their recorded delays.\n\n"+
+				"Requests without a stub fail with 501. Other record modes (-mode, or mode /\n"+
+				"endpoints.<EndpointName>.record.mode in vcr.json, where all counts as none)\n"+
+				"proxy them to the vcr.json upstream instead:\n"+
+				"  fallthrough   serve the upstream response without recording it\n"+
+				"  new_episodes  record the upstream response as a new stub, then serve it\n"+
+				"  once          like new_episodes, but only for endpoints with no stubs yet\n\n"+
+				"With -fallback (mode none only), a miss is answered by the nearest stub of the\n"+
+				"endpoint: the one for the same route params, then the one sharing the most\n"+
+				"query parameters, then the undiversified stub. Each fallback is logged.\n\n"+
+				"With -latency, responses served from stubs are delayed to surface loading\n"+
+				"states and timeouts, whatever latency vcr.json sets.\n\n"+
+				"With -faults, a share of the responses served from stubs fail: 5xx errors,\n"+
+				"connection resets, truncated or slowly dripped bodies, or no answer at all.\n"+
+				"The seed is logged; pass it back with -fault-seed to reproduce a run.\n\n"+
+				"With -strict, playback must be exhaustive: requests that match no endpoint\n"+
+				"or have no stub, and stubs that are never served, are reported at shutdown\n"+
+				"(SIGINT or SIGTERM) and make play exit with status 1.\n\n"+
+				"Unless -no-admin is set, an admin API under /__vcr/ lets tests drive the\n"+
+				"server at runtime (JSON bodies):\n"+
+				"  GET|PUT /__vcr/scenario          current scenario; load {\"scenario\": name}\n"+
+				"  POST /__vcr/scenario/reset       load the current scenario again\n"+
+				"  POST /__vcr/sequences/reset      replay stub sequences from the start\n"+
+				"  GET /__vcr/stubs                 stubs and their hit counts\n"+
+				"  GET|PUT|DELETE /__vcr/latency    latency override {\"latency\": \"250ms\"}\n"+
+				"  GET|PUT|DELETE /__vcr/faults     fault override {\"faults\": {\"error\": 5}}\n"+
+				"  POST /__vcr/reload               read vcr.json again\n\n"+
+				"Stubs are read from disk on every request, so stub edits show up at once.\n"+
+				"With -cache, they are read into memory at startup instead. With -watch,\n"+
+				"edits to vcr.json and to stub files (also when cached) take effect as soon\n"+
+				"as they are saved; each change is logged, and an invalid vcr.json is\n"+
+				"ignored.\n\n"+
 				"Options:\n",
 			cfg.AppName,
 		)
@@ -475,6 +563,19 @@ func cmdPlay(args []string, cfg CLIConfig) int {
 	ctx := cmdContext(cfg.AppName)
 	ctx = log.With(ctx, log.KV{K: "subcmd", V: "play"})
 
+	var mode vcrruntime.RecordMode
+	if *modeFlag != "" {
+		m, err := vcrruntime.ParseRecordMode(*modeFlag)
+		if err == nil && m == vcrruntime.RecordModeAll {
+			err = fmt.Errorf("play always serves existing stubs; use -mode new_episodes, or record -mode all")
+		}
+		if err != nil {
+			log.Errorf(ctx, err, "invalid mode")
+			return 1
+		}
+		mode = m
+	}
+
 	store, err := vcrruntime.New(outDir)
 	if err != nil {
 		log.Errorf(ctx, err, "failed to load policy")
@@ -484,6 +585,42 @@ func cmdPlay(args []string, cfg CLIConfig) int {
 		log.Errorf(ctx, fmt.Errorf("%s must exist and define an upstream", vcrruntime.PolicyFileName), "invalid policy")
 		return 1
 	}
+	if *fallbackFlag {
+		store.Policy.Fallback = true
+	}
+	if *cacheFlag {
+		if err := store.Preload(); err != nil {
+			log.Errorf(ctx, err, "failed to load stubs")
+			return 1
+		}
+	}
+	var latency *vcrruntime.Latency
+	if *latencyFlag != "" {
+		l, err := vcrruntime.ParseLatency(*latencyFlag)
+		if err != nil {
+			log.Errorf(ctx, err, "invalid latency")
+			return 1
+		}
+		latency = &l
+	}
+	var faults *vcrruntime.Faults
+	if *faultsFlag != "" {
+		f, err := vcrruntime.ParseFaults(*faultsFlag)
+		if err != nil {
+			log.Errorf(ctx, err, "invalid faults")
+			return 1
+		}
+		faults = &f
+	}
+	var faultSeed *uint64
+	if *faultSeedFlag != "" {
+		seed, err := strconv.ParseUint(*faultSeedFlag, 10, 64)
+		if err != nil {
+			log.Errorf(ctx, err, "invalid fault seed")
+			return 1
+		}
+		faultSeed = &seed
+	}
 
 	addr := fmt.Sprintf("127.0.0.1:%d", *portFlag)
 	baseURL := fmt.Sprintf("http://%s", addr)
@@ -494,14 +631,42 @@ func cmdPlay(args []string, cfg CLIConfig) int {
 		return 1
 	}
 
+	// Misses reach the upstream through a recorder, which saves them as new
+	// stubs unless the mode of their endpoint is fallthrough.
+	recorder := vcrruntime.NewRecordingTransport(ctx, store, Endpoints(), nil, cfg.DefaultMaxVariants)
+	recorder.Mode = mode
+
 	loopbackDoer := vcrruntime.NewStubDoer(store, Endpoints())
-	sc, _, err := BuildScenario(baseURL, loopbackDoer, factory)
+	loopbackDoer.Mode = mode
+	loopbackDoer.Upstream = recorder
+	loopbackDoer.StreamTiming = *streamTimingFlag
+	loopbackDoer.Latency = latency
+	loopbackDoer.Faults = faults
+	loopbackDoer.FaultSeed = faultSeed
+	loopbackDoer.Strict = *strictFlag
+	sc, client, err := BuildScenario(baseURL, loopbackDoer, factory)
 	if err != nil {
 		log.Errorf(ctx, err, "failed to build scenario")
 		return 1
 	}
 
-	h, err := NewPlaybackHandler(store, sc, PlaybackOptions{ScenarioName: *scenarioFlag})
+	// Reloading vcr.json keeps -fallback in effect.
+	reloadPolicy := func() error {
+		return store.ReloadPolicy(func(p *vcrruntime.Policy) {
+			if *fallbackFlag {
+				p.Fallback = true
+			}
+		})
+	}
+	var admin *vcrruntime.Admin
+	if !*noAdminFlag {
+		admin = newPlayAdmin(store, cfg, *scenarioFlag, &sc, client, reloadPolicy)
+		admin.Doers = append(admin.Doers, loopbackDoer)
+		admin.Latency = latency
+		admin.Faults = faults
+	}
+
+	h, err := NewPlaybackHandler(store, sc, PlaybackOptions{ScenarioName: *scenarioFlag, Mode: mode, Upstream: recorder, StreamTiming: *streamTimingFlag, Latency: latency, Faults: faults, FaultSeed: faultSeed, Strict: *strictFlag, Admin: admin})
 	if err != nil {
 		log.Errorf(ctx, err, "failed to build playback handler")
 		return 1
@@ -510,6 +675,12 @@ func cmdPlay(args []string, cfg CLIConfig) int {
 	// then run the debug access log middleware.
 	h = vcrAccessLog(store)(h)
 	h = withRequestLogContext(h)
+	if admin != nil {
+		mux := http.NewServeMux()
+		mux.Handle(vcrruntime.AdminPrefix, admin)
+		mux.Handle("/", h)
+		h = mux
+	}
 
 	httpServer := &http.Server{
 		Addr:              addr,
@@ -529,15 +700,59 @@ func cmdPlay(args []string, cfg CLIConfig) int {
 		_ = httpServer.Close()
 	}()
 
+	if *watchFlag {
+		watcher := &vcrruntime.Watcher{Store: store, Reload: reloadPolicy}
+		if _, err := watcher.Check(ctx); err != nil {
+			log.Errorf(ctx, err, "failed to watch stubs")
+			return 1
+		}
+		go func() { _ = watcher.Run(ctx) }()
+	}
+
 	log.Print(ctx, log.KV{K: "http-addr", V: addr}, log.KV{K: "vcr.scenario", V: *scenarioFlag})
 
 	if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Errorf(ctx, err, "server error")
 		return 1
 	}
+	if *strictFlag {
+		report, err := store.StrictReport()
+		if err != nil {
+			log.Errorf(ctx, err, "failed to build strict report")
+			return 1
+		}
+		fmt.Fprint(os.Stderr, report)
+		if !report.OK() {
+			return 1
+		}
+	}
 	return 0
 }
 
+// newPlayAdmin returns the admin API of the play command. Loading a scenario
+// swaps the handlers of sc for those built by its factory with client.
+func newPlayAdmin(store *vcrruntime.VCR, cfg CLIConfig, scenario string, sc *Scenario, client *httpclient.Client, reload func() error) *vcrruntime.Admin {
+	names := make([]string, 0, len(cfg.ScenarioRegistry))
+	for name := range cfg.ScenarioRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return &vcrruntime.Admin{
+		Store:     store,
+		Scenarios: names,
+		Scenario:  scenario,
+		LoadScenario: func(name string) error {
+			factory, ok := cfg.ScenarioRegistry[name]
+			if !ok {
+				return fmt.Errorf("%w %q", vcrruntime.ErrUnknownScenario, name)
+			}
+			sc.Replace(factory(client).Scenario)
+			return nil
+		},
+		Reload: reload,
+	}
+}
+
 const defaultContentType = "application/json"
 
 // cmdRefresh implements the "refresh" subcommand.
@@ -553,7 +768,7 @@ func cmdRefresh(args []string, cfg CLIConfig) int {
 			"Usage: %s refresh [options] <testdata-dir>\n\n"+
 				"Refresh VCR stubs by re-fetching from upstream endpoints.\n\n"+
 				"For each .vcr.har file found in the testdata directory, this command:\n"+
-				"  1. Parses HAR request metadata to extract URL, method\n"+
+				"  1. Parses HAR request metadata to extract URL, method and payload\n"+
 				"  2. Validates all files in a directory target the same hostname\n"+
 				"  3. Makes HTTP requests with the provided auth token\n"+
 				"  4. Writes responses to corresponding .vcr.json files and updates HAR metadata\n\n"+
@@ -592,6 +807,60 @@ func cmdRefresh(args []string, cfg CLIConfig) int {
 	return 0
 }
 
+// cmdScan implements the "scan" subcommand.
+func cmdScan(args []string, cfg CLIConfig) int {
+	fs := flag.NewFlagSet("scan", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr,
+			"Usage: %s scan <testdata-dir>...\n\n"+
+				"Report likely secrets in recorded VCR stubs: credential headers such as\n"+
+				"Set-Cookie, JWTs, bearer tokens, access keys, private keys, secret-looking\n"+
+				"JSON fields and query parameters, and email addresses. Values already\n"+
+				"replaced by the redact section of vcr.json are not reported.\n\n"+
+				"Exits with status 2 if anything is found, so it can guard commits.\n\n"+
+				"Examples:\n"+
+				"  %[1]s scan ./testdata\n",
+			cfg.AppName,
+		)
+	}
+
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 1
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 1
+	}
+
+	found := 0
+	for _, dir := range fs.Args() {
+		store, err := vcrruntime.New(dir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			return 1
+		}
+		findings, err := store.ScanStubs()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s: %v\n", dir, err)
+			return 1
+		}
+		for _, f := range findings {
+			fmt.Printf("%s: %s: %s: %s\n", filepath.Join(dir, f.Stub+".vcr.har"), f.Location, f.Rule, f.Excerpt)
+		}
+		found += len(findings)
+	}
+	if found > 0 {
+		fmt.Fprintf(os.Stderr, "%d likely secret(s) found; add redact rules to %s and re-record\n", found, vcrruntime.PolicyFileName)
+		return 2
+	}
+	return 0
+}
+
 func ensurePolicy(dir, upstream string, upstreamSet bool) error {
 	path := filepath.Join(dir, vcrruntime.PolicyFileName)
 	if _, err := os.Stat(path); err == nil {
@@ -636,9 +905,9 @@ func refreshDir(dir, token string, dryRun, verbose bool) error {
 		return err
 	}
 
-	files, err := scanDir(dir)
+	files, err := store.ListStubs()
 	if err != nil {
-		return err
+		return fmt.Errorf("read dir: %w", err)
 	}
 	if len(files) == 0 {
 		fmt.Fprintf(os.Stderr, "%s: no .vcr.har files found\n", dir)
@@ -649,32 +918,14 @@ func refreshDir(dir, token string, dryRun, verbose bool) error {
 		return err
 	}
 
-	matcher := vcrruntime.NewRouteMatcher(Endpoints())
 	for _, name := range files {
-		if err := executeVCR(store, matcher, name, token, dryRun, verbose); err != nil {
+		if err := executeVCR(store, name, token, dryRun, verbose); err != nil {
 			fmt.Fprintf(os.Stderr, "%s.vcr.har: %v\n", name, err)
 		}
 	}
 	return nil
 }
 
-func scanDir(dir string) ([]string, error) {
-	entries, err := os.ReadDir(dir)
-	if err != nil {
-		return nil, fmt.Errorf("read dir: %w", err)
-	}
-
-	var files []string
-	for _, entry := range entries {
-		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".vcr.har") || entry.Name() == vcrruntime.PolicyFileName {
-			continue
-		}
-		name := strings.TrimSuffix(entry.Name(), ".vcr.har")
-		files = append(files, name)
-	}
-	return files, nil
-}
-
 func validateHosts(store *vcrruntime.VCR, files []string, verbose bool) error {
 	if len(files) == 0 {
 		return nil
@@ -719,24 +970,28 @@ func validateHosts(store *vcrruntime.VCR, files []string, verbose bool) error {
 	return nil
 }
 
-func executeVCR(store *vcrruntime.VCR, matcher *vcrruntime.RouteMatcher, name string, token string, dryRun, verbose bool) error {
+func executeVCR(store *vcrruntime.VCR, name string, token string, dryRun, verbose bool) error {
 	endpointName, diversifier := splitStubKey(name)
 	reqSpec, err := store.ReadRequest(endpointName, diversifier)
 	if err != nil {
 		return fmt.Errorf("read %s: %w", name, err)
 	}
 	if verbose || dryRun {
-		fmt.Printf("%s: GET %s\n", name, reqSpec.URL)
+		fmt.Printf("%s: %s %s\n", name, reqSpec.Method, reqSpec.URL)
 	}
 	if dryRun {
 		return nil
 	}
 
-	body, status, headers, err := doRequest(&reqSpec, token)
+	resp, err := doRequest(&reqSpec, token)
 	if err != nil {
 		return fmt.Errorf("request: %w", err)
 	}
-	if !json.Valid(body) {
+	body, status, headers := resp.Body, resp.Status, resp.Header
+	if !store.Policy.RecordStatus(endpointName, status) {
+		return fmt.Errorf("HTTP %d: %s", status, string(body))
+	}
+	if len(bytes.TrimSpace(body)) > 0 && !json.Valid(body) {
 		return fmt.Errorf("response is not JSON")
 	}
 
@@ -752,29 +1007,58 @@ func executeVCR(store *vcrruntime.VCR, matcher *vcrruntime.RouteMatcher, name st
 		mimeType = defaultContentType
 	}
 
-	// Recompute diversifier from the request URL using the route matcher and policy.
-	newDiv, err := requestDiversifierForURL(store, matcher, reqSpec.URL)
-	if err != nil {
-		return fmt.Errorf("compute diversifier: %w", err)
-	}
-
-	if err := store.WriteStub(endpointName, vcrruntime.RequestSpec{URL: reqSpec.URL}, vcrruntime.ResponseMeta{
-		Status:   status,
-		Headers:  firstHeaderValues(headers),
-		MimeType: mimeType,
-		Size:     len(blobBytes),
-	}, blobBytes, newDiv); err != nil {
+	// Write the stub back under the key it was read from: the recorded request
+	// may be redacted, so a diversifier computed from it may not be the one
+	// playback computes for the live request.
+	if err := store.WriteStub(endpointName, reqSpec, vcrruntime.ResponseMeta{
+		Status:      status,
+		Headers:     headers,
+		MimeType:    mimeType,
+		Size:        len(blobBytes),
+		HTTPVersion: resp.Proto,
+		RedirectURL: headers.Get("Location"),
+		StartedAt:   resp.StartedAt,
+		Timings:     resp.Timings,
+	}, blobBytes, diversifier); err != nil {
 		return err
 	}
 
-	fmt.Printf("%s: wrote %d bytes to %s\n", name, len(blobBytes), stubKey(endpointName, newDiv)+".vcr.json")
+	fmt.Printf("%s: wrote %d bytes to %s\n", name, len(blobBytes), name+".vcr.json")
 	return nil
 }
 
-func doRequest(req *vcrruntime.RequestSpec, token string) ([]byte, int, http.Header, error) {
-	httpReq, err := http.NewRequestWithContext(context.Background(), http.MethodGet, req.URL, nil)
+// refreshResponse is the upstream answer to a replayed stub request.
+type refreshResponse struct {
+	Body      []byte
+	Status    int
+	Proto     string
+	Header    http.Header
+	StartedAt time.Time
+	Timings   vcrruntime.Timings
+}
+
+// doRequest replays a recorded request, including its recorded headers, against
+// the upstream. Transport-level headers are left to the HTTP client.
+func doRequest(req *vcrruntime.RequestSpec, token string) (*refreshResponse, error) {
+	var reqBody io.Reader
+	if len(req.Body) > 0 {
+		reqBody = bytes.NewReader(req.Body)
+	}
+	httpReq, err := http.NewRequestWithContext(context.Background(), req.Method, req.URL, reqBody)
 	if err != nil {
-		return nil, 0, nil, fmt.Errorf("create request: %w", err)
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	for name, values := range req.Headers {
+		switch http.CanonicalHeaderKey(name) {
+		case "Host", "Content-Length", "Accept-Encoding", "Connection":
+			continue
+		}
+		for _, value := range values {
+			httpReq.Header.Add(name, value)
+		}
+	}
+	if req.MimeType != "" {
+		httpReq.Header.Set("Content-Type", req.MimeType)
 	}
 
 	if token != "" {
@@ -785,37 +1069,27 @@ func doRequest(req *vcrruntime.RequestSpec, token string) ([]byte, int, http.Hea
 	}
 
 	client := &http.Client{Timeout: 60 * time.Second}
+	startedAt := time.Now()
 	resp, err := client.Do(httpReq)
 	if err != nil {
-		return nil, 0, nil, fmt.Errorf("http: %w", err)
+		return nil, fmt.Errorf("http: %w", err)
 	}
 	defer resp.Body.Close()
+	wait := time.Since(startedAt)
 
+	receiveStart := time.Now()
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, 0, nil, fmt.Errorf("read response: %w", err)
-	}
-	if resp.StatusCode >= 400 {
-		return nil, 0, nil, fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(body))
-	}
-	return body, resp.StatusCode, resp.Header, nil
-}
-
-func requestDiversifierForURL(store *vcrruntime.VCR, matcher *vcrruntime.RouteMatcher, rawURL string) (string, error) {
-	u, err := url.Parse(rawURL)
-	if err != nil {
-		return "", err
-	}
-	r, err := http.NewRequest(http.MethodGet, rawURL, nil)
-	if err != nil {
-		return "", err
-	}
-	endpointName, vars, ok := matcher.Match(r)
-	if !ok {
-		// If we can't match, fall back to query-only diversifier (best effort).
-		return vcrruntime.QueryDiversifier(u.Query()), nil
-	}
-	return vcrruntime.RequestDiversifier(store.Policy, endpointName, u.Query(), vars), nil
+		return nil, fmt.Errorf("read response: %w", err)
+	}
+	return &refreshResponse{
+		Body:      body,
+		Status:    resp.StatusCode,
+		Proto:     resp.Proto,
+		Header:    resp.Header,
+		StartedAt: startedAt,
+		Timings:   vcrruntime.Timings{Wait: wait, Receive: time.Since(receiveStart)},
+	}, nil
 }
 
 func splitStubKey(name string) (string, string) {
@@ -825,25 +1099,4 @@ func splitStubKey(name string) (string, string) {
 	}
 	return name, ""
 }
-
-func stubKey(endpointName, diversifier string) string {
-	if diversifier == "" {
-		return endpointName
-	}
-	return endpointName + "--" + diversifier
-}
-
-func firstHeaderValues(headers http.Header) map[string]string {
-	if len(headers) == 0 {
-		return nil
-	}
-	out := make(map[string]string, len(headers))
-	for name, values := range headers {
-		if len(values) == 0 {
-			continue
-		}
-		out[name] = values[0]
-	}
-	return out
-}
 `
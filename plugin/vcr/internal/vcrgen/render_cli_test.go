@@ -44,5 +44,13 @@ func TestRenderServiceVCRCLI_WritesCLIFile(t *testing.T) {
 	assertContains(t, src, "func Usage(")
 	assertContains(t, src, "Endpoints()")
 	assertContains(t, src, "BuildScenario(")
+	assertContains(t, src, "func cmdScan(")
+	assertContains(t, src, "vcrruntime.WithStubMatch(ctx)")
 	assertContains(t, src, "NewPlaybackHandler(")
+	assertContains(t, src, `recorder.Mode = mode`)
+	assertContains(t, src, `PlaybackOptions{ScenarioName: *scenarioFlag, Mode: mode, Upstream: recorder, StreamTiming: *streamTimingFlag, Latency: latency, Faults: faults, FaultSeed: faultSeed, Strict: *strictFlag, Admin: admin}`)
+	assertContains(t, src, `mux.Handle(vcrruntime.AdminPrefix, admin)`)
+	assertContains(t, src, `sc.Replace(factory(client).Scenario)`)
+	assertContains(t, src, `&vcrruntime.Watcher{Store: store, Reload: reloadPolicy}`)
+	assertContains(t, src, `store.Preload()`)
 }
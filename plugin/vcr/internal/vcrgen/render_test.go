@@ -47,6 +47,46 @@ func TestRenderServiceVCR_UnaryDispatchIncludesLoopbackBypassAndFallback(t *test
 	assertContains(t, src, `type ServiceGetThingFunc`)
 	assertContains(t, src, `func (s *Scenario) SetGetThing`)
 	assertContains(t, src, `func (s *Scenario) AddGetThing`)
+	assertContains(t, src, `doer.Faults = opts.Faults`)
+	assertContains(t, src, `func (j *Journal) CallsToGetThing() []vcrruntime.Call`)
+	assertContains(t, src, `vcrruntime.MarkScenarioCall(ctx)`)
+	assertContains(t, src, `opts.Admin.Doers = append(opts.Admin.Doers, doer)`)
+	assertContains(t, src, `h = vcrruntime.JournalMiddleware(doer, h)`)
+	assertContains(t, src, `vcrruntime.StrictMiddleware(doer, mux)`)
+	assertContains(t, src, `h = vcrruntime.FaultMiddleware(h)`)
+}
+
+func TestRenderServiceVCR_BackgroundClientMapsStubErrors(t *testing.T) {
+	spec := ServiceSpec{
+		GenPkg:          "github.com/example/proj/gen",
+		ServicePathName: "toy",
+		ServicePkgName:  "toy",
+		Endpoints: []EndpointSpec{
+			{
+				MethodVarName: "GetThing",
+				PayloadRef:    "*toy.GetThingPayload",
+				ResultRef:     "*toy.Thing",
+				Errors:        []ErrorSpec{{Name: "not_found", MakeName: "MakeNotFound", StatusCode: "http.StatusNotFound"}},
+				Routes:        []RouteSpec{{Verb: "GET", Path: "/things/{id}"}},
+			},
+		},
+	}
+
+	f := RenderServiceVCR(spec)
+	outPath, err := f.Render(t.TempDir())
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	data, err := os.ReadFile(outPath)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	src := string(data)
+
+	assertContains(t, src, `GetThingEndpoint: withStubErrors(hc.GetThing(), stubErrorGetThing)`)
+	assertContains(t, src, `case stub.Status == http.StatusNotFound && (name == "" || name == "not_found"):`)
+	assertContains(t, src, `return toy.MakeNotFound(err)`)
+	assertContains(t, src, `return vcrruntime.StubStatusError(stub.Status, err)`)
 }
 
 func TestRenderServiceVCR_WebSocketUsesUpgrader(t *testing.T) {
@@ -82,6 +122,9 @@ func TestRenderServiceVCR_WebSocketUsesUpgrader(t *testing.T) {
 	assertContains(t, src, `server.Mount(mux)`)
 	assertContains(t, src, `v.(*toyws.StreamThingsEndpointInput)`)
 	assertContains(t, src, `return nil, f(ctx, in.Payload, in.Stream)`)
+	assertContains(t, src, `StreamThings: makeEndpointStreamThings(doer, scenario, upgrader),`)
+	assertContains(t, src, `err := doer.ReplayWebSocket(ctx, upgrader)`)
+	assertContains(t, src, `h = vcrruntime.WebSocketMiddleware(h)`)
 }
 
 func TestRenderServiceVCR_UnaryViewedResultWrapsWithNewViewed(t *testing.T) {
@@ -5,6 +5,7 @@ type ServiceSpec struct {
 	ServicePathName string
 	ServicePkgName  string
 	HasWebSocket    bool
+	HasSSE          bool
 	HasViewedResult bool
 	Endpoints       []EndpointSpec
 }
@@ -15,6 +16,10 @@ type EndpointSpec struct {
 	PayloadRef    string
 	ResultRef     string
 	IsStreaming   bool
+	// IsSSE is true for server-sent event endpoints. Without a scenario
+	// handler, playback replays their recorded events. Other streaming
+	// endpoints are WebSockets, whose recorded conversation is replayed.
+	IsSSE bool
 	// ViewedResultInitName is the name of the generated helper that constructs the
 	// viewed result wrapper from the service result, e.g. NewViewedOrganizationCollection.
 	// Empty when the method does not return a viewed result.
@@ -27,7 +32,20 @@ type EndpointSpec struct {
 	// has extra return values in this case, so makeEndpoint must call the raw
 	// endpoint field instead.
 	SkipResponseBodyEncodeDecode bool
-	Routes                       []RouteSpec
+	// Errors lists the design errors of type ErrorResult together with the
+	// HTTP status they are mapped to. Recorded error stubs with a matching
+	// status are turned into the corresponding Goa service error.
+	Errors []ErrorSpec
+	Routes []RouteSpec
+}
+
+type ErrorSpec struct {
+	// Name is the design error name, e.g. "not_found".
+	Name string
+	// MakeName is the service package helper that builds the error, e.g. MakeNotFound.
+	MakeName string
+	// StatusCode is the Go expression for the HTTP status, e.g. http.StatusNotFound.
+	StatusCode string
 }
 
 type RouteSpec struct {
@@ -0,0 +1,273 @@
+package runtime
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// AdminPrefix is the path under which play servers mount Admin.
+const AdminPrefix = "/__vcr/"
+
+// ErrUnknownScenario is returned by Admin.LoadScenario callbacks for names
+// that are not registered.
+var ErrUnknownScenario = errors.New("unknown scenario")
+
+// Admin serves the runtime admin API of a play server under AdminPrefix. It
+// lets tests switch scenarios, rewind sequences, inspect stub usage and change
+// latency and faults without restarting the server:
+//
+//	GET    /__vcr/scenario           current and registered scenarios
+//	PUT    /__vcr/scenario           load {"scenario": name}
+//	POST   /__vcr/scenario/reset     load the current scenario again
+//	POST   /__vcr/sequences/reset    replay every sequence from the start
+//	GET    /__vcr/stubs              stub keys with their hit counts
+//	GET    /__vcr/latency            latency override, null if none
+//	PUT    /__vcr/latency            set {"latency": "100ms-400ms"}
+//	DELETE /__vcr/latency            use the latency in vcr.json again
+//	GET    /__vcr/faults             fault override, null if none
+//	PUT    /__vcr/faults             set {"faults": {"error": 5}}
+//	DELETE /__vcr/faults             use the faults in vcr.json again
+//	POST   /__vcr/reload             read vcr.json again
+//
+// Responses are JSON; errors are {"error": message}. Configure the fields
+// before serving requests.
+type Admin struct {
+	// Store is the store served by the play server.
+	Store *VCR
+	// Doers receive latency and fault overrides.
+	Doers []*StubDoer
+	// Scenarios lists the names LoadScenario accepts.
+	Scenarios []string
+	// Scenario is the name of the scenario loaded when the server started.
+	Scenario string
+	// LoadScenario replaces the scenario handlers with those of the named
+	// scenario, with fresh queues. If nil, scenarios cannot be switched.
+	LoadScenario func(name string) error
+	// Reload reads vcr.json again. If nil, Store.ReloadPolicy is used.
+	Reload func() error
+	// Latency and Faults are the overrides the Doers were configured with,
+	// reported until they are changed through the API.
+	Latency *Latency
+	Faults  *Faults
+
+	once sync.Once
+	mux  *http.ServeMux
+	mu   sync.Mutex
+	// current, latency and faults are the settings in effect.
+	current string
+	latency *Latency
+	faults  *Faults
+}
+
+// StubHit is a stub key with the number of requests it answered.
+type StubHit struct {
+	Key  string `json:"key"`
+	Hits int    `json:"hits"`
+}
+
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.once.Do(a.init)
+	a.mux.ServeHTTP(w, r)
+}
+
+func (a *Admin) init() {
+	a.current = a.Scenario
+	a.latency = a.Latency
+	a.faults = a.Faults
+	p := strings.TrimSuffix(AdminPrefix, "/")
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+p+"/scenario", a.getScenario)
+	mux.HandleFunc("PUT "+p+"/scenario", a.putScenario)
+	mux.HandleFunc("POST "+p+"/scenario/reset", a.resetScenario)
+	mux.HandleFunc("POST "+p+"/sequences/reset", a.resetSequences)
+	mux.HandleFunc("GET "+p+"/stubs", a.getStubs)
+	mux.HandleFunc("GET "+p+"/latency", a.getLatency)
+	mux.HandleFunc("PUT "+p+"/latency", a.putLatency)
+	mux.HandleFunc("DELETE "+p+"/latency", a.deleteLatency)
+	mux.HandleFunc("GET "+p+"/faults", a.getFaults)
+	mux.HandleFunc("PUT "+p+"/faults", a.putFaults)
+	mux.HandleFunc("DELETE "+p+"/faults", a.deleteFaults)
+	mux.HandleFunc("POST "+p+"/reload", a.reload)
+	mux.HandleFunc(p+"/", func(w http.ResponseWriter, r *http.Request) {
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("unknown admin route %s %s", r.Method, r.URL.Path))
+	})
+	a.mux = mux
+}
+
+type scenarioBody struct {
+	Scenario  string   `json:"scenario"`
+	Scenarios []string `json:"scenarios,omitempty"`
+}
+
+func (a *Admin) getScenario(w http.ResponseWriter, _ *http.Request) {
+	a.mu.Lock()
+	current := a.current
+	a.mu.Unlock()
+	writeAdminJSON(w, http.StatusOK, scenarioBody{Scenario: current, Scenarios: a.Scenarios})
+}
+
+func (a *Admin) putScenario(w http.ResponseWriter, r *http.Request) {
+	var body scenarioBody
+	if !readAdminJSON(w, r, &body) {
+		return
+	}
+	a.loadScenario(w, body.Scenario)
+}
+
+func (a *Admin) resetScenario(w http.ResponseWriter, _ *http.Request) {
+	a.mu.Lock()
+	current := a.current
+	a.mu.Unlock()
+	a.loadScenario(w, current)
+}
+
+func (a *Admin) loadScenario(w http.ResponseWriter, name string) {
+	if a.LoadScenario == nil {
+		writeAdminError(w, http.StatusNotImplemented, errors.New("scenarios cannot be switched"))
+		return
+	}
+	if len(a.Scenarios) > 0 && !slices.Contains(a.Scenarios, name) {
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("%w %q", ErrUnknownScenario, name))
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.LoadScenario(name); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrUnknownScenario) {
+			status = http.StatusNotFound
+		}
+		writeAdminError(w, status, err)
+		return
+	}
+	a.current = name
+	writeAdminJSON(w, http.StatusOK, scenarioBody{Scenario: name, Scenarios: a.Scenarios})
+}
+
+func (a *Admin) resetSequences(w http.ResponseWriter, _ *http.Request) {
+	a.Store.ResetSequences()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Admin) getStubs(w http.ResponseWriter, _ *http.Request) {
+	keys, err := a.Store.ListStubs()
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	hits := a.Store.StubHits()
+	stubs := make([]StubHit, 0, len(keys))
+	for _, key := range keys {
+		stubs = append(stubs, StubHit{Key: key, Hits: hits[key]})
+	}
+	slices.SortFunc(stubs, func(x, y StubHit) int { return strings.Compare(x.Key, y.Key) })
+	writeAdminJSON(w, http.StatusOK, stubs)
+}
+
+type latencyBody struct {
+	Latency *Latency `json:"latency"`
+}
+
+func (a *Admin) getLatency(w http.ResponseWriter, _ *http.Request) {
+	a.mu.Lock()
+	body := latencyBody{Latency: a.latency}
+	a.mu.Unlock()
+	writeAdminJSON(w, http.StatusOK, body)
+}
+
+func (a *Admin) putLatency(w http.ResponseWriter, r *http.Request) {
+	var body latencyBody
+	if !readAdminJSON(w, r, &body) {
+		return
+	}
+	a.setLatency(w, body.Latency)
+}
+
+func (a *Admin) deleteLatency(w http.ResponseWriter, _ *http.Request) {
+	a.setLatency(w, nil)
+}
+
+func (a *Admin) setLatency(w http.ResponseWriter, l *Latency) {
+	a.mu.Lock()
+	a.latency = l
+	for _, d := range a.Doers {
+		d.SetLatency(l)
+	}
+	a.mu.Unlock()
+	writeAdminJSON(w, http.StatusOK, latencyBody{Latency: l})
+}
+
+type faultsBody struct {
+	Faults *Faults `json:"faults"`
+}
+
+func (a *Admin) getFaults(w http.ResponseWriter, _ *http.Request) {
+	a.mu.Lock()
+	body := faultsBody{Faults: a.faults}
+	a.mu.Unlock()
+	writeAdminJSON(w, http.StatusOK, body)
+}
+
+func (a *Admin) putFaults(w http.ResponseWriter, r *http.Request) {
+	var body faultsBody
+	if !readAdminJSON(w, r, &body) {
+		return
+	}
+	if err := body.Faults.Validate(); err != nil {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid faults: %w", err))
+		return
+	}
+	a.setFaults(w, body.Faults)
+}
+
+func (a *Admin) deleteFaults(w http.ResponseWriter, _ *http.Request) {
+	a.setFaults(w, nil)
+}
+
+func (a *Admin) setFaults(w http.ResponseWriter, f *Faults) {
+	a.mu.Lock()
+	a.faults = f
+	for _, d := range a.Doers {
+		d.SetFaults(f)
+	}
+	a.mu.Unlock()
+	writeAdminJSON(w, http.StatusOK, faultsBody{Faults: f})
+}
+
+func (a *Admin) reload(w http.ResponseWriter, _ *http.Request) {
+	reload := a.Reload
+	if reload == nil {
+		reload = func() error { return a.Store.ReloadPolicy() }
+	}
+	if err := reload(); err != nil {
+		writeAdminError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// readAdminJSON decodes the request body into v, answering 400 if it cannot.
+func readAdminJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid body: %w", err))
+		return false
+	}
+	return true
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	writeAdminJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,165 @@
+package runtime
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminServesRuntimeControls(t *testing.T) {
+	storage := memoryStorageWithPolicy(t, `{"upstream":"https://example.com","endpoints":{"Poll":{"sequence":{"end":"error"}}}}`)
+	store, err := NewWithStorage(storage)
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	body := []byte(`{}`)
+	meta := ResponseMeta{Status: 200, MimeType: "application/json", Size: len(body)}
+	for range 2 {
+		if err := store.AppendStub("Poll", RequestSpec{URL: "http://example.com/poll"}, meta, body); err != nil {
+			t.Fatalf("append stub: %v", err)
+		}
+	}
+	if err := store.WriteStub("Idle", RequestSpec{URL: "http://example.com/idle"}, meta, body); err != nil {
+		t.Fatalf("write stub: %v", err)
+	}
+	d := NewStubDoer(store, []Endpoint{{Name: "Poll", Method: http.MethodGet, Pattern: "/poll"}})
+
+	scenario := NewScenario()
+	handlers := map[string]Scenario{"A": NewScenario(), "B": NewScenario()}
+	handlers["A"].state.m.Set("Poll", "a")
+	handlers["B"].state.m.Set("Poll", "b")
+	served := scenario // a copy, as playback handlers hold
+	admin := &Admin{
+		Store:     store,
+		Doers:     []*StubDoer{d},
+		Scenarios: []string{"A", "B"},
+		Scenario:  "A",
+		LoadScenario: func(name string) error {
+			scenario.Replace(handlers[name])
+			return nil
+		},
+	}
+	srv := httptest.NewServer(admin)
+	defer srv.Close()
+
+	call := func(method, path, reqBody string, wantStatus int) string {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(reqBody))
+		if err != nil {
+			t.Fatalf("new request: %v", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != wantStatus {
+			t.Fatalf("%s %s: got %d want %d: %s", method, path, resp.StatusCode, wantStatus, b)
+		}
+		return string(b)
+	}
+
+	if got := call(http.MethodGet, "/__vcr/scenario", "", http.StatusOK); !strings.Contains(got, `"scenario":"A"`) {
+		t.Fatalf("unexpected scenario: %s", got)
+	}
+	call(http.MethodPut, "/__vcr/scenario", `{"scenario":"B"}`, http.StatusOK)
+	if got := served.Next("Poll"); got != "b" {
+		t.Fatalf("expected copies to see the loaded scenario, got %v", got)
+	}
+	call(http.MethodPut, "/__vcr/scenario", `{"scenario":"C"}`, http.StatusNotFound)
+	call(http.MethodPost, "/__vcr/scenario/reset", "", http.StatusOK)
+	if got := call(http.MethodGet, "/__vcr/scenario", "", http.StatusOK); !strings.Contains(got, `"scenario":"B"`) {
+		t.Fatalf("unexpected scenario after reset: %s", got)
+	}
+
+	for range 2 {
+		if _, err := d.Do(mustRequest(t, http.MethodGet, "http://example.com/poll")); err != nil {
+			t.Fatalf("do: %v", err)
+		}
+	}
+	if resp, _ := d.Do(mustRequest(t, http.MethodGet, "http://example.com/poll")); resp.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("expected an exhausted sequence, got %d", resp.StatusCode)
+	}
+	call(http.MethodPost, "/__vcr/sequences/reset", "", http.StatusNoContent)
+	if resp, _ := d.Do(mustRequest(t, http.MethodGet, "http://example.com/poll")); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected a rewound sequence, got %d", resp.StatusCode)
+	}
+
+	var stubs []StubHit
+	if err := json.Unmarshal([]byte(call(http.MethodGet, "/__vcr/stubs", "", http.StatusOK)), &stubs); err != nil {
+		t.Fatalf("decode stubs: %v", err)
+	}
+	if !slices.Equal(stubs, []StubHit{{Key: "Idle", Hits: 0}, {Key: "Poll", Hits: 3}}) {
+		t.Fatalf("unexpected stubs: %+v", stubs)
+	}
+
+	call(http.MethodPut, "/__vcr/latency", `{"latency":"250ms"}`, http.StatusOK)
+	if got := d.latency("Poll"); got.Min != 250*time.Millisecond {
+		t.Fatalf("unexpected latency: %+v", got)
+	}
+	if got := call(http.MethodGet, "/__vcr/latency", "", http.StatusOK); !strings.Contains(got, `"250ms"`) {
+		t.Fatalf("unexpected latency: %s", got)
+	}
+	call(http.MethodDelete, "/__vcr/latency", "", http.StatusOK)
+	if d.Latency != nil {
+		t.Fatalf("expected the latency override to be cleared")
+	}
+
+	call(http.MethodPut, "/__vcr/faults", `{"faults":{"error":101}}`, http.StatusBadRequest)
+	call(http.MethodPut, "/__vcr/faults", `{"faults":{"error":5}}`, http.StatusOK)
+	if got := d.faults("Poll"); got.Error != 5 {
+		t.Fatalf("unexpected faults: %+v", got)
+	}
+	call(http.MethodDelete, "/__vcr/faults", "", http.StatusOK)
+	if got := call(http.MethodGet, "/__vcr/faults", "", http.StatusOK); !strings.Contains(got, `"faults":null`) {
+		t.Fatalf("unexpected faults: %s", got)
+	}
+
+	if err := storage.WriteFile(PolicyFileName, []byte(`{"upstream":"https://example.org"}`)); err != nil {
+		t.Fatalf("write policy: %v", err)
+	}
+	call(http.MethodPost, "/__vcr/reload", "", http.StatusNoContent)
+	if store.Policy.Upstream != "https://example.org" {
+		t.Fatalf("expected a reloaded policy, got %+v", store.Policy)
+	}
+	if err := storage.WriteFile(PolicyFileName, []byte(`{"upstream":"https://example.org","faults":{"error":101}}`)); err != nil {
+		t.Fatalf("write policy: %v", err)
+	}
+	call(http.MethodPost, "/__vcr/reload", "", http.StatusUnprocessableEntity)
+	if store.Policy.Upstream != "https://example.org" || store.Policy.Faults != nil {
+		t.Fatalf("expected an invalid policy to be ignored, got %+v", store.Policy)
+	}
+
+	call(http.MethodGet, "/__vcr/nowhere", "", http.StatusNotFound)
+}
+
+func TestAdminReportsSettingsWithoutDoers(t *testing.T) {
+	store, err := NewWithStorage(memoryStorageWithPolicy(t, `{"upstream":"https://example.com"}`))
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	l, _ := ParseLatency("100ms")
+	a := &Admin{Store: store, Latency: &l}
+	call := func(method, path, body string) string {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s %s: got %d: %s", method, path, rec.Code, rec.Body)
+		}
+		return rec.Body.String()
+	}
+	if got := call(http.MethodGet, "/__vcr/latency", ""); !strings.Contains(got, `"100ms"`) {
+		t.Fatalf("expected the configured latency, got %s", got)
+	}
+	call(http.MethodPut, "/__vcr/faults", `{"faults":{"error":5}}`)
+	if got := call(http.MethodGet, "/__vcr/faults", ""); !strings.Contains(got, `"error":5`) {
+		t.Fatalf("expected the faults set through the API, got %s", got)
+	}
+}
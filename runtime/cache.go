@@ -0,0 +1,196 @@
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"slices"
+	"sync"
+)
+
+// stubCache mirrors the files of a Storage in memory, along with the stubs
+// parsed from them, so that playback does not touch the backend. Reads are
+// served from memory; writes and removals go to the backend first and then
+// update the mirror. It implements Storage and is safe for concurrent use.
+type stubCache struct {
+	backend Storage
+
+	mu    sync.RWMutex
+	files map[string][]byte
+	// stubs holds the stubs parsed from HAR files, by HAR name.
+	stubs map[string]*stub
+	// gen counts changes to files, so that a stub parsed while its file
+	// changed is not cached.
+	gen uint64
+}
+
+// newStubCache reads every file of backend into memory.
+func newStubCache(backend Storage) (*stubCache, error) {
+	c := &stubCache{backend: backend}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload reads every file of the backend again.
+func (c *stubCache) reload() error {
+	names, err := c.backend.List()
+	if err != nil {
+		return err
+	}
+	files := make(map[string][]byte, len(names))
+	for _, name := range names {
+		data, err := c.backend.ReadFile(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("read %s: %w", name, err)
+		}
+		files[name] = data
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.files = files
+	c.stubs = map[string]*stub{}
+	c.gen++
+	return nil
+}
+
+// refresh reads the named files from the backend again, dropping those that
+// no longer exist.
+func (c *stubCache) refresh(names ...string) error {
+	for _, name := range names {
+		data, err := c.backend.ReadFile(name)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("read %s: %w", name, err)
+		}
+		c.mu.Lock()
+		if err != nil {
+			delete(c.files, name)
+		} else {
+			c.files[name] = data
+		}
+		delete(c.stubs, name)
+		c.gen++
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+func (c *stubCache) ReadFile(name string) ([]byte, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	data, ok := c.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return slices.Clone(data), nil
+}
+
+func (c *stubCache) WriteFile(name string, data []byte) error {
+	if err := c.backend.WriteFile(name, data); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.files[name] = slices.Clone(data)
+	delete(c.stubs, name)
+	c.gen++
+	return nil
+}
+
+func (c *stubCache) Remove(name string) error {
+	if err := c.backend.Remove(name); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.files, name)
+	delete(c.stubs, name)
+	c.gen++
+	return nil
+}
+
+func (c *stubCache) List() ([]string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return slices.Sorted(maps.Keys(c.files)), nil
+}
+
+// stub returns the stub parsed from the HAR file harName, parsing it on first
+// use. The stub is shared: callers must not modify it.
+func (c *stubCache) stub(harName string) (*stub, error) {
+	c.mu.RLock()
+	s, ok := c.stubs[harName]
+	gen := c.gen
+	c.mu.RUnlock()
+	if ok {
+		return s, nil
+	}
+	s, err := readStub(c, harName)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen == gen {
+		c.stubs[harName] = s
+	}
+	return s, nil
+}
+
+// Preload reads every stub in storage into memory. Afterwards stubs are served
+// from memory and written through to storage; files changed in storage other
+// than through the store are only seen once a Watcher reports them. Call it
+// again to read storage anew.
+func (v *VCR) Preload() error {
+	backend := v.backend()
+	if backend == nil {
+		return fmt.Errorf("no storage configured")
+	}
+	c, err := newStubCache(backend)
+	if err != nil {
+		return err
+	}
+	v.cache.Store(c)
+	v.invalidateIndex()
+	return nil
+}
+
+// readStub returns the stub parsed from the HAR file harName, from the cache
+// when stubs are preloaded.
+func (v *VCR) readStub(harName string) (*stub, error) {
+	if c := v.cache.Load(); c != nil {
+		return c.stub(harName)
+	}
+	storage := v.storage()
+	if storage == nil {
+		return nil, fs.ErrNotExist
+	}
+	return readStub(storage, harName)
+}
+
+// invalidateStubs reads the named files from storage again when stubs are
+// preloaded, or every file if none is named, and makes the next lookup index
+// stubs again. It is meant for changes made behind the store's back.
+func (v *VCR) invalidateStubs(names ...string) error {
+	defer v.invalidateIndex()
+	c := v.cache.Load()
+	if c == nil {
+		return nil
+	}
+	if len(names) == 0 {
+		return c.reload()
+	}
+	return c.refresh(names...)
+}
+
+// invalidateIndex makes the next lookup index stubs again.
+func (v *VCR) invalidateIndex() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.indexed = false
+}
@@ -0,0 +1,170 @@
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestPreloadServesStubsFromMemory(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, PolicyFileName), []byte(`{"upstream":"https://example.com"}`), 0600); err != nil {
+		t.Fatalf("write policy: %v", err)
+	}
+	store, err := New(dir)
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	write := func(name, body string) {
+		t.Helper()
+		if err := store.WriteStub(name, RequestSpec{URL: "http://example.com/" + name}, ResponseMeta{Status: 200, MimeType: "application/json", Size: len(body)}, []byte(body)); err != nil {
+			t.Fatalf("write stub: %v", err)
+		}
+	}
+	read := func(name string) (string, error) {
+		t.Helper()
+		_, body, err := store.ReadResponse(name)
+		return string(body), err
+	}
+	write("GetThing", `{"v":1}`)
+	if err := store.Preload(); err != nil {
+		t.Fatalf("preload: %v", err)
+	}
+
+	// Files removed behind the store's back are still served...
+	if err := os.Remove(filepath.Join(dir, "GetThing.vcr.json")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if body, err := read("GetThing"); err != nil || body != `{"v":1}` {
+		t.Fatalf("expected the preloaded stub, got %q %v", body, err)
+	}
+	// ...until they are invalidated.
+	if err := store.invalidateStubs("GetThing.vcr.json"); err != nil {
+		t.Fatalf("invalidate: %v", err)
+	}
+	if _, err := read("GetThing"); !errors.Is(err, ErrIncompleteStub) {
+		t.Fatalf("expected an incomplete stub, got %v", err)
+	}
+
+	// Writes go through to storage and are served at once.
+	write("GetThing", `{"v":2}`)
+	if body, err := read("GetThing"); err != nil || body != `{"v":2}` {
+		t.Fatalf("expected the written stub, got %q %v", body, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "GetThing.vcr.json")); err != nil || string(data) != `{"v":2}` {
+		t.Fatalf("expected the stub on disk, got %q %v", data, err)
+	}
+	if ok, err := store.HasStub("Missing"); ok || err != nil {
+		t.Fatalf("unexpected stub: %v %v", ok, err)
+	}
+	keys, err := store.ListStubs()
+	if err != nil || len(keys) != 1 || keys[0] != "GetThing" {
+		t.Fatalf("unexpected stubs: %q %v", keys, err)
+	}
+}
+
+func TestUpdatePolicyLeavesReadersUnaffected(t *testing.T) {
+	store, err := NewWithStorage(memoryStorageWithPolicy(t, `{"upstream":"https://example.com","endpoints":{"GetThing":{"variant":{"path":true}}}}`))
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	before := store.CurrentPolicy()
+	query := url.Values{"page": {"2"}}
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Go(func() {
+			for range 100 {
+				_ = RequestDiversifier(store.CurrentPolicy(), "GetThing", query, map[string]string{"id": "1"}, nil, nil)
+			}
+		})
+	}
+	for i := range 100 {
+		store.UpdatePolicy(func(p *Policy) { p.SetVariantQuery("GetThing", i%2 == 0) })
+	}
+	wg.Wait()
+
+	if enabled, explicit := before.QueryVariantEnabled("GetThing"); enabled != true || explicit {
+		t.Fatalf("expected the earlier policy to be unchanged, got %v %v", enabled, explicit)
+	}
+	if enabled, explicit := store.CurrentPolicy().QueryVariantEnabled("GetThing"); enabled || !explicit {
+		t.Fatalf("expected the last update, got %v %v", enabled, explicit)
+	}
+	if enabled, _ := store.CurrentPolicy().PathVariantEnabled("GetThing"); !enabled {
+		t.Fatalf("expected other settings to be kept")
+	}
+}
+
+// benchmarkStore returns a store on disk holding n stubs of GetThing, one per
+// id, optionally preloaded.
+func benchmarkStore(b *testing.B, n int, preload bool) *VCR {
+	b.Helper()
+	dir := b.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, PolicyFileName), []byte(`{"upstream":"https://example.com","endpoints":{"GetThing":{"variant":{"path":true}}}}`), 0600); err != nil {
+		b.Fatalf("write policy: %v", err)
+	}
+	store, err := New(dir)
+	if err != nil {
+		b.Fatalf("new store: %v", err)
+	}
+	body := []byte(`{"id":"1","name":"widget","tags":["a","b","c"]}`)
+	for i := range n {
+		div := RequestDiversifier(store.Policy, "GetThing", nil, map[string]string{"id": fmt.Sprint(i)}, nil, nil)
+		spec := RequestSpec{URL: fmt.Sprintf("http://example.com/things/%d", i)}
+		if err := store.WriteStub("GetThing", spec, ResponseMeta{Status: 200, MimeType: "application/json", Size: len(body)}, body, div); err != nil {
+			b.Fatalf("write stub: %v", err)
+		}
+	}
+	if preload {
+		if err := store.Preload(); err != nil {
+			b.Fatalf("preload: %v", err)
+		}
+	}
+	return store
+}
+
+func BenchmarkStubDoerDo(b *testing.B) {
+	for _, preload := range []bool{false, true} {
+		b.Run(fmt.Sprintf("preload=%v", preload), func(b *testing.B) {
+			const n = 100
+			d := NewStubDoer(benchmarkStore(b, n, preload), []Endpoint{{Name: "GetThing", Method: http.MethodGet, Pattern: "/things/{id}"}})
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("http://example.com/things/%d", i%n), nil)
+					resp, err := d.Do(req)
+					if err != nil || resp.StatusCode != http.StatusOK {
+						b.Errorf("do: %v", err)
+						return
+					}
+					_, _ = io.Copy(io.Discard, resp.Body)
+					_ = resp.Body.Close()
+					i++
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkHasStub(b *testing.B) {
+	for _, preload := range []bool{false, true} {
+		b.Run(fmt.Sprintf("preload=%v", preload), func(b *testing.B) {
+			store := benchmarkStore(b, 1, preload)
+			div := RequestDiversifier(store.Policy, "GetThing", nil, map[string]string{"id": "0"}, nil, nil)
+			b.ReportAllocs()
+			for b.Loop() {
+				if ok, err := store.HasStub("GetThing", div); !ok || err != nil {
+					b.Fatalf("has stub: %v %v", ok, err)
+				}
+			}
+		})
+	}
+}
@@ -1,29 +1,165 @@
 package runtime
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"hash/fnv"
+	"net/http"
 	"net/url"
+	"slices"
 	"sort"
 	"strings"
 )
 
-func RequestDiversifier(policy Policy, endpointName string, query url.Values, pathVars map[string]string) string {
-	var parts []string
+// RequestDiversifier returns the diversifier that names the stub for a request,
+// in the style selected by the endpoint's names policy.
+func RequestDiversifier(policy Policy, endpointName string, query url.Values, pathVars map[string]string, body []byte, header http.Header) string {
+	return requestDiversifier(policy, endpointName, query, pathVars, body, header, policy.NameStyle(endpointName))
+}
 
+func requestDiversifier(policy Policy, endpointName string, query url.Values, pathVars map[string]string, body []byte, header http.Header, style NameStyle) string {
+	var pathValues, queryValues url.Values
 	if enabled, _ := policy.PathVariantEnabled(endpointName); enabled {
-		if p := PathDiversifier(varsToValues(pathVars)); p != "" {
-			parts = append(parts, p)
+		pathValues = varsToValues(pathVars)
+	}
+	if qv, _ := policy.QueryVariant(endpointName); qv.Enabled {
+		queryValues = qv.Filter(query)
+	}
+	var b string
+	var bodyFields url.Values
+	if bv, _ := policy.BodyVariant(endpointName); bv.Enabled {
+		if len(bv.Paths) == 0 {
+			b = BodyDiversifier(body)
+		} else {
+			bodyFields = bodyValues(body, bv.Paths)
 		}
 	}
-	if enabled, _ := policy.QueryVariantEnabled(endpointName); enabled {
-		if q := QueryDiversifier(query); q != "" {
-			parts = append(parts, q)
+	h := headerValues(header, policy.HeaderVariants(endpointName))
+	c := cookieValues(header, policy.CookieVariants(endpointName))
+
+	if style == NameStyleReadable {
+		if div, ok := readableDiversifier(pathValues, queryValues, b, bodyFields, h, c); ok {
+			return div
 		}
 	}
+
+	var parts []string
+	if p := PathDiversifier(pathValues); p != "" {
+		parts = append(parts, p)
+	}
+	if q := QueryDiversifier(queryValues); q != "" {
+		parts = append(parts, q)
+	}
+	if b != "" {
+		parts = append(parts, b)
+	}
+	if b := valuesDiversifier("b-", bodyFields); b != "" {
+		parts = append(parts, b)
+	}
+	if h := valuesDiversifier("h-", h); h != "" {
+		parts = append(parts, h)
+	}
+	if c := valuesDiversifier("c-", c); c != "" {
+		parts = append(parts, c)
+	}
 	return strings.Join(parts, "--")
 }
 
+// maxReadableDiversifier is the longest readable diversifier. Longer ones fall
+// back to the hashed form so file names stay within file system limits.
+const maxReadableDiversifier = 100
+
+// readableDiversifier renders the variant as name=value parts prefixed by
+// their source, e.g. "p.id=123--q.status=open": "p." path params, "q." query
+// parameters, "b." selected body fields, "h." headers (names lower-cased) and
+// "c." cookies. Whole bodies have no readable form and keep their "b-" hash.
+// It reports false if the result exceeds maxReadableDiversifier, or if a name
+// or value has upper-case letters: on case-insensitive file systems such stubs
+// could not be told apart from those differing only by case.
+func readableDiversifier(path, query url.Values, body string, bodyFields, header, cookies url.Values) (string, bool) {
+	lowerHeader := url.Values{}
+	for name, vals := range header {
+		lowerHeader[strings.ToLower(name)] = vals
+	}
+	var parts []string
+	parts = append(parts, readableValues("p.", path)...)
+	parts = append(parts, readableValues("q.", query)...)
+	if body != "" {
+		parts = append(parts, body)
+	}
+	parts = append(parts, readableValues("b.", bodyFields)...)
+	parts = append(parts, readableValues("h.", lowerHeader)...)
+	parts = append(parts, readableValues("c.", cookies)...)
+	for _, part := range parts {
+		if hasUpperCase(part) {
+			return "", false
+		}
+	}
+	div := strings.Join(parts, "--")
+	return div, len(div) <= maxReadableDiversifier
+}
+
+// hasUpperCase reports whether an escaped part has upper-case letters other
+// than the hex digits of %XX escapes.
+func hasUpperCase(part string) bool {
+	for i := 0; i < len(part); i++ {
+		switch c := part[i]; {
+		case c == '%':
+			i += 2
+		case 'A' <= c && c <= 'Z':
+			return true
+		}
+	}
+	return false
+}
+
+// readableValues returns escaped prefix+name=value pairs sorted by name, then
+// value.
+func readableValues(prefix string, values url.Values) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var out []string
+	for _, key := range keys {
+		vals := append([]string(nil), values[key]...)
+		if len(vals) == 0 {
+			vals = []string{""}
+		}
+		sort.Strings(vals)
+		for _, val := range vals {
+			out = append(out, prefix+escapeNamePart(key)+"="+escapeNamePart(val))
+		}
+	}
+	return out
+}
+
+// escapeNamePart makes s safe for use in a file name on every platform.
+// Bytes other than ASCII letters, digits and "._+,@" become %XX, including
+// "-" so that the "--" between parts cannot occur within one and "~" so that
+// keys cannot be mistaken for sequence blobs.
+func escapeNamePart(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+			b.WriteByte(c)
+		case strings.IndexByte("._+,@", c) >= 0:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hex[c>>4])
+			b.WriteByte(hex[c&0x0f])
+		}
+	}
+	return b.String()
+}
+
 func varsToValues(vars map[string]string) url.Values {
 	if len(vars) == 0 {
 		return nil
@@ -51,6 +187,87 @@ func PathDiversifier(values url.Values) string {
 	return "p-" + hash64Hex(normalized)
 }
 
+// BodyDiversifier returns the "b-" diversifier for a request payload, or "" if
+// the payload is empty.
+func BodyDiversifier(body []byte) string {
+	normalized := NormalizeBody(body)
+	if normalized == "" {
+		return ""
+	}
+	return "b-" + hash64Hex(normalized)
+}
+
+// HeaderDiversifier returns the "h-" diversifier for the named request headers,
+// or "" if none of them is present. Header names are case-insensitive.
+func HeaderDiversifier(header http.Header, names []string) string {
+	return valuesDiversifier("h-", headerValues(header, names))
+}
+
+// CookieDiversifier returns the "c-" diversifier for the named cookies sent in
+// the Cookie header, or "" if none of them is present.
+func CookieDiversifier(header http.Header, names []string) string {
+	return valuesDiversifier("c-", cookieValues(header, names))
+}
+
+func valuesDiversifier(prefix string, values url.Values) string {
+	normalized := NormalizeValues(values)
+	if normalized == "" {
+		return ""
+	}
+	return prefix + hash64Hex(normalized)
+}
+
+// headerValues returns the values of the named headers, keyed by canonical name.
+func headerValues(header http.Header, names []string) url.Values {
+	values := url.Values{}
+	for _, name := range names {
+		key := http.CanonicalHeaderKey(name)
+		if vals := header.Values(key); len(vals) > 0 {
+			values[key] = vals
+		}
+	}
+	return values
+}
+
+// cookieValues returns the values of the named cookies sent in the Cookie header.
+func cookieValues(header http.Header, names []string) url.Values {
+	values := url.Values{}
+	if len(names) == 0 {
+		return values
+	}
+	for _, line := range header.Values("Cookie") {
+		cookies, err := http.ParseCookie(line)
+		if err != nil {
+			continue
+		}
+		for _, c := range cookies {
+			if slices.Contains(names, c.Name) {
+				values.Add(c.Name, c.Value)
+			}
+		}
+	}
+	return values
+}
+
+// NormalizeBody returns a canonical form of a request payload. JSON payloads are
+// re-encoded with sorted object keys and no insignificant whitespace so that
+// semantically equal bodies share a variant; other payloads are used verbatim.
+func NormalizeBody(body []byte) string {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 {
+		return ""
+	}
+	decoder := json.NewDecoder(bytes.NewReader(trimmed))
+	decoder.UseNumber()
+	var v any
+	if err := decoder.Decode(&v); err == nil && !decoder.More() {
+		if canonical, err := json.Marshal(v); err == nil {
+			return string(canonical)
+		}
+	}
+	return string(trimmed)
+}
+
 func NormalizeValues(values url.Values) string {
 	if len(values) == 0 {
 		return ""
@@ -1,7 +1,9 @@
 package runtime
 
 import (
+	"net/http"
 	"net/url"
+	"strings"
 	"testing"
 )
 
@@ -24,7 +26,7 @@ func TestRequestDiversifierRespectsPolicyDefaults(t *testing.T) {
 	q.Add("x", "1")
 
 	// Default: query enabled, path disabled.
-	div := RequestDiversifier(policy, "AnyEndpoint", q, map[string]string{"id": "123"})
+	div := RequestDiversifier(policy, "AnyEndpoint", q, map[string]string{"id": "123"}, nil, nil)
 	if div == "" {
 		t.Fatalf("expected non-empty diversifier (query default enabled)")
 	}
@@ -33,3 +35,137 @@ func TestRequestDiversifierRespectsPolicyDefaults(t *testing.T) {
 	}
 }
 
+func TestBodyDiversifierCanonicalizesJSON(t *testing.T) {
+	a := BodyDiversifier([]byte(`{"b":2,"a":[1,2]}`))
+	b := BodyDiversifier([]byte("{\n  \"a\": [1, 2],\n  \"b\": 2\n}\n"))
+	if a == "" || a != b {
+		t.Fatalf("expected equal body diversifiers, got %q and %q", a, b)
+	}
+	if c := BodyDiversifier([]byte(`{"a":[1,2],"b":3}`)); c == a {
+		t.Fatalf("expected distinct diversifier for distinct payload")
+	}
+	if d := BodyDiversifier(nil); d != "" {
+		t.Fatalf("expected empty diversifier for empty body, got %q", d)
+	}
+}
+
+func TestRequestDiversifierBodyVariantDisabled(t *testing.T) {
+	policy := Policy{Endpoints: map[string]EndpointPolicy{
+		"CreateThing": {Variant: &VariantPolicy{Body: &BodyVariant{Enabled: false}}},
+	}}
+	if div := RequestDiversifier(policy, "CreateThing", nil, nil, []byte(`{"name":"x"}`), nil); div != "" {
+		t.Fatalf("expected empty diversifier when body variants disabled, got %q", div)
+	}
+	if div := RequestDiversifier(Policy{}, "CreateThing", nil, nil, []byte(`{"name":"x"}`), nil); len(div) < 2 || div[0:2] != "b-" {
+		t.Fatalf("expected body diversifier prefix, got %q", div)
+	}
+}
+
+func TestRequestDiversifierHeaderAndCookieVariants(t *testing.T) {
+	policy := Policy{Endpoints: map[string]EndpointPolicy{
+		"GetThing": {Variant: &VariantPolicy{Headers: []string{"accept-language"}, Cookies: []string{"flag"}}},
+	}}
+	header := func(lang, cookie string) http.Header {
+		h := http.Header{}
+		h.Set("Accept-Language", lang)
+		h.Set("X-Request-Id", lang+cookie)
+		if cookie != "" {
+			h.Set("Cookie", cookie)
+		}
+		return h
+	}
+
+	fr := RequestDiversifier(policy, "GetThing", nil, nil, nil, header("fr", ""))
+	if !strings.HasPrefix(fr, "h-") {
+		t.Fatalf("expected header diversifier, got %q", fr)
+	}
+	if de := RequestDiversifier(policy, "GetThing", nil, nil, nil, header("de", "")); de == fr {
+		t.Fatalf("expected distinct variants per Accept-Language")
+	}
+
+	on := RequestDiversifier(policy, "GetThing", nil, nil, nil, header("fr", "flag=on; theme=dark"))
+	if !strings.HasPrefix(on, fr+"--c-") {
+		t.Fatalf("expected cookie diversifier after header diversifier, got %q", on)
+	}
+	if other := RequestDiversifier(policy, "GetThing", nil, nil, nil, header("fr", "theme=light; flag=on")); other != on {
+		t.Fatalf("expected unlisted cookies to be ignored: %q vs %q", other, on)
+	}
+
+	if div := RequestDiversifier(policy, "Other", nil, nil, nil, header("fr", "flag=on")); div != "" {
+		t.Fatalf("expected no variant for endpoints without header policy, got %q", div)
+	}
+}
+
+
+func TestRequestDiversifierReadableNames(t *testing.T) {
+	truth := true
+	policy := Policy{Names: NameStyleReadable, Endpoints: map[string]EndpointPolicy{
+		"GetThing": {Variant: &VariantPolicy{Path: &truth}},
+	}}
+	query := url.Values{"status": {"open"}}
+	vars := map[string]string{"id": "123"}
+
+	if div := RequestDiversifier(policy, "GetThing", query, vars, nil, nil); div != "p.id=123--q.status=open" {
+		t.Fatalf("unexpected readable diversifier: %q", div)
+	}
+	if div := RequestDiversifier(policy, "GetThing", url.Values{"q": {"a/b c?~2"}}, vars, nil, nil); div != "p.id=123--q.q=a%2Fb%20c%3F%7E2" {
+		t.Fatalf("expected unsafe characters to be escaped, got %q", div)
+	}
+	if div := RequestDiversifier(policy, "CreateThing", nil, nil, []byte(`{"name":"x"}`), nil); !strings.HasPrefix(div, "b-") {
+		t.Fatalf("expected body to stay hashed, got %q", div)
+	}
+
+	long := url.Values{"q": {strings.Repeat("x", maxReadableDiversifier)}}
+	if div := RequestDiversifier(policy, "GetThing", long, vars, nil, nil); !strings.HasPrefix(div, "p-") || !strings.Contains(div, "--q-") {
+		t.Fatalf("expected long names to fall back to hashes, got %q", div)
+	}
+
+	// Pairs are qualified by their source and "-" is escaped, so neither
+	// sources nor values can run into each other.
+	if a, b := RequestDiversifier(policy, "GetThing", url.Values{"id": {"123"}}, nil, nil, nil), RequestDiversifier(policy, "GetThing", nil, vars, nil, nil); a == b {
+		t.Fatalf("expected path and query pairs to differ, got %q", a)
+	}
+	policy.Endpoints["GetThing"].Variant.Cookies = []string{"flag"}
+	policy.Endpoints["GetThing"].Variant.Headers = []string{"X-Tenant"}
+	header := http.Header{"Cookie": {"flag=on"}, "X-Tenant": {"a--b"}}
+	if div := RequestDiversifier(policy, "GetThing", url.Values{"flag": {"on"}}, vars, nil, header); div != "p.id=123--q.flag=on--h.x%2Dtenant=a%2D%2Db--c.flag=on" {
+		t.Fatalf("unexpected qualified diversifier: %q", div)
+	}
+	upper := RequestDiversifier(policy, "GetThing", url.Values{"status": {"Open"}}, vars, nil, nil)
+	if lower := RequestDiversifier(policy, "GetThing", query, vars, nil, nil); !strings.HasPrefix(upper, "p-") || strings.EqualFold(upper, lower) {
+		t.Fatalf("expected values differing by case to fall back to hashes, got %q and %q", upper, lower)
+	}
+
+	policy.Endpoints["GetThing"].Variant.Names = NameStyleHash
+	if div := RequestDiversifier(policy, "GetThing", query, vars, nil, nil); !strings.HasPrefix(div, "p-") {
+		t.Fatalf("expected endpoint names style to win, got %q", div)
+	}
+}
+
+func TestRequestDiversifierBodyPathVariants(t *testing.T) {
+	policy := Policy{Endpoints: map[string]EndpointPolicy{
+		"SearchThings": {Variant: &VariantPolicy{Body: &BodyVariant{Enabled: true, Paths: []string{"$.filter.status", "$.page"}}}},
+	}}
+	div := func(body string) string {
+		return RequestDiversifier(policy, "SearchThings", nil, nil, []byte(body), nil)
+	}
+
+	open := div(`{"filter":{"status":"open"},"page":2,"nonce":"a1","ts":"2025-01-01T00:00:00Z"}`)
+	if !strings.HasPrefix(open, "b-") {
+		t.Fatalf("expected body diversifier, got %q", open)
+	}
+	if other := div(`{"ts":"2025-06-30T12:00:00Z","page":2,"filter":{"status":"open"},"nonce":"b2"}`); other != open {
+		t.Fatalf("expected unselected fields to be ignored: %q vs %q", other, open)
+	}
+	if closed := div(`{"filter":{"status":"closed"},"page":2}`); closed == open {
+		t.Fatalf("expected distinct variants per selected field")
+	}
+	if none := div(`{"nonce":"c3"}`); none != "" {
+		t.Fatalf("expected no variant when selectors match nothing, got %q", none)
+	}
+
+	policy.Names = NameStyleReadable
+	if got := div(`{"filter":{"status":"open"},"page":2}`); got != "b.filter.status=open--b.page=2" {
+		t.Fatalf("unexpected readable body variant: %q", got)
+	}
+}
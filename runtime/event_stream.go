@@ -0,0 +1,256 @@
+package runtime
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventStreamMimeType is the content type of server-sent event responses.
+const EventStreamMimeType = "text/event-stream"
+
+// StreamEvent is one server-sent event of a recorded text/event-stream
+// response. Event stream stubs store their events as a JSON array in the blob.
+type StreamEvent struct {
+	// At is the time between the response headers and the end of the event.
+	At    time.Duration
+	ID    string
+	Event string
+	Data  string
+	// Retry is the reconnection time in milliseconds, or 0 when unset.
+	Retry int
+}
+
+type streamEventJSON struct {
+	At    int64  `json:"at"`
+	ID    string `json:"id,omitempty"`
+	Event string `json:"event,omitempty"`
+	Data  string `json:"data"`
+	Retry int    `json:"retry,omitempty"`
+}
+
+// MarshalJSON encodes At in milliseconds.
+func (e StreamEvent) MarshalJSON() ([]byte, error) {
+	return json.Marshal(streamEventJSON{
+		At:    e.At.Milliseconds(),
+		ID:    e.ID,
+		Event: e.Event,
+		Data:  e.Data,
+		Retry: e.Retry,
+	})
+}
+
+func (e *StreamEvent) UnmarshalJSON(data []byte) error {
+	var raw streamEventJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*e = StreamEvent{
+		At:    time.Duration(raw.At) * time.Millisecond,
+		ID:    raw.ID,
+		Event: raw.Event,
+		Data:  raw.Data,
+		Retry: raw.Retry,
+	}
+	return nil
+}
+
+// isEventStream reports whether contentType denotes server-sent events.
+func isEventStream(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == EventStreamMimeType
+}
+
+// eventStreamParser splits a text/event-stream body into events as it arrives.
+type eventStreamParser struct {
+	buf    []byte
+	events []StreamEvent
+}
+
+// feed appends data and parses every event it completes; at stamps them.
+func (p *eventStreamParser) feed(data []byte, at time.Duration) {
+	p.buf = append(p.buf, data...)
+	for {
+		block, rest, ok := cutEvent(p.buf)
+		if !ok {
+			return
+		}
+		p.add(block, at)
+		p.buf = rest
+	}
+}
+
+// flush parses an event left unterminated at the end of the body.
+func (p *eventStreamParser) flush(at time.Duration) {
+	if len(bytes.TrimSpace(p.buf)) > 0 {
+		p.add(p.buf, at)
+	}
+	p.buf = nil
+}
+
+func (p *eventStreamParser) add(block []byte, at time.Duration) {
+	ev := StreamEvent{At: at}
+	var data []string
+	seen := false
+	for _, line := range strings.Split(string(block), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" || strings.HasPrefix(line, ":") {
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "data":
+			data = append(data, value)
+		case "id":
+			ev.ID = value
+		case "event":
+			ev.Event = value
+		case "retry":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				continue
+			}
+			ev.Retry = n
+		default:
+			continue
+		}
+		seen = true
+	}
+	if !seen {
+		return
+	}
+	ev.Data = strings.Join(data, "\n")
+	p.events = append(p.events, ev)
+}
+
+// cutEvent splits buf after the blank line that ends its first event.
+func cutEvent(buf []byte) (block, rest []byte, ok bool) {
+	for i := 0; i < len(buf); i++ {
+		if buf[i] != '\n' {
+			continue
+		}
+		j := i + 1
+		if j < len(buf) && buf[j] == '\r' {
+			j++
+		}
+		if j < len(buf) && buf[j] == '\n' {
+			return buf[:i], buf[j+1:], true
+		}
+	}
+	return nil, buf, false
+}
+
+// encodeEvent renders ev in text/event-stream format.
+func encodeEvent(ev StreamEvent) []byte {
+	var b bytes.Buffer
+	if ev.ID != "" {
+		b.WriteString("id: " + ev.ID + "\n")
+	}
+	if ev.Event != "" {
+		b.WriteString("event: " + ev.Event + "\n")
+	}
+	if ev.Retry > 0 {
+		b.WriteString("retry: " + strconv.Itoa(ev.Retry) + "\n")
+	}
+	for _, line := range strings.Split(ev.Data, "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+// encodeEventStream renders events as a text/event-stream body.
+func encodeEventStream(events []StreamEvent) []byte {
+	var b bytes.Buffer
+	for _, ev := range events {
+		b.Write(encodeEvent(ev))
+	}
+	return b.Bytes()
+}
+
+// eventStreamCapture passes a text/event-stream body through while recording
+// its events. When the body ends or is closed, done receives the events and
+// the time the stream was open.
+type eventStreamCapture struct {
+	body  io.ReadCloser
+	start time.Time
+	done  func(events []StreamEvent, elapsed time.Duration)
+
+	mu     sync.Mutex
+	parser eventStreamParser
+	once   sync.Once
+}
+
+func newEventStreamCapture(body io.ReadCloser, done func([]StreamEvent, time.Duration)) *eventStreamCapture {
+	return &eventStreamCapture{body: body, start: time.Now(), done: done}
+}
+
+func (c *eventStreamCapture) Read(p []byte) (int, error) {
+	n, err := c.body.Read(p)
+	if n > 0 {
+		c.mu.Lock()
+		c.parser.feed(p[:n], time.Since(c.start))
+		c.mu.Unlock()
+	}
+	if err == io.EOF {
+		c.finish()
+	}
+	return n, err
+}
+
+func (c *eventStreamCapture) Close() error {
+	err := c.body.Close()
+	c.finish()
+	return err
+}
+
+func (c *eventStreamCapture) finish() {
+	c.once.Do(func() {
+		elapsed := time.Since(c.start)
+		c.mu.Lock()
+		c.parser.flush(elapsed)
+		events := c.parser.events
+		c.mu.Unlock()
+		c.done(events, elapsed)
+	})
+}
+
+// timedEventReader replays events, holding each back until its recorded
+// offset from the first read has passed.
+type timedEventReader struct {
+	ctx     context.Context
+	events  []StreamEvent
+	start   time.Time
+	pending []byte
+}
+
+func (r *timedEventReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if len(r.events) == 0 {
+			return 0, io.EOF
+		}
+		if r.start.IsZero() {
+			r.start = time.Now()
+		}
+		if err := sleep(r.ctx, time.Until(r.start.Add(r.events[0].At))); err != nil {
+			return 0, err
+		}
+		r.pending = encodeEvent(r.events[0])
+		r.events = r.events[1:]
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *timedEventReader) Close() error {
+	r.events, r.pending = nil, nil
+	return nil
+}
@@ -0,0 +1,122 @@
+package runtime
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pipeRoundTripper answers with a text/event-stream body written by write.
+type pipeRoundTripper struct {
+	write func(w io.Writer)
+}
+
+func (rt pipeRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		rt.write(pw)
+		_ = pw.Close()
+	}()
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Type": []string{"text/event-stream"}},
+		Body:          pr,
+		ContentLength: -1,
+		Request:       req,
+	}, nil
+}
+
+func TestEventStreamParserSplitsEvents(t *testing.T) {
+	var p eventStreamParser
+	p.feed([]byte(": comment\nid: 1\nevent: tick\ndata: a\nda"), 0)
+	p.feed([]byte("ta: b\n\nretry: 500\r\ndata: c\r\n\r\n"), time.Second)
+	p.feed([]byte("data: tail"), 2*time.Second)
+	p.flush(3 * time.Second)
+
+	want := []StreamEvent{
+		{At: time.Second, ID: "1", Event: "tick", Data: "a\nb"},
+		{At: time.Second, Data: "c", Retry: 500},
+		{At: 3 * time.Second, Data: "tail"},
+	}
+	if len(p.events) != len(want) {
+		t.Fatalf("unexpected events: %+v", p.events)
+	}
+	for i := range want {
+		if p.events[i] != want[i] {
+			t.Fatalf("event %d: got %+v want %+v", i, p.events[i], want[i])
+		}
+	}
+	if got := string(encodeEvent(want[0])); got != "id: 1\nevent: tick\ndata: a\ndata: b\n\n" {
+		t.Fatalf("unexpected encoding: %q", got)
+	}
+}
+
+func TestRecordingTransportRecordsEventStreams(t *testing.T) {
+	store, err := NewWithStorage(memoryStorageWithPolicy(t, `{"upstream":"https://example.com"}`))
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	endpoints := []Endpoint{{Name: "Watch", Method: http.MethodGet, Pattern: "/watch"}}
+	base := pipeRoundTripper{write: func(w io.Writer) {
+		_, _ = io.WriteString(w, "data: {\"n\":1}\n\n")
+		time.Sleep(50 * time.Millisecond)
+		_, _ = io.WriteString(w, "data: {\"n\":2}\n\n")
+	}}
+	rt := NewRecordingTransport(context.Background(), store, endpoints, base, 0)
+
+	resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "http://example.com/watch"))
+	if err != nil {
+		t.Fatalf("round trip: %v", err)
+	}
+	streamed, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if string(streamed) != "data: {\"n\":1}\n\ndata: {\"n\":2}\n\n" {
+		t.Fatalf("unexpected streamed body: %q", streamed)
+	}
+
+	meta, blob, _, err := store.nextResponse("Watch", "")
+	if err != nil {
+		t.Fatalf("read stub: %v", err)
+	}
+	if meta.MimeType != EventStreamMimeType {
+		t.Fatalf("unexpected mime type: %q", meta.MimeType)
+	}
+	var events []StreamEvent
+	if err := json.Unmarshal(blob, &events); err != nil {
+		t.Fatalf("decode events: %v\n%s", err, blob)
+	}
+	if len(events) != 2 || events[0].Data != `{"n":1}` || events[1].Data != `{"n":2}` {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+	if gap := events[1].At - events[0].At; gap < 40*time.Millisecond {
+		t.Fatalf("expected recorded timing, got events at %v and %v", events[0].At, events[1].At)
+	}
+
+	d := NewStubDoer(store, endpoints)
+	resp, err = d.Do(mustRequest(t, http.MethodGet, "http://example.com/watch"))
+	if err != nil {
+		t.Fatalf("do: %v", err)
+	}
+	replayed, _ := io.ReadAll(resp.Body)
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") || string(replayed) != string(streamed) {
+		t.Fatalf("unexpected replay: %q %q", resp.Header.Get("Content-Type"), replayed)
+	}
+
+	d.StreamTiming = true
+	start := time.Now()
+	resp, err = d.Do(mustRequest(t, http.MethodGet, "http://example.com/watch"))
+	if err != nil {
+		t.Fatalf("do: %v", err)
+	}
+	replayed, _ = io.ReadAll(resp.Body)
+	if string(replayed) != string(streamed) {
+		t.Fatalf("unexpected timed replay: %q", replayed)
+	}
+	if elapsed := time.Since(start); elapsed < events[1].At {
+		t.Fatalf("timed replay took %v, want at least %v", elapsed, events[1].At)
+	}
+}
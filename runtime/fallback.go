@@ -0,0 +1,223 @@
+package runtime
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// StubFallback names the step of the fallback chain that found a stub after
+// the exact variant missed.
+type StubFallback string
+
+const (
+	// StubFallbackPath serves the stub recorded for the same route params,
+	// ignoring query, body, header and cookie variants.
+	StubFallbackPath StubFallback = "path"
+	// StubFallbackQuery serves the stub whose recorded query shares the most
+	// parameters with the request. Ties go to the stub with fewer conflicting
+	// values, then to the one with fewer extra parameters.
+	StubFallbackQuery StubFallback = "query"
+	// StubFallbackDefault serves the endpoint's undiversified stub.
+	StubFallbackDefault StubFallback = "default"
+)
+
+// StubMatch describes which stub StubDoer served for a request.
+type StubMatch struct {
+	// Endpoint is the name of the matched endpoint.
+	Endpoint string
+	// Requested is the diversifier computed for the request.
+	Requested string
+	// Stub is the key of the stub that answered, or "" on a miss.
+	Stub string
+	// Fallback is the fallback step that found Stub, or "" for an exact hit.
+	Fallback StubFallback
+}
+
+type stubMatchKey struct{}
+
+// WithStubMatch returns a context that captures how StubDoer resolved the stub
+// for requests made with it. Unlike WithStubResult it is meant for the
+// playback server's access log, which sits outside the generated client.
+func WithStubMatch(ctx context.Context) (context.Context, *StubMatch) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	m := &StubMatch{}
+	return context.WithValue(ctx, stubMatchKey{}, m), m
+}
+
+func setStubMatch(ctx context.Context, match StubMatch) {
+	if ctx == nil {
+		return
+	}
+	if m, _ := ctx.Value(stubMatchKey{}).(*StubMatch); m != nil {
+		*m = match
+	}
+}
+
+// FallbackEnabled reports whether playback may answer a miss with the nearest
+// stub: endpoints[name].fallback, then fallback.
+func (p Policy) FallbackEnabled(endpointName string) bool {
+	if ep, ok := p.Endpoints[endpointName]; ok && ep.Fallback != nil {
+		return *ep.Fallback
+	}
+	return p.Fallback
+}
+
+// nearestStub walks the fallback chain for a request whose exact variant
+// missed: the path-only variant, then the stub with the most query parameters
+// in common, then the undiversified stub. It returns the key of the stub that
+// answered, or os.ErrNotExist if none exists.
+func (d *StubDoer) nearestStub(req *http.Request, endpointName string, vars map[string]string, exact string) (string, StubFallback, ResponseMeta, []byte, error) {
+	tried := map[string]bool{exact: true}
+	try := func(div string) (string, ResponseMeta, []byte, bool, error) {
+		if tried[div] {
+			return "", ResponseMeta{}, nil, false, nil
+		}
+		tried[div] = true
+		meta, body, key, err := d.Store.nextResponse(endpointName, div)
+		if os.IsNotExist(err) {
+			return "", ResponseMeta{}, nil, false, nil
+		}
+		return key, meta, body, err == nil, err
+	}
+
+	policy := d.Store.CurrentPolicy()
+	if enabled, _ := policy.PathVariantEnabled(endpointName); enabled {
+		div := requestDiversifier(pathOnlyPolicy(policy, endpointName), endpointName, nil, vars, nil, nil, policy.NameStyle(endpointName))
+		if div != "" {
+			if key, meta, body, ok, err := try(div); ok || err != nil {
+				return key, StubFallbackPath, meta, body, err
+			}
+		}
+	}
+
+	if div, ok := d.closestQueryStub(req, endpointName, vars); ok {
+		if key, meta, body, ok, err := try(div); ok || err != nil {
+			return key, StubFallbackQuery, meta, body, err
+		}
+	}
+
+	if key, meta, body, ok, err := try(""); ok || err != nil {
+		return key, StubFallbackDefault, meta, body, err
+	}
+	return "", "", ResponseMeta{}, nil, os.ErrNotExist
+}
+
+// closestQueryStub returns the diversifier of the endpoint's stub whose
+// recorded request shares the most query parameters with req. Stubs for other
+// methods or, when path variants are enabled, other route params are skipped.
+// Ties go to the stub with fewer conflicting values, then fewer extra
+// parameters, then the first in name order.
+func (d *StubDoer) closestQueryStub(req *http.Request, endpointName string, vars map[string]string) (string, bool) {
+	query := req.URL.Query()
+	if len(query) == 0 {
+		return "", false
+	}
+	keys, err := d.Store.ListStubs()
+	if err != nil {
+		return "", false
+	}
+	pathEnabled, _ := d.Store.CurrentPolicy().PathVariantEnabled(endpointName)
+
+	best, found := "", false
+	var bestScore [3]int
+	for _, key := range keys {
+		div, ok := stubDiversifier(key, endpointName)
+		if !ok {
+			continue
+		}
+		spec, err := d.Store.ReadRequest(endpointName, div)
+		if err != nil || !strings.EqualFold(spec.Method, req.Method) {
+			continue
+		}
+		u, err := url.Parse(spec.URL)
+		if err != nil {
+			continue
+		}
+		if pathEnabled {
+			r := &http.Request{Method: req.Method, URL: u}
+			if name, stubVars, ok := d.Matcher.Match(r); !ok || name != endpointName || !maps.Equal(stubVars, vars) {
+				continue
+			}
+		}
+		overlap, conflicts, extras := compareQueries(query, u.Query())
+		if overlap == 0 {
+			continue
+		}
+		score := [3]int{overlap, -conflicts, -extras}
+		if !found || scoreGreater(score, bestScore) {
+			best, bestScore, found = div, score, true
+		}
+	}
+	return best, found
+}
+
+// compareQueries counts the request parameters a stub's query shares, the
+// parameters it has with other values and the parameters the request lacks.
+func compareQueries(req, stub url.Values) (overlap, conflicts, extras int) {
+	for key, vals := range stub {
+		reqVals, ok := req[key]
+		if !ok {
+			extras++
+			continue
+		}
+		matched := false
+		for _, v := range vals {
+			for _, rv := range reqVals {
+				if v == rv {
+					overlap++
+					matched = true
+				}
+			}
+		}
+		if !matched {
+			conflicts++
+		}
+	}
+	return overlap, conflicts, extras
+}
+
+func scoreGreater(a, b [3]int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] > b[i]
+		}
+	}
+	return false
+}
+
+// stubDiversifier returns the diversifier part of a stub key if the key
+// belongs to the endpoint.
+func stubDiversifier(key, endpointName string) (string, bool) {
+	if key == endpointName {
+		return "", true
+	}
+	return strings.CutPrefix(key, endpointName+"--")
+}
+
+// pathOnlyPolicy returns a copy of p in which only route params diversify the
+// endpoint's stubs.
+func pathOnlyPolicy(p Policy, endpointName string) Policy {
+	endpoints := maps.Clone(p.Endpoints)
+	if endpoints == nil {
+		endpoints = map[string]EndpointPolicy{}
+	}
+	ep := endpoints[endpointName]
+	variant := VariantPolicy{
+		Query: &QueryVariant{Enabled: false},
+		Body:  &BodyVariant{Enabled: false},
+	}
+	if ep.Variant != nil {
+		variant.Path = ep.Variant.Path
+		variant.Names = ep.Variant.Names
+	}
+	ep.Variant = &variant
+	endpoints[endpointName] = ep
+	p.Endpoints = endpoints
+	return p
+}
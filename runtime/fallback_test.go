@@ -0,0 +1,77 @@
+package runtime
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestStubDoerFallbackChain(t *testing.T) {
+	store, err := NewWithStorage(memoryStorageWithPolicy(t, `{
+  "upstream": "https://example.com",
+  "fallback": true,
+  "endpoints": {"GetThing": {"variant": {"path": true}}, "Other": {"fallback": false}}
+}`))
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	endpoints := []Endpoint{
+		{Name: "GetThing", Method: http.MethodGet, Pattern: "/things/{id}"},
+		{Name: "ListThings", Method: http.MethodGet, Pattern: "/things"},
+		{Name: "Other", Method: http.MethodGet, Pattern: "/other"},
+	}
+	write := func(endpointName, rawURL string, vars map[string]string, body string) {
+		t.Helper()
+		u, _ := url.Parse(rawURL)
+		div := RequestDiversifier(store.Policy, endpointName, u.Query(), vars, nil, nil)
+		if err := store.WriteStub(endpointName, RequestSpec{Method: http.MethodGet, URL: rawURL}, ResponseMeta{
+			Status:   200,
+			MimeType: "application/json",
+			Size:     len(body),
+		}, []byte(body), div); err != nil {
+			t.Fatalf("write stub: %v", err)
+		}
+	}
+	write("GetThing", "http://example.com/things/1", map[string]string{"id": "1"}, `"thing-1"`)
+	write("ListThings", "http://example.com/things", nil, `"default"`)
+	write("ListThings", "http://example.com/things?status=open&page=1", nil, `"open"`)
+	write("ListThings", "http://example.com/things?status=closed", nil, `"closed"`)
+	write("Other", "http://example.com/other?a=1", nil, `"other"`)
+
+	d := NewStubDoer(store, endpoints)
+	cases := []struct {
+		url      string
+		status   int
+		body     string
+		fallback StubFallback
+	}{
+		{"http://example.com/things?status=open&page=1", 200, `"open"`, ""},
+		{"http://example.com/things/1?expand=owner", 200, `"thing-1"`, StubFallbackPath},
+		{"http://example.com/things?status=open&page=2", 200, `"open"`, StubFallbackQuery},
+		{"http://example.com/things?sort=name", 200, `"default"`, StubFallbackDefault},
+		{"http://example.com/things/2", http.StatusNotImplemented, "", ""},
+		{"http://example.com/other?a=2", http.StatusNotImplemented, "", ""},
+	}
+	for _, tc := range cases {
+		ctx, match := WithStubMatch(t.Context())
+		req := mustRequest(t, http.MethodGet, tc.url).WithContext(ctx)
+		resp, err := d.Do(req)
+		if err != nil {
+			t.Fatalf("%s: do: %v", tc.url, err)
+		}
+		if resp.StatusCode != tc.status {
+			t.Fatalf("%s: expected status %d, got %d", tc.url, tc.status, resp.StatusCode)
+		}
+		if tc.status != 200 {
+			if match.Stub != "" {
+				t.Fatalf("%s: expected no stub, got %+v", tc.url, match)
+			}
+			continue
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != tc.body || match.Fallback != tc.fallback {
+			t.Fatalf("%s: expected %s via %q, got %s via %+v", tc.url, tc.body, tc.fallback, body, match)
+		}
+	}
+}
@@ -0,0 +1,415 @@
+package runtime
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"goa.design/clue/log"
+)
+
+// Fault names a failure injected into a playback response.
+type Fault string
+
+const (
+	// FaultError answers with a 5xx status instead of the stub.
+	FaultError Fault = "error"
+	// FaultReset drops the connection before anything is written.
+	FaultReset Fault = "reset"
+	// FaultTruncate cuts the response body short.
+	FaultTruncate Fault = "truncate"
+	// FaultDrip sends the response body a few bytes at a time.
+	FaultDrip Fault = "drip"
+	// FaultTimeout never answers; the request fails once its context ends.
+	FaultTimeout Fault = "timeout"
+)
+
+const (
+	// defaultFaultStatus is the status of injected errors.
+	defaultFaultStatus = http.StatusServiceUnavailable
+	// defaultDripRate is the speed of dripped bodies in bytes per second.
+	defaultDripRate = 100
+	// dripInterval is the pause between two dripped chunks.
+	dripInterval = 100 * time.Millisecond
+)
+
+// ErrFaultReset is returned by StubDoer for requests whose connection is reset
+// by fault injection. It wraps syscall.ECONNRESET.
+var ErrFaultReset = fmt.Errorf("vcr: injected fault: %w", syscall.ECONNRESET)
+
+// Faults is a fault injection profile for playback. Each rate is the
+// percentage (0-100) of stub responses that suffer the fault; a response
+// suffers at most one fault.
+type Faults struct {
+	// Error is the rate of responses replaced by an error with Status.
+	Error float64 `json:"error,omitempty"`
+	// Status is the status of injected errors. If zero, 503.
+	Status int `json:"status,omitempty"`
+	// Reset is the rate of connections dropped before the response.
+	Reset float64 `json:"reset,omitempty"`
+	// Truncate is the rate of response bodies cut short at a random offset.
+	Truncate float64 `json:"truncate,omitempty"`
+	// Drip is the rate of response bodies sent at DripRate.
+	Drip float64 `json:"drip,omitempty"`
+	// DripRate is the speed of dripped bodies in bytes per second. If zero,
+	// 100.
+	DripRate int `json:"drip_rate,omitempty"`
+	// Timeout is the rate of requests that are never answered.
+	Timeout float64 `json:"timeout,omitempty"`
+}
+
+// ParseFaults parses a fault profile written as comma-separated name=value
+// pairs, e.g. "error=5,reset=1,truncate=2,drip=10,timeout=1,status=502".
+func ParseFaults(s string) (Faults, error) {
+	var f Faults
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return Faults{}, fmt.Errorf("invalid fault %q (want name=value)", pair)
+		}
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		var err error
+		switch name {
+		case "status":
+			f.Status, err = strconv.Atoi(value)
+		case "drip_rate":
+			f.DripRate, err = strconv.Atoi(value)
+		case string(FaultError):
+			f.Error, err = strconv.ParseFloat(value, 64)
+		case string(FaultReset):
+			f.Reset, err = strconv.ParseFloat(value, 64)
+		case string(FaultTruncate):
+			f.Truncate, err = strconv.ParseFloat(value, 64)
+		case string(FaultDrip):
+			f.Drip, err = strconv.ParseFloat(value, 64)
+		case string(FaultTimeout):
+			f.Timeout, err = strconv.ParseFloat(value, 64)
+		default:
+			return Faults{}, fmt.Errorf("unknown fault %q (want error, reset, truncate, drip, timeout, status or drip_rate)", name)
+		}
+		if err != nil {
+			return Faults{}, fmt.Errorf("invalid fault %q: %w", pair, err)
+		}
+	}
+	return f, f.Validate()
+}
+
+// Validate checks that rates are percentages adding up to at most 100 and that
+// the error status is a 5xx status.
+func (f *Faults) Validate() error {
+	if f == nil {
+		return nil
+	}
+	total := 0.0
+	for _, rate := range []float64{f.Error, f.Reset, f.Truncate, f.Drip, f.Timeout} {
+		if rate < 0 || rate > 100 {
+			return fmt.Errorf("rates must be between 0 and 100, got %v", rate)
+		}
+		total += rate
+	}
+	if total > 100 {
+		return fmt.Errorf("rates add up to %v%%, more than 100%%", total)
+	}
+	if f.Status != 0 && (f.Status < 500 || f.Status > 599) {
+		return fmt.Errorf("status must be a 5xx status, got %d", f.Status)
+	}
+	if f.DripRate < 0 {
+		return fmt.Errorf("drip_rate must not be negative, got %d", f.DripRate)
+	}
+	return nil
+}
+
+// enabled reports whether any fault has a rate.
+func (f Faults) enabled() bool {
+	return f.Error > 0 || f.Reset > 0 || f.Truncate > 0 || f.Drip > 0 || f.Timeout > 0
+}
+
+func (f Faults) status() int {
+	if f.Status == 0 {
+		return defaultFaultStatus
+	}
+	return f.Status
+}
+
+func (f Faults) dripRate() int {
+	if f.DripRate == 0 {
+		return defaultDripRate
+	}
+	return f.DripRate
+}
+
+// pick returns the fault for a draw in [0, 100), or "" for none.
+func (f Faults) pick(draw float64) Fault {
+	for _, c := range []struct {
+		fault Fault
+		rate  float64
+	}{
+		{FaultError, f.Error},
+		{FaultReset, f.Reset},
+		{FaultTruncate, f.Truncate},
+		{FaultDrip, f.Drip},
+		{FaultTimeout, f.Timeout},
+	} {
+		if draw < c.rate {
+			return c.fault
+		}
+		draw -= c.rate
+	}
+	return ""
+}
+
+// ResponseFaults returns endpoints[name].faults, then faults, then no faults.
+func (p Policy) ResponseFaults(endpointName string) Faults {
+	if ep, ok := p.Endpoints[endpointName]; ok && ep.Faults != nil {
+		return *ep.Faults
+	}
+	if p.Faults != nil {
+		return *p.Faults
+	}
+	return Faults{}
+}
+
+// faults returns the fault profile of the endpoint's stub responses.
+func (d *StubDoer) faults(endpointName string) Faults {
+	d.settingsMu.RLock()
+	f := d.Faults
+	d.settingsMu.RUnlock()
+	if f != nil {
+		return *f
+	}
+	return d.Store.CurrentPolicy().ResponseFaults(endpointName)
+}
+
+// drawFault picks the fault for a response and, for truncation, the fraction
+// of the body to keep. Draws come from a generator seeded with FaultSeed, then
+// Policy.FaultSeed, then a random seed that is logged so the run can be
+// reproduced.
+func (d *StubDoer) drawFault(ctx context.Context, f Faults) (Fault, float64) {
+	if !f.enabled() {
+		return "", 0
+	}
+	d.faultMu.Lock()
+	defer d.faultMu.Unlock()
+	if d.faultRand == nil {
+		var seed uint64
+		policySeed := d.Store.CurrentPolicy().FaultSeed
+		switch {
+		case d.FaultSeed != nil:
+			seed = *d.FaultSeed
+		case policySeed != nil:
+			seed = *policySeed
+		default:
+			seed = rand.Uint64()
+			log.Print(ctx, log.KV{K: "msg", V: "vcr fault seed"}, log.KV{K: "vcr.fault_seed", V: seed})
+		}
+		d.faultRand = rand.New(rand.NewPCG(seed, seed))
+	}
+	return f.pick(d.faultRand.Float64() * 100), d.faultRand.Float64()
+}
+
+// injectFault applies the fault drawn for a stub response. When the request
+// comes through FaultMiddleware, resets, truncation and drips are left to the
+// middleware, which applies them to the playback response itself.
+func (d *StubDoer) injectFault(req *http.Request, endpointName string, resp *http.Response) (*http.Response, error) {
+	ctx := req.Context()
+	f := d.faults(endpointName)
+	fault, keep := d.drawFault(ctx, f)
+	if fault == "" {
+		return resp, nil
+	}
+	state, _ := ctx.Value(faultKey{}).(*faultState)
+	if state != nil {
+		state.fault, state.keep, state.rate = fault, keep, f.dripRate()
+	}
+	switch fault {
+	case FaultError:
+		_ = resp.Body.Close()
+		resp = vcrErrorResponse(req, f.status(), "vcr: injected fault")
+		setStubResult(ctx, endpointName, resp.StatusCode, resp.Header)
+		return resp, nil
+	case FaultReset:
+		_ = resp.Body.Close()
+		return nil, ErrFaultReset
+	case FaultTimeout:
+		_ = resp.Body.Close()
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if state != nil {
+		return resp, nil
+	}
+	switch fault {
+	case FaultTruncate:
+		resp.Body = &truncatedBody{ReadCloser: resp.Body, remaining: int64(keep * float64(max(resp.ContentLength, 0)))}
+	case FaultDrip:
+		resp.Body = &dripBody{ReadCloser: resp.Body, ctx: ctx, chunk: dripChunk(f.dripRate())}
+	}
+	return resp, nil
+}
+
+// dripChunk returns the number of bytes dripped every dripInterval.
+func dripChunk(rate int) int {
+	return max(1, rate*int(dripInterval)/int(time.Second))
+}
+
+// truncatedBody fails with io.ErrUnexpectedEOF after remaining bytes.
+type truncatedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *truncatedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// dripBody reads at most chunk bytes every dripInterval.
+type dripBody struct {
+	io.ReadCloser
+	ctx   context.Context
+	chunk int
+	read  bool
+}
+
+func (b *dripBody) Read(p []byte) (int, error) {
+	if b.read {
+		if err := sleep(b.ctx, dripInterval); err != nil {
+			return 0, err
+		}
+	}
+	b.read = true
+	if len(p) > b.chunk {
+		p = p[:b.chunk]
+	}
+	return b.ReadCloser.Read(p)
+}
+
+type faultKey struct{}
+
+// faultState carries the fault drawn by StubDoer to FaultMiddleware.
+type faultState struct {
+	fault Fault
+	// keep is the fraction of a truncated body that is sent.
+	keep float64
+	// rate is the speed of a dripped body in bytes per second.
+	rate int
+}
+
+// FaultMiddleware applies the faults that StubDoer injects into requests
+// served by next to the connection itself: reset requests are aborted before
+// anything is written, truncated responses announce their full length but
+// abort partway through the body, and dripped responses are flushed a few
+// bytes at a time.
+func FaultMiddleware(next http.Handler) http.Handler {
+	if next == nil {
+		return http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state := &faultState{}
+		r = r.WithContext(context.WithValue(r.Context(), faultKey{}, state))
+		fw := &faultWriter{ResponseWriter: w, ctx: r.Context(), state: state}
+		next.ServeHTTP(fw, r)
+		switch state.fault {
+		case FaultReset:
+			panic(http.ErrAbortHandler)
+		case FaultTruncate:
+			body := fw.held.Bytes()
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			if fw.status == 0 {
+				fw.status = http.StatusOK
+			}
+			w.WriteHeader(fw.status)
+			_, _ = w.Write(body[:int(state.keep*float64(len(body)))])
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+			panic(http.ErrAbortHandler)
+		}
+	})
+}
+
+// faultWriter discards the response of reset requests, holds back the response
+// of truncated requests and drips the body of dripped requests.
+type faultWriter struct {
+	http.ResponseWriter
+	ctx    context.Context
+	state  *faultState
+	status int
+	held   bytes.Buffer
+}
+
+func (w *faultWriter) WriteHeader(status int) {
+	switch w.state.fault {
+	case FaultReset:
+	case FaultTruncate:
+		if w.status == 0 {
+			w.status = status
+		}
+	default:
+		w.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (w *faultWriter) Write(p []byte) (int, error) {
+	switch w.state.fault {
+	case FaultReset:
+		return len(p), nil
+	case FaultTruncate:
+		return w.held.Write(p)
+	case FaultDrip:
+		chunk := dripChunk(w.state.rate)
+		written := 0
+		for written < len(p) {
+			if written > 0 {
+				if err := sleep(w.ctx, dripInterval); err != nil {
+					return written, err
+				}
+			}
+			n, err := w.ResponseWriter.Write(p[written:min(len(p), written+chunk)])
+			written += n
+			if err != nil {
+				return written, err
+			}
+			w.Flush()
+		}
+		return written, nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *faultWriter) Flush() {
+	switch w.state.fault {
+	case FaultReset, FaultTruncate:
+		return
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *faultWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+func (w *faultWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
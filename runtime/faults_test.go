@@ -0,0 +1,163 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseFaults(t *testing.T) {
+	got, err := ParseFaults("error=5, reset=1,truncate=2.5,drip=10,timeout=1,status=502,drip_rate=50")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	want := Faults{Error: 5, Reset: 1, Truncate: 2.5, Drip: 10, Timeout: 1, Status: 502, DripRate: 50}
+	if got != want {
+		t.Fatalf("got %+v want %+v", got, want)
+	}
+	for _, in := range []string{"error", "slow=5", "error=x", "error=60,reset=50", "error=-1", "status=404"} {
+		if _, err := ParseFaults(in); err == nil {
+			t.Fatalf("ParseFaults(%q): expected error", in)
+		}
+	}
+	if _, err := NewWithStorage(memoryStorageWithPolicy(t, `{"upstream":"https://example.com","endpoints":{"Known":{"faults":{"error":101}}}}`)); err == nil {
+		t.Fatalf("expected invalid endpoint faults to be rejected")
+	}
+}
+
+// faultDoer returns a StubDoer serving one JSON stub for GET /known.
+func faultDoer(t *testing.T, faults Faults) *StubDoer {
+	t.Helper()
+	store, err := NewWithStorage(memoryStorageWithPolicy(t, `{"upstream":"https://example.com"}`))
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	body := []byte(`{"message":"hello, world"}`)
+	if err := store.WriteStub("Known", RequestSpec{URL: "http://example.com/known"}, ResponseMeta{Status: 200, MimeType: "application/json", Size: len(body)}, body); err != nil {
+		t.Fatalf("write stub: %v", err)
+	}
+	d := NewStubDoer(store, []Endpoint{{Name: "Known", Method: http.MethodGet, Pattern: "/known"}})
+	seed := uint64(7)
+	d.Faults = &faults
+	d.FaultSeed = &seed
+	return d
+}
+
+func TestStubDoerInjectsFaults(t *testing.T) {
+	resp, err := faultDoer(t, Faults{Error: 100, Status: 502}).Do(mustRequest(t, http.MethodGet, "http://example.com/known"))
+	if err != nil || resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected injected error, got %v %v", resp, err)
+	}
+
+	if _, err := faultDoer(t, Faults{Reset: 100}).Do(mustRequest(t, http.MethodGet, "http://example.com/known")); !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("expected connection reset, got %v", err)
+	}
+
+	resp, err = faultDoer(t, Faults{Truncate: 100}).Do(mustRequest(t, http.MethodGet, "http://example.com/known"))
+	if err != nil {
+		t.Fatalf("do: %v", err)
+	}
+	if b, err := io.ReadAll(resp.Body); !errors.Is(err, io.ErrUnexpectedEOF) || int64(len(b)) >= resp.ContentLength {
+		t.Fatalf("expected truncated body, got %q %v", b, err)
+	}
+
+	resp, err = faultDoer(t, Faults{Drip: 100, DripRate: 100}).Do(mustRequest(t, http.MethodGet, "http://example.com/known"))
+	if err != nil {
+		t.Fatalf("do: %v", err)
+	}
+	start := time.Now()
+	if b, err := io.ReadAll(resp.Body); err != nil || string(b) != `{"message":"hello, world"}` {
+		t.Fatalf("unexpected dripped body: %q %v", b, err)
+	}
+	if elapsed := time.Since(start); elapsed < 2*dripInterval {
+		t.Fatalf("expected a slow body, took %v", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req := mustRequest(t, http.MethodGet, "http://example.com/known").WithContext(ctx)
+	if _, err := faultDoer(t, Faults{Timeout: 100}).Do(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+}
+
+func TestStubDoerFaultsAreReproducible(t *testing.T) {
+	draw := func() []int {
+		d := faultDoer(t, Faults{Error: 50})
+		var statuses []int
+		for i := 0; i < 20; i++ {
+			resp, err := d.Do(mustRequest(t, http.MethodGet, "http://example.com/known"))
+			if err != nil {
+				t.Fatalf("do: %v", err)
+			}
+			statuses = append(statuses, resp.StatusCode)
+		}
+		return statuses
+	}
+	first, second := draw(), draw()
+	failed := 0
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("runs with the same seed differ: %v vs %v", first, second)
+		}
+		if first[i] != http.StatusOK {
+			failed++
+		}
+	}
+	if failed == 0 || failed == len(first) {
+		t.Fatalf("expected some but not all responses to fail: %v", first)
+	}
+}
+
+func TestFaultMiddlewareAppliesFaultsToConnection(t *testing.T) {
+	serve := func(faults Faults) *httptest.Server {
+		d := faultDoer(t, faults)
+		return httptest.NewServer(FaultMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			req := mustRequest(t, http.MethodGet, "http://example.com/known").WithContext(r.Context())
+			resp, err := d.Do(req)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(resp.StatusCode)
+			_, _ = io.Copy(w, resp.Body)
+		})))
+	}
+
+	srv := serve(Faults{Reset: 100})
+	if _, err := http.Get(srv.URL); err == nil {
+		t.Fatalf("expected the connection to be dropped")
+	}
+	srv.Close()
+
+	srv = serve(Faults{Truncate: 100})
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if b, err := io.ReadAll(resp.Body); err == nil {
+		t.Fatalf("expected a truncated body, got %q", b)
+	}
+	srv.Close()
+
+	srv = serve(Faults{Drip: 100, DripRate: 100})
+	start := time.Now()
+	resp, err = http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil || !strings.Contains(string(b), "hello, world") {
+		t.Fatalf("unexpected dripped body: %q %v", b, err)
+	}
+	if elapsed := time.Since(start); elapsed < 2*dripInterval {
+		t.Fatalf("expected a slow body, took %v", elapsed)
+	}
+	srv.Close()
+}
@@ -2,13 +2,22 @@ package runtime
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"net/http"
 	"net/url"
-	"os"
+	"sort"
 	"strings"
+	"time"
 )
 
+// harTimeFormat is the ISO 8601 layout used for HAR startedDateTime.
+const harTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// har is a HAR 1.2 log. Stubs keep the full request and response, so they
+// open in browser devtools and other HAR viewers; repeated headers keep every
+// value. Older, minimal stubs are still read.
 type har struct {
 	Log harLog `json:"log"`
 }
@@ -25,24 +34,46 @@ type harCreator struct {
 }
 
 type harEntry struct {
-	Request  harRequest  `json:"request"`
-	Response harResponse `json:"response"`
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
 }
 
 type harRequest struct {
-	URL string `json:"url"`
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
 }
 
 type harResponse struct {
-	Status     int            `json:"status"`
-	StatusText string         `json:"statusText,omitempty"`
-	Headers    []harNameValue `json:"headers,omitempty"`
-	Content    harContent     `json:"content"`
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
 }
 
 type harContent struct {
 	Size     int    `json:"size"`
-	MimeType string `json:"mimeType,omitempty"`
+	MimeType string `json:"mimeType"`
 	Encoding string `json:"encoding,omitempty"`
 }
 
@@ -51,75 +82,194 @@ type harNameValue struct {
 	Value string `json:"value"`
 }
 
-// stub represents a parsed VCR stub file and its blob on disk.
+type harCookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Expires  string `json:"expires,omitempty"`
+	HTTPOnly bool   `json:"httpOnly,omitempty"`
+	Secure   bool   `json:"secure,omitempty"`
+}
+
+// harTimings holds HAR timing phases in milliseconds; -1 marks a phase that
+// does not apply.
+type harTimings struct {
+	Blocked float64 `json:"blocked,omitempty"`
+	DNS     float64 `json:"dns,omitempty"`
+	Connect float64 `json:"connect,omitempty"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl,omitempty"`
+}
+
+// stub represents a parsed VCR stub file and its blob in storage.
 type stub struct {
-	HARPath  string
-	BlobPath string
+	HARName  string
+	BlobName string
 	Request  RequestSpec
 	Response ResponseMeta
+	// Sequence holds the response of every HAR entry in order. It has a
+	// single element, Response, unless successive responses were recorded.
+	Sequence []ResponseMeta
 }
 
 // ResponseMeta describes the response metadata persisted in the HAR file.
 type ResponseMeta struct {
-	Status   int
-	Headers  map[string]string
+	Status int
+	// Headers holds every recorded response header value, in order.
+	Headers  http.Header
 	MimeType string
 	Size     int
+	// HTTPVersion is the response protocol, e.g. "HTTP/1.1".
+	HTTPVersion string
+	// RedirectURL is the Location header of redirect responses.
+	RedirectURL string
+	// StartedAt is when the recorded request was issued.
+	StartedAt time.Time
+	// Timings breaks down how long the recorded exchange took.
+	Timings Timings
+	// Template reports that the body is a text/template read from a
+	// TemplateExt blob. It is not persisted in the HAR file.
+	Template bool
+}
+
+// Timings describes the phases of a recorded HTTP exchange, following HAR.
+type Timings struct {
+	// Send is the time spent sending the request.
+	Send time.Duration
+	// Wait is the time spent waiting for the first response byte.
+	Wait time.Duration
+	// Receive is the time spent reading the response body.
+	Receive time.Duration
+}
+
+// Total returns the overall duration of the exchange.
+func (t Timings) Total() time.Duration {
+	return t.Send + t.Wait + t.Receive
 }
 
-// readStub loads a HAR file from disk and returns a parsed stub.
-func readStub(harPath string) (*stub, error) {
-	archive, err := readHAR(harPath)
+// readStub loads a HAR file from storage and returns a parsed stub.
+func readStub(storage Storage, harName string) (*stub, error) {
+	archive, err := readHAR(storage, harName)
 	if err != nil {
 		return nil, err
 	}
-	entry, err := singleEntry(archive)
-	if err != nil {
+	if err := checkEntries(archive); err != nil {
 		return nil, err
 	}
+	entry := &archive.Log.Entries[0]
 	req := RequestSpec{
-		URL: entry.Request.URL,
+		Method:      entry.Request.Method,
+		URL:         entry.Request.URL,
+		HTTPVersion: entry.Request.HTTPVersion,
+		Headers:     nameValuesToHeader(entry.Request.Headers),
+	}
+	if req.Method == "" {
+		// Stubs recorded before non-GET support omit the method.
+		req.Method = http.MethodGet
 	}
 	if u, err := url.Parse(entry.Request.URL); err == nil {
 		req.Host = u.Host
 	}
+	if pd := entry.Request.PostData; pd != nil {
+		req.Body = []byte(pd.Text)
+		req.MimeType = pd.MimeType
+	}
+	sequence := make([]ResponseMeta, 0, len(archive.Log.Entries))
+	for _, e := range archive.Log.Entries {
+		sequence = append(sequence, responseMetaFromEntry(e))
+	}
 	return &stub{
-		HARPath:  harPath,
-		BlobPath: blobPathForHARPath(harPath),
+		HARName:  harName,
+		BlobName: blobPathForHARPath(harName),
 		Request:  req,
-		Response: responseMetaFromHAR(entry.Response),
+		Response: sequence[0],
+		Sequence: sequence,
 	}, nil
 }
 
+func responseMetaFromEntry(entry harEntry) ResponseMeta {
+	resp := responseMetaFromHAR(entry.Response)
+	if entry.StartedDateTime != "" {
+		if t, err := time.Parse(time.RFC3339Nano, entry.StartedDateTime); err == nil {
+			resp.StartedAt = t
+		}
+	}
+	resp.Timings = timingsFromHAR(entry.Timings)
+	return resp
+}
+
 // writeStub writes a HAR file with the provided request/response metadata.
-func writeStub(harPath string, req RequestSpec, resp ResponseMeta) error {
+func writeStub(storage Storage, harName string, req RequestSpec, resp ResponseMeta) error {
 	archive := &har{
 		Log: harLog{
 			Version: "1.2",
 			Creator: harCreator{Name: "goa-vcr"},
-			Entries: []harEntry{
-				{
-					Request: harRequest{
-						URL: req.URL,
-					},
-					Response: harResponse{
-						Status:     resp.Status,
-						StatusText: httpStatusText(resp.Status),
-						Headers:    headersToNameValues(resp.Headers),
-						Content: harContent{
-							MimeType: resp.MimeType,
-							Size:     resp.Size,
-						},
-					},
-				},
+			Entries: []harEntry{newHAREntry(req, resp)},
+		},
+	}
+	return writeHAR(storage, harName, archive)
+}
+
+// appendStub adds an entry to the HAR file, creating it if needed, and returns
+// the index of the new entry.
+func appendStub(storage Storage, harName string, req RequestSpec, resp ResponseMeta) (int, error) {
+	archive, err := readHAR(storage, harName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, writeStub(storage, harName, req, resp)
+	}
+	if err != nil {
+		return 0, err
+	}
+	archive.Log.Entries = append(archive.Log.Entries, newHAREntry(req, resp))
+	return len(archive.Log.Entries) - 1, writeHAR(storage, harName, archive)
+}
+
+func newHAREntry(req RequestSpec, resp ResponseMeta) harEntry {
+	startedAt := resp.StartedAt
+	if startedAt.IsZero() {
+		startedAt = time.Now()
+	}
+	return harEntry{
+		StartedDateTime: startedAt.Format(harTimeFormat),
+		Time:            durationMillis(resp.Timings.Total()),
+		Request: harRequest{
+			Method:      requestMethod(req),
+			URL:         req.URL,
+			HTTPVersion: httpVersion(req.HTTPVersion),
+			Cookies:     requestCookies(req.Headers),
+			Headers:     headerToNameValues(req.Headers),
+			QueryString: queryStringFromURL(req.URL),
+			PostData:    postDataFromRequest(req),
+			HeadersSize: -1,
+			BodySize:    len(req.Body),
+		},
+		Response: harResponse{
+			Status:      resp.Status,
+			StatusText:  httpStatusText(resp.Status),
+			HTTPVersion: httpVersion(resp.HTTPVersion),
+			Cookies:     responseCookies(resp.Headers),
+			Headers:     headerToNameValues(resp.Headers),
+			Content: harContent{
+				MimeType: resp.MimeType,
+				Size:     resp.Size,
 			},
+			RedirectURL: resp.RedirectURL,
+			HeadersSize: -1,
+			BodySize:    resp.Size,
+		},
+		Timings: harTimings{
+			Send:    durationMillis(resp.Timings.Send),
+			Wait:    durationMillis(resp.Timings.Wait),
+			Receive: durationMillis(resp.Timings.Receive),
 		},
 	}
-	return writeHAR(harPath, archive)
 }
 
-func readHAR(path string) (*har, error) {
-	data, err := os.ReadFile(path)
+func readHAR(storage Storage, path string) (*har, error) {
+	data, err := storage.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("read %s: %w", path, err)
 	}
@@ -130,13 +280,13 @@ func readHAR(path string) (*har, error) {
 	return &archive, nil
 }
 
-func writeHAR(path string, archive *har) error {
+func writeHAR(storage Storage, path string, archive *har) error {
 	data, err := json.MarshalIndent(archive, "", "  ")
 	if err != nil {
 		return fmt.Errorf("marshal %s: %w", path, err)
 	}
 	data = append(data, '\n')
-	if err := os.WriteFile(path, data, 0600); err != nil {
+	if err := storage.WriteFile(path, data); err != nil {
 		return fmt.Errorf("write %s: %w", path, err)
 	}
 	return nil
@@ -149,38 +299,185 @@ func blobPathForHARPath(harPath string) string {
 	return harPath + ".blob"
 }
 
-func responseMetaFromHAR(resp harResponse) ResponseMeta {
-	headers := make(map[string]string, len(resp.Headers))
-	for _, header := range resp.Headers {
-		headers[header.Name] = header.Value
+// sequenceSep separates a stub key from the position of a sequence blob. Stub
+// keys never contain it, since escapeNamePart escapes it in readable names.
+const sequenceSep = "~"
+
+// sequenceBlobPath returns the blob holding the body of HAR entry index: the
+// usual blob for the first entry, then "<key>~2.vcr.json", "<key>~3.vcr.json"
+// and so on.
+func sequenceBlobPath(harPath string, index int) string {
+	if index == 0 {
+		return blobPathForHARPath(harPath)
 	}
-	return ResponseMeta{
-		Status:   resp.Status,
-		Headers:  headers,
-		MimeType: resp.Content.MimeType,
-		Size:     resp.Content.Size,
+	blob := blobPathForHARPath(harPath)
+	if key, ok := strings.CutSuffix(blob, ".vcr.json"); ok {
+		return fmt.Sprintf("%s%s%d.vcr.json", key, sequenceSep, index+1)
+	}
+	return fmt.Sprintf("%s%s%d", blob, sequenceSep, index+1)
+}
+
+// stubKeyForName returns the key of the stub that a .vcr.har file or one of
+// its blobs belongs to.
+func stubKeyForName(name string) (string, bool) {
+	if key, ok := strings.CutSuffix(name, ".vcr.har"); ok {
+		return key, true
+	}
+	key, ok := strings.CutSuffix(name, ".vcr.json")
+	if !ok {
+		return "", false
+	}
+	if i := strings.LastIndex(key, sequenceSep); i >= 0 {
+		key = key[:i]
+	}
+	return key, true
+}
+
+func requestMethod(req RequestSpec) string {
+	if req.Method == "" {
+		return http.MethodGet
 	}
+	return req.Method
 }
 
-func headersToNameValues(headers map[string]string) []harNameValue {
-	if len(headers) == 0 {
+func httpVersion(proto string) string {
+	if proto == "" {
+		return "HTTP/1.1"
+	}
+	return proto
+}
+
+func postDataFromRequest(req RequestSpec) *harPostData {
+	if len(req.Body) == 0 {
 		return nil
 	}
+	return &harPostData{
+		MimeType: req.MimeType,
+		Text:     string(req.Body),
+	}
+}
+
+func queryStringFromURL(rawURL string) []harNameValue {
+	pairs := []harNameValue{}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return pairs
+	}
+	query := u.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range query[key] {
+			pairs = append(pairs, harNameValue{Name: key, Value: value})
+		}
+	}
+	return pairs
+}
+
+func requestCookies(headers http.Header) []harCookie {
+	cookies := []harCookie{}
+	for _, line := range headers.Values("Cookie") {
+		parsed, err := http.ParseCookie(line)
+		if err != nil {
+			continue
+		}
+		for _, c := range parsed {
+			cookies = append(cookies, harCookie{Name: c.Name, Value: c.Value})
+		}
+	}
+	return cookies
+}
+
+func responseCookies(headers http.Header) []harCookie {
+	cookies := []harCookie{}
+	for _, line := range headers.Values("Set-Cookie") {
+		c, err := http.ParseSetCookie(line)
+		if err != nil {
+			continue
+		}
+		hc := harCookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Domain:   c.Domain,
+			HTTPOnly: c.HttpOnly,
+			Secure:   c.Secure,
+		}
+		if !c.Expires.IsZero() {
+			hc.Expires = c.Expires.UTC().Format(harTimeFormat)
+		}
+		cookies = append(cookies, hc)
+	}
+	return cookies
+}
+
+func responseMetaFromHAR(resp harResponse) ResponseMeta {
+	return ResponseMeta{
+		Status:      resp.Status,
+		Headers:     nameValuesToHeader(resp.Headers),
+		MimeType:    resp.Content.MimeType,
+		Size:        resp.Content.Size,
+		HTTPVersion: resp.HTTPVersion,
+		RedirectURL: resp.RedirectURL,
+	}
+}
+
+func headerToNameValues(headers http.Header) []harNameValue {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 	pairs := make([]harNameValue, 0, len(headers))
-	for name, value := range headers {
-		pairs = append(pairs, harNameValue{Name: name, Value: value})
+	for _, name := range names {
+		for _, value := range headers[name] {
+			pairs = append(pairs, harNameValue{Name: name, Value: value})
+		}
 	}
 	return pairs
 }
 
-func singleEntry(archive *har) (*harEntry, error) {
+func nameValuesToHeader(pairs []harNameValue) http.Header {
+	if len(pairs) == 0 {
+		return nil
+	}
+	headers := make(http.Header, len(pairs))
+	for _, pair := range pairs {
+		headers.Add(pair.Name, pair.Value)
+	}
+	return headers
+}
+
+func timingsFromHAR(t harTimings) Timings {
+	return Timings{
+		Send:    millisDuration(t.Send),
+		Wait:    millisDuration(t.Wait),
+		Receive: millisDuration(t.Receive),
+	}
+}
+
+func durationMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func millisDuration(ms float64) time.Duration {
+	if ms <= 0 {
+		return 0
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+func checkEntries(archive *har) error {
 	if archive == nil {
-		return nil, fmt.Errorf("har is nil")
+		return fmt.Errorf("har is nil")
 	}
-	if len(archive.Log.Entries) != 1 {
-		return nil, fmt.Errorf("har must contain exactly one entry")
+	if len(archive.Log.Entries) == 0 {
+		return fmt.Errorf("har must contain at least one entry")
 	}
-	return &archive.Log.Entries[0], nil
+	return nil
 }
 
 func httpStatusText(code int) string {
@@ -189,4 +486,3 @@ func httpStatusText(code int) string {
 	}
 	return http.StatusText(code)
 }
-
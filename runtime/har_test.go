@@ -1,22 +1,26 @@
 package runtime
 
 import (
+	"encoding/json"
+	"net/http"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestReadHARBlob(t *testing.T) {
 	tmpDir := t.TempDir()
-	harPath := filepath.Join(tmpDir, "Example.vcr.har")
-	blobPath := blobPathForHARPath(harPath)
+	storage := NewDirStorage(tmpDir)
+	harPath := "Example.vcr.har"
+	blobPath := filepath.Join(tmpDir, blobPathForHARPath(harPath))
 
 	blob := []byte(`{"foo":"bar"}`)
 	if err := os.WriteFile(blobPath, blob, 0600); err != nil {
 		t.Fatalf("write blob: %v", err)
 	}
 
-	if err := writeStub(harPath, RequestSpec{URL: "https://example.com/api"}, ResponseMeta{
+	if err := writeStub(storage, harPath, RequestSpec{URL: "https://example.com/api"}, ResponseMeta{
 		Status:   200,
 		MimeType: "application/json",
 		Size:     len(blob),
@@ -28,7 +32,7 @@ func TestReadHARBlob(t *testing.T) {
 		Foo string `json:"foo"`
 	}
 
-	result, err := readResult(harPath, func(b *Body) *Body { return b }, nil)
+	result, err := readResult(storage, harPath, func(b *Body) *Body { return b }, nil)
 	if err != nil {
 		t.Fatalf("read result: %v", err)
 	}
@@ -37,3 +41,102 @@ func TestReadHARBlob(t *testing.T) {
 	}
 }
 
+func TestWriteStubProducesCompleteHAR(t *testing.T) {
+	storage := NewMemoryStorage()
+	harPath := "CreateThing.vcr.har"
+	startedAt := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	req := RequestSpec{
+		Method:      http.MethodPost,
+		URL:         "https://example.com/things?b=2&a=1",
+		HTTPVersion: "HTTP/2.0",
+		Headers: http.Header{
+			"Accept": []string{"application/json"},
+			"Cookie": []string{"flag=on; theme=dark"},
+		},
+		Body:     []byte(`{"name":"a"}`),
+		MimeType: "application/json",
+	}
+	resp := ResponseMeta{
+		Status: http.StatusCreated,
+		Headers: http.Header{
+			"Content-Type": []string{"application/json"},
+			"Set-Cookie":   []string{"sid=abc; Path=/; HttpOnly", "lang=fr; Path=/"},
+		},
+		MimeType:    "application/json",
+		Size:        9,
+		RedirectURL: "https://example.com/things/1",
+		StartedAt:   startedAt,
+		Timings:     Timings{Wait: 40 * time.Millisecond, Receive: 2 * time.Millisecond},
+	}
+	if err := writeStub(storage, harPath, req, resp); err != nil {
+		t.Fatalf("write har: %v", err)
+	}
+
+	archive, err := readHAR(storage, harPath)
+	if err != nil {
+		t.Fatalf("read har: %v", err)
+	}
+	entry := archive.Log.Entries[0]
+	if archive.Log.Version != "1.2" || entry.StartedDateTime != "2024-05-01T12:30:00.000Z" || entry.Time != 42 {
+		t.Fatalf("unexpected entry: version=%q started=%q time=%v", archive.Log.Version, entry.StartedDateTime, entry.Time)
+	}
+	if entry.Request.Method != http.MethodPost || entry.Request.HTTPVersion != "HTTP/2.0" || entry.Request.BodySize != len(req.Body) {
+		t.Fatalf("unexpected request: %+v", entry.Request)
+	}
+	if len(entry.Request.QueryString) != 2 || entry.Request.QueryString[0].Name != "a" {
+		t.Fatalf("unexpected queryString: %+v", entry.Request.QueryString)
+	}
+	if len(entry.Request.Cookies) != 2 || entry.Request.Cookies[0].Name != "flag" {
+		t.Fatalf("unexpected request cookies: %+v", entry.Request.Cookies)
+	}
+	if entry.Response.StatusText != "Created" || entry.Response.HTTPVersion != "HTTP/1.1" || entry.Response.RedirectURL != resp.RedirectURL {
+		t.Fatalf("unexpected response: %+v", entry.Response)
+	}
+	if len(entry.Response.Cookies) != 2 || entry.Response.Cookies[0].Name != "sid" || !entry.Response.Cookies[0].HTTPOnly {
+		t.Fatalf("unexpected response cookies: %+v", entry.Response.Cookies)
+	}
+
+	parsed, err := readStub(storage, harPath)
+	if err != nil {
+		t.Fatalf("read stub: %v", err)
+	}
+	if parsed.Request.Headers.Get("Accept") != "application/json" || parsed.Request.HTTPVersion != "HTTP/2.0" {
+		t.Fatalf("unexpected parsed request: %+v", parsed.Request)
+	}
+	if !parsed.Response.StartedAt.Equal(startedAt) || parsed.Response.Timings != resp.Timings {
+		t.Fatalf("unexpected parsed response: %+v", parsed.Response)
+	}
+}
+
+func TestReadStubAcceptsMinimalHAR(t *testing.T) {
+	storage := NewMemoryStorage()
+	harPath := "GetThing.vcr.har"
+	minimal := map[string]any{
+		"log": map[string]any{
+			"version": "1.2",
+			"entries": []any{map[string]any{
+				"request":  map[string]any{"url": "https://example.com/things/1"},
+				"response": map[string]any{"status": 200, "content": map[string]any{"size": 2, "mimeType": "application/json"}},
+			}},
+		},
+	}
+	data, err := json.Marshal(minimal)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if err := storage.WriteFile(harPath, data); err != nil {
+		t.Fatalf("write har: %v", err)
+	}
+
+	parsed, err := readStub(storage, harPath)
+	if err != nil {
+		t.Fatalf("read stub: %v", err)
+	}
+	if parsed.Request.Method != http.MethodGet || parsed.Request.Host != "example.com" {
+		t.Fatalf("unexpected request: %+v", parsed.Request)
+	}
+	if parsed.Response.Status != 200 || parsed.Response.Size != 2 || !parsed.Response.StartedAt.IsZero() {
+		t.Fatalf("unexpected response: %+v", parsed.Response)
+	}
+}
+
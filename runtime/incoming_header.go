@@ -0,0 +1,54 @@
+package runtime
+
+import (
+	"context"
+	"net/http"
+)
+
+type incomingHeaderKey struct{}
+
+// WithIncomingHeader stores the headers of the request received by the
+// playback server in ctx. StubDoer diversifies by them when the request built
+// by the Goa client does not carry the header itself.
+func WithIncomingHeader(ctx context.Context, header http.Header) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, incomingHeaderKey{}, header)
+}
+
+// IncomingHeader returns the headers stored by WithIncomingHeader, if any.
+func IncomingHeader(ctx context.Context) http.Header {
+	if ctx == nil {
+		return nil
+	}
+	h, _ := ctx.Value(incomingHeaderKey{}).(http.Header)
+	return h
+}
+
+// IncomingHeaderMiddleware stores each request's headers in its context.
+func IncomingHeaderMiddleware(next http.Handler) http.Handler {
+	if next == nil {
+		return http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r != nil {
+			r = r.WithContext(WithIncomingHeader(r.Context(), r.Header.Clone()))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// diversifierHeader returns the headers used to diversify req: its own headers,
+// completed by those of the incoming playback request.
+func diversifierHeader(req *http.Request) http.Header {
+	incoming := IncomingHeader(req.Context())
+	if len(incoming) == 0 {
+		return req.Header
+	}
+	h := incoming.Clone()
+	for name, values := range req.Header {
+		h[name] = values
+	}
+	return h
+}
@@ -0,0 +1,30 @@
+package runtime
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIncomingHeaderMiddlewareCompletesDiversifierHeader(t *testing.T) {
+	var got http.Header
+	h := IncomingHeaderMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Simulate the Goa client building a fresh request from the payload.
+		out := httptest.NewRequest(http.MethodGet, "http://vcr.local/things", nil).WithContext(r.Context())
+		out.Header.Set("Accept", "application/json")
+		got = diversifierHeader(out)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/things", nil)
+	req.Header.Set("Accept-Language", "fr")
+	req.Header.Set("Accept", "text/html")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if got.Get("Accept-Language") != "fr" {
+		t.Fatalf("expected incoming header, got %v", got)
+	}
+	if got.Get("Accept") != "application/json" {
+		t.Fatalf("expected client header to win, got %v", got)
+	}
+}
@@ -0,0 +1,231 @@
+package runtime
+
+import (
+	"bufio"
+	"context"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+)
+
+// CallSource says what answered a call recorded in a Journal.
+type CallSource string
+
+const (
+	// CallStub was answered from a stub.
+	CallStub CallSource = "stub"
+	// CallScenario was answered by a scenario handler.
+	CallScenario CallSource = "scenario"
+	// CallUpstream had no stub and was forwarded to the upstream.
+	CallUpstream CallSource = "upstream"
+	// CallMiss had no stub and was answered with an error.
+	CallMiss CallSource = "miss"
+)
+
+// Call is a request to a known endpoint recorded in a Journal.
+type Call struct {
+	// Endpoint is the name of the matched endpoint.
+	Endpoint string
+	// Method and Path are those of the request.
+	Method string
+	Path   string
+	// Vars holds the route params.
+	Vars map[string]string
+	// Query holds the query values.
+	Query url.Values
+	// Body is the request payload.
+	Body []byte
+	// Diversifier is the stub variant computed for the request.
+	Diversifier string
+	// Source says what answered the request.
+	Source CallSource
+	// Stub is the key of the stub that answered, if any.
+	Stub string
+	// Status is the response status, or 0 if the request failed without one.
+	Status int
+	// At is when the request was received.
+	At time.Time
+}
+
+// TestingT is the subset of testing.TB used by Journal assertions.
+type TestingT interface {
+	Helper()
+	Errorf(format string, args ...any)
+}
+
+// Journal records the calls served during playback so that tests can check
+// which endpoints were hit, how often and with which payloads. It is safe for
+// concurrent use.
+type Journal struct {
+	mu    sync.Mutex
+	calls []Call
+}
+
+// NewJournal returns an empty journal.
+func NewJournal() *Journal {
+	return &Journal{}
+}
+
+// Calls returns every recorded call, in the order the requests were received.
+func (j *Journal) Calls() []Call {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return slices.Clone(j.calls)
+}
+
+// CallsTo returns the recorded calls to the endpoint.
+func (j *Journal) CallsTo(endpointName string) []Call {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var calls []Call
+	for _, c := range j.calls {
+		if c.Endpoint == endpointName {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+// Reset forgets every recorded call.
+func (j *Journal) Reset() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.calls = nil
+}
+
+// AssertCalled reports a test error unless the endpoint was called exactly
+// times times.
+func (j *Journal) AssertCalled(t TestingT, endpointName string, times int) bool {
+	t.Helper()
+	if n := len(j.CallsTo(endpointName)); n != times {
+		t.Errorf("vcr: expected %s to be called %d times, got %d", endpointName, times, n)
+		return false
+	}
+	return true
+}
+
+// AssertNotCalled reports a test error if the endpoint was called.
+func (j *Journal) AssertNotCalled(t TestingT, endpointName string) bool {
+	t.Helper()
+	return j.AssertCalled(t, endpointName, 0)
+}
+
+func (j *Journal) record(c Call) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.calls = append(j.calls, c)
+}
+
+type callKey struct{}
+
+// callFromContext returns the call that JournalMiddleware is recording for the
+// request, if any.
+func callFromContext(ctx context.Context) *Call {
+	if ctx == nil {
+		return nil
+	}
+	c, _ := ctx.Value(callKey{}).(*Call)
+	return c
+}
+
+// MarkScenarioCall records that a scenario handler answers the request being
+// journaled in ctx. Generated playback handlers call it before dispatching to
+// a scenario handler.
+func MarkScenarioCall(ctx context.Context) {
+	if c := callFromContext(ctx); c != nil {
+		c.Source = CallScenario
+	}
+}
+
+// newCall describes a request to a matched endpoint.
+func newCall(req *http.Request, endpointName string, vars map[string]string, body []byte, div string) Call {
+	return Call{
+		Endpoint:    endpointName,
+		Method:      req.Method,
+		Path:        req.URL.Path,
+		Vars:        maps.Clone(vars),
+		Query:       req.URL.Query(),
+		Body:        body,
+		Diversifier: div,
+		At:          time.Now(),
+	}
+}
+
+// resolve records what answered the call unless a scenario handler did. It
+// does nothing on a nil call.
+func (c *Call) resolve(source CallSource, stub string) {
+	if c != nil && c.Source == "" {
+		c.Source = source
+		c.Stub = stub
+	}
+}
+
+// JournalMiddleware records every request to one of d's endpoints in
+// d.Journal once it has been answered, including requests answered by
+// scenario handlers. StubDoer does not journal requests that go through it
+// separately.
+func JournalMiddleware(d *StubDoer, next http.Handler) http.Handler {
+	if next == nil {
+		return http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if d == nil || d.Journal == nil || d.Store == nil || d.Matcher == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		endpointName, vars, ok := d.Matcher.Match(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, _ := ReadRequestBody(r)
+		div := RequestDiversifier(d.Store.CurrentPolicy(), endpointName, r.URL.Query(), vars, body, diversifierHeader(r))
+		call := newCall(r, endpointName, vars, body, div)
+		jw := &journalWriter{ResponseWriter: w}
+		next.ServeHTTP(jw, r.WithContext(context.WithValue(r.Context(), callKey{}, &call)))
+		call.Status = jw.status
+		d.Journal.record(call)
+	})
+}
+
+// journalWriter captures the response status.
+type journalWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *journalWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *journalWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *journalWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *journalWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+func (w *journalWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
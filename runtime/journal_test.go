@@ -0,0 +1,162 @@
+package runtime
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// recordingT captures assertion failures.
+type recordingT struct {
+	errors []string
+}
+
+func (t *recordingT) Helper() {}
+
+func (t *recordingT) Errorf(format string, args ...any) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func TestStubDoerJournalsCalls(t *testing.T) {
+	store, err := NewWithStorage(memoryStorageWithPolicy(t, `{"upstream":"https://example.com","endpoints":{"GetThing":{"variant":{"path":true,"query":false}}}}`))
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	body := []byte(`{"id":"123"}`)
+	endpoints := []Endpoint{{Name: "GetThing", Method: http.MethodGet, Pattern: "/things/{id}"}}
+	div := RequestDiversifier(store.Policy, "GetThing", nil, map[string]string{"id": "123"}, nil, nil)
+	if err := store.WriteStub("GetThing", RequestSpec{URL: "http://example.com/things/123"}, ResponseMeta{Status: 200, MimeType: "application/json", Size: len(body)}, body, div); err != nil {
+		t.Fatalf("write stub: %v", err)
+	}
+	d := NewStubDoer(store, endpoints)
+	d.Journal = NewJournal()
+
+	for _, id := range []string{"123", "456"} {
+		if _, err := d.Do(mustRequest(t, http.MethodGet, "http://example.com/things/"+id+"?page=2")); err != nil {
+			t.Fatalf("do: %v", err)
+		}
+	}
+	calls := d.Journal.CallsTo("GetThing")
+	if len(calls) != 2 {
+		t.Fatalf("unexpected calls: %+v", calls)
+	}
+	if c := calls[0]; c.Source != CallStub || c.Stub != stubKey("GetThing", div) || c.Vars["id"] != "123" || c.Query.Get("page") != "2" || c.Status != http.StatusOK {
+		t.Fatalf("unexpected stub call: %+v", c)
+	}
+	if c := calls[1]; c.Source != CallMiss || c.Stub != "" || c.Vars["id"] != "456" || c.Status != http.StatusNotImplemented {
+		t.Fatalf("unexpected miss: %+v", c)
+	}
+
+	rt := &recordingT{}
+	if !d.Journal.AssertCalled(rt, "GetThing", 2) || !d.Journal.AssertNotCalled(rt, "Other") || len(rt.errors) != 0 {
+		t.Fatalf("unexpected assertion failures: %q", rt.errors)
+	}
+	if d.Journal.AssertCalled(rt, "GetThing", 1) || len(rt.errors) != 1 || !strings.Contains(rt.errors[0], "called 1 times, got 2") {
+		t.Fatalf("expected an assertion failure, got %q", rt.errors)
+	}
+	d.Journal.Reset()
+	if len(d.Journal.Calls()) != 0 {
+		t.Fatalf("expected an empty journal after reset")
+	}
+}
+
+func TestJournalMiddlewareRecordsScenarioCalls(t *testing.T) {
+	store, err := NewWithStorage(memoryStorageWithPolicy(t, `{"upstream":"https://example.com","endpoints":{"CreateThing":{"variant":{"body":false}}}}`))
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	body := []byte(`{"ok":true}`)
+	if err := store.WriteStub("CreateThing", RequestSpec{Method: http.MethodPost, URL: "http://example.com/things"}, ResponseMeta{Status: 201, MimeType: "application/json", Size: len(body)}, body); err != nil {
+		t.Fatalf("write stub: %v", err)
+	}
+	d := NewStubDoer(store, []Endpoint{{Name: "CreateThing", Method: http.MethodPost, Pattern: "/things"}})
+	d.Journal = NewJournal()
+
+	scenario := false
+	srv := httptest.NewServer(JournalMiddleware(d, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if scenario {
+			MarkScenarioCall(r.Context())
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		req, _ := http.NewRequestWithContext(r.Context(), r.Method, "http://example.com"+r.URL.Path, r.Body)
+		resp, err := d.Do(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(resp.StatusCode)
+		_, _ = io.Copy(w, resp.Body)
+	})))
+	defer srv.Close()
+
+	post := func() {
+		resp, err := http.Post(srv.URL+"/things", "application/json", strings.NewReader(`{"name":"widget"}`))
+		if err != nil {
+			t.Fatalf("post: %v", err)
+		}
+		_ = resp.Body.Close()
+	}
+	post()
+	scenario = true
+	post()
+	if resp, err := http.Get(srv.URL + "/unknown"); err == nil {
+		_ = resp.Body.Close()
+	}
+
+	calls := d.Journal.Calls()
+	if len(calls) != 2 {
+		t.Fatalf("expected one entry per matched request, got %+v", calls)
+	}
+	if c := calls[0]; c.Source != CallStub || c.Status != http.StatusCreated || string(c.Body) != `{"name":"widget"}` {
+		t.Fatalf("unexpected stub call: %+v", c)
+	}
+	if c := calls[1]; c.Source != CallScenario || c.Status != http.StatusAccepted {
+		t.Fatalf("unexpected scenario call: %+v", c)
+	}
+}
+
+func TestJournalMiddlewareDiversifiesByIncomingHeaders(t *testing.T) {
+	store, err := NewWithStorage(memoryStorageWithPolicy(t, `{"upstream":"https://example.com","endpoints":{"GetThing":{"variant":{"headers":["X-Tenant"]}}}}`))
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	tenant := http.Header{"X-Tenant": {"acme"}}
+	div := RequestDiversifier(store.Policy, "GetThing", nil, nil, nil, tenant)
+	body := []byte(`{"id":"1"}`)
+	if err := store.WriteStub("GetThing", RequestSpec{Method: http.MethodGet, URL: "http://example.com/things/1", Headers: tenant}, ResponseMeta{Status: 200, MimeType: "application/json", Size: len(body)}, body, div); err != nil {
+		t.Fatalf("write stub: %v", err)
+	}
+	d := NewStubDoer(store, []Endpoint{{Name: "GetThing", Method: http.MethodGet, Pattern: "/things/{id}"}})
+	d.Journal = NewJournal()
+
+	journaled := JournalMiddleware(d, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, _ := http.NewRequestWithContext(r.Context(), r.Method, "http://example.com"+r.URL.Path, nil)
+		resp, err := d.Do(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(resp.StatusCode)
+	}))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		journaled.ServeHTTP(w, r.WithContext(WithIncomingHeader(r.Context(), tenant)))
+	}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/things/1")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	_ = resp.Body.Close()
+	calls := d.Journal.Calls()
+	if len(calls) != 1 {
+		t.Fatalf("expected one call, got %+v", calls)
+	}
+	if c := calls[0]; c.Diversifier != div || c.Stub != stubKey("GetThing", div) || c.Status != http.StatusOK {
+		t.Fatalf("expected the call to carry the served stub key, got %+v", c)
+	}
+}
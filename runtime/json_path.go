@@ -0,0 +1,163 @@
+package runtime
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// jsonPath is a parsed JSON path selector. Each segment is an object key
+// (string), an array index (int) or jsonPathWildcard.
+type jsonPath []any
+
+// jsonPathWildcard matches every element of an array or member of an object.
+type jsonPathWildcard struct{}
+
+// parseJSONPath parses the JSON path subset used in vcr.json: a leading "$"
+// followed by ".name", "[index]", ["name"], "[*]" or ".*" segments, e.g.
+// "$.filter.status", "$.items[0].id", "$['content-type']" or "$.users[*].email".
+func parseJSONPath(s string) (jsonPath, error) {
+	rest, ok := strings.CutPrefix(s, "$")
+	if !ok {
+		return nil, fmt.Errorf("json path %q must start with $", s)
+	}
+	var path jsonPath
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("json path %q: empty name", s)
+			}
+			if rest[:end] == "*" {
+				path = append(path, jsonPathWildcard{})
+			} else {
+				path = append(path, rest[:end])
+			}
+			rest = rest[end:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("json path %q: unterminated [", s)
+			}
+			inner := rest[1:end]
+			rest = rest[end+1:]
+			if inner == "*" {
+				path = append(path, jsonPathWildcard{})
+				continue
+			}
+			if len(inner) >= 2 && (inner[0] == '"' || inner[0] == '\'') && inner[len(inner)-1] == inner[0] {
+				path = append(path, inner[1:len(inner)-1])
+				continue
+			}
+			index, err := strconv.Atoi(inner)
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("json path %q: invalid index %q", s, inner)
+			}
+			path = append(path, index)
+		default:
+			return nil, fmt.Errorf("json path %q: unexpected %q", s, rest[0])
+		}
+	}
+	return path, nil
+}
+
+// lookup returns every value matched by the path in a decoded JSON document.
+func (p jsonPath) lookup(doc any) []any {
+	var out []any
+	p.walk(doc, func(v any) any {
+		out = append(out, v)
+		return v
+	})
+	return out
+}
+
+// walk calls fn for every value matched by the path and stores its result in
+// place of the value. It returns the number of matches. The document root is
+// visited but cannot be replaced.
+func (p jsonPath) walk(doc any, fn func(any) any) int {
+	if len(p) == 0 {
+		fn(doc)
+		return 1
+	}
+	seg, rest := p[0], p[1:]
+	visit := func(v any, set func(any)) int {
+		if len(rest) == 0 {
+			set(fn(v))
+			return 1
+		}
+		return rest.walk(v, fn)
+	}
+	n := 0
+	switch seg := seg.(type) {
+	case string:
+		if obj, ok := doc.(map[string]any); ok {
+			if v, ok := obj[seg]; ok {
+				n += visit(v, func(nv any) { obj[seg] = nv })
+			}
+		}
+	case int:
+		if arr, ok := doc.([]any); ok && seg < len(arr) {
+			n += visit(arr[seg], func(nv any) { arr[seg] = nv })
+		}
+	case jsonPathWildcard:
+		switch doc := doc.(type) {
+		case map[string]any:
+			for key, v := range doc {
+				n += visit(v, func(nv any) { doc[key] = nv })
+			}
+		case []any:
+			for i, v := range doc {
+				n += visit(v, func(nv any) { doc[i] = nv })
+			}
+		}
+	}
+	return n
+}
+
+// bodyValues returns the values selected by paths from a JSON payload, keyed by
+// the path without its leading "$.". Wildcards may select several values.
+// Paths that select nothing are omitted, as are all paths if the payload is not
+// JSON. Strings are used verbatim; other values are canonical JSON.
+func bodyValues(body []byte, paths []string) url.Values {
+	values := url.Values{}
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 {
+		return values
+	}
+	decoder := json.NewDecoder(bytes.NewReader(trimmed))
+	decoder.UseNumber()
+	var doc any
+	if err := decoder.Decode(&doc); err != nil || decoder.More() {
+		return values
+	}
+	for _, raw := range paths {
+		path, err := parseJSONPath(raw)
+		if err != nil {
+			continue
+		}
+		key := strings.TrimPrefix(strings.TrimPrefix(raw, "$"), ".")
+		for _, v := range path.lookup(doc) {
+			switch v := v.(type) {
+			case string:
+				values.Add(key, v)
+			case json.Number:
+				values.Add(key, v.String())
+			default:
+				canonical, err := json.Marshal(v)
+				if err != nil {
+					continue
+				}
+				values.Add(key, string(canonical))
+			}
+		}
+	}
+	return values
+}
@@ -0,0 +1,40 @@
+package runtime
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseJSONPath(t *testing.T) {
+	path, err := parseJSONPath(`$.items[1]['content-type'].id`)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if want := (jsonPath{"items", 1, "content-type", "id"}); !reflect.DeepEqual(path, want) {
+		t.Fatalf("unexpected path: %#v", path)
+	}
+	for _, bad := range []string{"items", "$..a", "$[x]", "$[0", "$a"} {
+		if _, err := parseJSONPath(bad); err == nil {
+			t.Fatalf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestBodyValues(t *testing.T) {
+	body := []byte(`{"filter":{"status":"open","tags":["b","a"]},"page":2,"draft":false,"owner":null}`)
+	got := bodyValues(body, []string{"$.filter.status", "$.filter.tags", "$.page", "$.draft", "$.owner", "$.missing"})
+	want := url.Values{
+		"filter.status": {"open"},
+		"filter.tags":   {`["b","a"]`},
+		"page":          {"2"},
+		"draft":         {"false"},
+		"owner":         {"null"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected values: %v", got)
+	}
+	if got := bodyValues([]byte("not json"), []string{"$.page"}); len(got) != 0 {
+		t.Fatalf("expected no values for non-JSON payloads, got %v", got)
+	}
+}
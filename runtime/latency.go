@@ -0,0 +1,113 @@
+package runtime
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"time"
+)
+
+// Latency is a simulated delay for responses served from stubs. In vcr.json
+// and on the command line it is written "250ms" (fixed), "100ms-400ms"
+// (uniformly random within the range), "recorded" (the HAR timings recorded
+// with the response) or "none".
+type Latency struct {
+	// Min is the shortest delay.
+	Min time.Duration
+	// Max is the longest delay. If not greater than Min, the delay is Min.
+	Max time.Duration
+	// Recorded uses the timings recorded with each response instead.
+	Recorded bool
+}
+
+// ParseLatency parses a latency as used in vcr.json.
+func ParseLatency(s string) (Latency, error) {
+	switch s = strings.TrimSpace(s); s {
+	case "none":
+		return Latency{}, nil
+	case "recorded":
+		return Latency{Recorded: true}, nil
+	}
+	lo, hi, isRange := strings.Cut(s, "-")
+	minDelay, err := time.ParseDuration(strings.TrimSpace(lo))
+	if err != nil || minDelay < 0 {
+		return Latency{}, fmt.Errorf("invalid latency %q (want e.g. 250ms, 100ms-400ms, recorded or none)", s)
+	}
+	if !isRange {
+		return Latency{Min: minDelay, Max: minDelay}, nil
+	}
+	maxDelay, err := time.ParseDuration(strings.TrimSpace(hi))
+	if err != nil || maxDelay < minDelay {
+		return Latency{}, fmt.Errorf("invalid latency %q (want e.g. 250ms, 100ms-400ms, recorded or none)", s)
+	}
+	return Latency{Min: minDelay, Max: maxDelay}, nil
+}
+
+func (l Latency) String() string {
+	switch {
+	case l.Recorded:
+		return "recorded"
+	case l.Min == 0 && l.Max <= 0:
+		return "none"
+	case l.Max <= l.Min:
+		return l.Min.String()
+	}
+	return l.Min.String() + "-" + l.Max.String()
+}
+
+func (l Latency) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.String())
+}
+
+func (l *Latency) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("latency: %w", err)
+	}
+	parsed, err := ParseLatency(s)
+	if err != nil {
+		return err
+	}
+	*l = parsed
+	return nil
+}
+
+// Delay returns the delay for a response recorded with timings.
+func (l Latency) Delay(timings Timings) time.Duration {
+	if l.Recorded {
+		return timings.Total()
+	}
+	if l.Max <= l.Min {
+		return l.Min
+	}
+	return l.Min + rand.N(l.Max-l.Min+1)
+}
+
+// ResponseLatency returns endpoints[name].latency, then latency, then no
+// latency.
+func (p Policy) ResponseLatency(endpointName string) Latency {
+	if ep, ok := p.Endpoints[endpointName]; ok && ep.Latency != nil {
+		return *ep.Latency
+	}
+	if p.Latency != nil {
+		return *p.Latency
+	}
+	return Latency{}
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,97 @@
+package runtime
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseLatency(t *testing.T) {
+	cases := map[string]Latency{
+		"250ms":       {Min: 250 * time.Millisecond, Max: 250 * time.Millisecond},
+		"100ms-400ms": {Min: 100 * time.Millisecond, Max: 400 * time.Millisecond},
+		"1s - 2s":     {Min: time.Second, Max: 2 * time.Second},
+		"recorded":    {Recorded: true},
+		"none":        {},
+	}
+	for in, want := range cases {
+		got, err := ParseLatency(in)
+		if err != nil || got != want {
+			t.Fatalf("ParseLatency(%q) = %+v, %v; want %+v", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "fast", "-1s", "2s-1s", "1s-"} {
+		if _, err := ParseLatency(in); err == nil {
+			t.Fatalf("ParseLatency(%q): expected error", in)
+		}
+	}
+
+	var p Policy
+	if err := json.Unmarshal([]byte(`{"latency":"100ms-400ms","endpoints":{"Slow":{"latency":"recorded"}}}`), &p); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if got := p.ResponseLatency("Other"); got != (Latency{Min: 100 * time.Millisecond, Max: 400 * time.Millisecond}) {
+		t.Fatalf("unexpected global latency: %+v", got)
+	}
+	if got := p.ResponseLatency("Slow"); !got.Recorded {
+		t.Fatalf("unexpected endpoint latency: %+v", got)
+	}
+	out, _ := json.Marshal(p.Latency)
+	if string(out) != `"100ms-400ms"` {
+		t.Fatalf("unexpected encoding: %s", out)
+	}
+	if err := json.Unmarshal([]byte(`{"latency":"soon"}`), &p); err == nil {
+		t.Fatalf("expected invalid latency to be rejected")
+	}
+}
+
+func TestLatencyDelay(t *testing.T) {
+	timings := Timings{Wait: 30 * time.Millisecond, Receive: 5 * time.Millisecond}
+	if got := (Latency{Recorded: true}).Delay(timings); got != 35*time.Millisecond {
+		t.Fatalf("unexpected recorded delay: %v", got)
+	}
+	l := Latency{Min: 10 * time.Millisecond, Max: 20 * time.Millisecond}
+	for i := 0; i < 100; i++ {
+		if got := l.Delay(timings); got < l.Min || got > l.Max {
+			t.Fatalf("delay %v outside %v", got, l)
+		}
+	}
+}
+
+func TestStubDoerAppliesLatency(t *testing.T) {
+	store, err := NewWithStorage(memoryStorageWithPolicy(t, `{"upstream":"https://example.com","latency":"50ms"}`))
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	body := []byte(`{"ok":true}`)
+	if err := store.WriteStub("Known", RequestSpec{URL: "http://example.com/known"}, ResponseMeta{Status: 200, MimeType: "application/json", Size: len(body)}, body); err != nil {
+		t.Fatalf("write stub: %v", err)
+	}
+	d := NewStubDoer(store, []Endpoint{{Name: "Known", Method: http.MethodGet, Pattern: "/known"}})
+
+	start := time.Now()
+	if _, err := d.Do(mustRequest(t, http.MethodGet, "http://example.com/known")); err != nil {
+		t.Fatalf("do: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("expected policy latency, took %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := mustRequest(t, http.MethodGet, "http://example.com/known").WithContext(ctx)
+	if _, err := d.Do(req); err == nil {
+		t.Fatalf("expected a canceled request to fail while delayed")
+	}
+
+	d.Latency = &Latency{}
+	start = time.Now()
+	if _, err := d.Do(mustRequest(t, http.MethodGet, "http://example.com/known")); err != nil {
+		t.Fatalf("do: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= 50*time.Millisecond {
+		t.Fatalf("expected the override to disable latency, took %v", elapsed)
+	}
+}
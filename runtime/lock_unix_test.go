@@ -0,0 +1,41 @@
+//go:build unix
+
+package runtime
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDirStorageLockExcludesOtherHolders(t *testing.T) {
+	dir := t.TempDir()
+	unlock, err := NewDirStorage(dir).Lock()
+	if err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+	locked := make(chan func())
+	go func() {
+		// A second DirStorage opens the lock file anew, like another process.
+		unlock, err := NewDirStorage(dir).Lock()
+		if err != nil {
+			t.Errorf("lock: %v", err)
+			close(locked)
+			return
+		}
+		locked <- unlock
+	}()
+	select {
+	case <-locked:
+		t.Fatalf("expected the second lock to wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case unlock2, ok := <-locked:
+		if ok {
+			unlock2()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the second lock once the first was released")
+	}
+}
@@ -1,22 +1,36 @@
 package runtime
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
+	"io/fs"
+	"net/url"
 	"reflect"
+	"slices"
 )
 
+// ErrPolicyConflict is returned by WritePolicy when vcr.json was changed by
+// someone else since the store read it.
+var ErrPolicyConflict = errors.New("vcr: policy changed in storage")
+
 // QueryVariantEnabled returns (enabled, explicit) for endpoints[name].variant.query.
 // If explicit is false, enabled defaults to true.
 func (p Policy) QueryVariantEnabled(endpointName string) (bool, bool) {
+	qv, explicit := p.QueryVariant(endpointName)
+	return qv.Enabled, explicit
+}
+
+// QueryVariant returns (variant, explicit) for endpoints[name].variant.query.
+// If explicit is false, the variant is enabled for every parameter.
+func (p Policy) QueryVariant(endpointName string) (QueryVariant, bool) {
 	if p.Endpoints == nil {
-		return true, false
+		return QueryVariant{Enabled: true}, false
 	}
 	ep, ok := p.Endpoints[endpointName]
 	if !ok || ep.Variant == nil || ep.Variant.Query == nil {
-		return true, false
+		return QueryVariant{Enabled: true}, false
 	}
 	return *ep.Variant.Query, true
 }
@@ -34,15 +48,84 @@ func (p Policy) PathVariantEnabled(endpointName string) (bool, bool) {
 	return *ep.Variant.Path, true
 }
 
+// BodyVariantEnabled returns (enabled, explicit) for endpoints[name].variant.body.
+// If explicit is false, enabled defaults to true.
+func (p Policy) BodyVariantEnabled(endpointName string) (bool, bool) {
+	bv, explicit := p.BodyVariant(endpointName)
+	return bv.Enabled, explicit
+}
+
+// BodyVariant returns (variant, explicit) for endpoints[name].variant.body.
+// If explicit is false, the variant is enabled for the whole payload.
+func (p Policy) BodyVariant(endpointName string) (BodyVariant, bool) {
+	if p.Endpoints == nil {
+		return BodyVariant{Enabled: true}, false
+	}
+	ep, ok := p.Endpoints[endpointName]
+	if !ok || ep.Variant == nil || ep.Variant.Body == nil {
+		return BodyVariant{Enabled: true}, false
+	}
+	return *ep.Variant.Body, true
+}
+
+// HeaderVariants returns endpoints[name].variant.headers.
+func (p Policy) HeaderVariants(endpointName string) []string {
+	if p.Endpoints == nil {
+		return nil
+	}
+	ep, ok := p.Endpoints[endpointName]
+	if !ok || ep.Variant == nil {
+		return nil
+	}
+	return ep.Variant.Headers
+}
+
+// CookieVariants returns endpoints[name].variant.cookies.
+func (p Policy) CookieVariants(endpointName string) []string {
+	if p.Endpoints == nil {
+		return nil
+	}
+	ep, ok := p.Endpoints[endpointName]
+	if !ok || ep.Variant == nil {
+		return nil
+	}
+	return ep.Variant.Cookies
+}
+
+// RecordStatus reports whether a response with the given status should be
+// recorded for endpoints[name]. Informational (1xx) responses are never recorded.
+func (p Policy) RecordStatus(endpointName string, status int) bool {
+	if status < 200 {
+		return false
+	}
+	ep, ok := p.Endpoints[endpointName]
+	if !ok || ep.Record == nil || len(ep.Record.Status) == 0 {
+		return true
+	}
+	return slices.Contains(ep.Record.Status, status)
+}
+
+// clone returns a copy of vp, or an empty policy if vp is nil, so that setters
+// do not modify a VariantPolicy shared with earlier copies of the Policy.
+func (vp *VariantPolicy) clone() *VariantPolicy {
+	if vp == nil {
+		return &VariantPolicy{}
+	}
+	c := *vp
+	return &c
+}
+
 func (p *Policy) SetVariantQuery(endpointName string, enabled bool) {
+	p.SetQueryVariant(endpointName, QueryVariant{Enabled: enabled})
+}
+
+func (p *Policy) SetQueryVariant(endpointName string, qv QueryVariant) {
 	if p.Endpoints == nil {
 		p.Endpoints = map[string]EndpointPolicy{}
 	}
 	ep := p.Endpoints[endpointName]
-	if ep.Variant == nil {
-		ep.Variant = &VariantPolicy{}
-	}
-	ep.Variant.Query = &enabled
+	ep.Variant = ep.Variant.clone()
+	ep.Variant.Query = &qv
 	p.Endpoints[endpointName] = ep
 }
 
@@ -51,9 +134,7 @@ func (p *Policy) SetVariantPath(endpointName string, enabled bool) {
 		p.Endpoints = map[string]EndpointPolicy{}
 	}
 	ep := p.Endpoints[endpointName]
-	if ep.Variant == nil {
-		ep.Variant = &VariantPolicy{}
-	}
+	ep.Variant = ep.Variant.clone()
 	ep.Variant.Path = &enabled
 	p.Endpoints[endpointName] = ep
 }
@@ -67,10 +148,14 @@ func (p *Policy) ClearVariantQuery(endpointName string) {
 		return
 	}
 	if ep.Variant != nil {
+		ep.Variant = ep.Variant.clone()
 		ep.Variant.Query = nil
+		if ep.Variant.Path == nil && ep.Variant.Body == nil && len(ep.Variant.Headers) == 0 && len(ep.Variant.Cookies) == 0 && ep.Variant.Names == "" {
+			ep.Variant = nil
+		}
 	}
 	// If nothing remains in the policy for this endpoint, remove it.
-	if ep.Variant == nil || (ep.Variant.Query == nil && ep.Variant.Path == nil) {
+	if ep.Variant == nil && ep.Record == nil && ep.Fallback == nil && ep.Sequence == nil && ep.WebSocket == nil && ep.Latency == nil && ep.Faults == nil {
 		delete(p.Endpoints, endpointName)
 		if len(p.Endpoints) == 0 {
 			p.Endpoints = nil
@@ -80,9 +165,127 @@ func (p *Policy) ClearVariantQuery(endpointName string) {
 	p.Endpoints[endpointName] = ep
 }
 
+// RecordMode returns the record mode for the endpoint: endpoints[name].record.mode,
+// then mode, then RecordModeAll.
+func (p Policy) RecordMode(endpointName string) RecordMode {
+	if p.Endpoints != nil {
+		if ep, ok := p.Endpoints[endpointName]; ok && ep.Record != nil && ep.Record.Mode != "" {
+			return ep.Record.Mode
+		}
+	}
+	if p.Mode != "" {
+		return p.Mode
+	}
+	return RecordModeAll
+}
+
+// ParseRecordMode parses a record mode name as used in vcr.json and on the
+// command line.
+func ParseRecordMode(s string) (RecordMode, error) {
+	mode := RecordMode(s)
+	switch mode {
+	case RecordModeAll, RecordModeOnce, RecordModeNewEpisodes, RecordModeNone, RecordModeFallthrough:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown record mode %q (want all, once, new_episodes, none or fallthrough)", s)
+}
+
+// NameStyle returns the stub naming style for the endpoint: endpoints[name].variant.names,
+// then names, then NameStyleHash.
+func (p Policy) NameStyle(endpointName string) NameStyle {
+	if p.Endpoints != nil {
+		if ep, ok := p.Endpoints[endpointName]; ok && ep.Variant != nil && ep.Variant.Names != "" {
+			return ep.Variant.Names
+		}
+	}
+	if p.Names != "" {
+		return p.Names
+	}
+	return NameStyleHash
+}
+
+// SequenceEnd returns endpoints[name].sequence.end, defaulting to SequenceEndLast.
+func (p Policy) SequenceEnd(endpointName string) SequenceEnd {
+	if ep, ok := p.Endpoints[endpointName]; ok && ep.Sequence != nil && ep.Sequence.End != "" {
+		return ep.Sequence.End
+	}
+	return SequenceEndLast
+}
+
+// RecordSequence reports whether successive responses for the endpoint are
+// recorded as a sequence.
+func (p Policy) RecordSequence(endpointName string) bool {
+	ep, ok := p.Endpoints[endpointName]
+	return ok && ep.Sequence != nil
+}
+
+// WebSocketMatch reports whether WebSocket playback for the endpoint matches
+// client messages against the recording.
+func (p Policy) WebSocketMatch(endpointName string) bool {
+	ep, ok := p.Endpoints[endpointName]
+	return ok && ep.WebSocket != nil && ep.WebSocket.Match
+}
+
+// ParseNameStyle parses a stub naming style as used in vcr.json.
+func ParseNameStyle(s string) (NameStyle, error) {
+	style := NameStyle(s)
+	switch style {
+	case NameStyleHash, NameStyleReadable:
+		return style, nil
+	}
+	return "", fmt.Errorf("unknown names style %q (want hash or readable)", s)
+}
+
 // Validate checks that the policy is valid.
-// It ensures that authorization.claims values are JSON scalars only.
+// It ensures that record modes, naming styles and sequence ends are known,
+// that body selectors and redact rules parse, that fault profiles are sound,
+// and that authorization.claims values are JSON scalars only.
 func (p Policy) Validate() error {
+	if p.Mode != "" {
+		if _, err := ParseRecordMode(string(p.Mode)); err != nil {
+			return fmt.Errorf("mode: %w", err)
+		}
+	}
+	if p.Names != "" {
+		if _, err := ParseNameStyle(string(p.Names)); err != nil {
+			return fmt.Errorf("names: %w", err)
+		}
+	}
+	if err := p.Redact.Validate(); err != nil {
+		return fmt.Errorf("redact.%w", err)
+	}
+	if err := p.Faults.Validate(); err != nil {
+		return fmt.Errorf("faults: %w", err)
+	}
+	for name, ep := range p.Endpoints {
+		if ep.Record != nil && ep.Record.Mode != "" {
+			if _, err := ParseRecordMode(string(ep.Record.Mode)); err != nil {
+				return fmt.Errorf("endpoints.%s.record.mode: %w", name, err)
+			}
+		}
+		if ep.Variant != nil && ep.Variant.Body != nil {
+			for _, path := range ep.Variant.Body.Paths {
+				if _, err := parseJSONPath(path); err != nil {
+					return fmt.Errorf("endpoints.%s.variant.body: %w", name, err)
+				}
+			}
+		}
+		if ep.Sequence != nil {
+			switch ep.Sequence.End {
+			case "", SequenceEndLast, SequenceEndCycle, SequenceEndError:
+			default:
+				return fmt.Errorf("endpoints.%s.sequence.end: unknown value %q (want last, cycle or error)", name, ep.Sequence.End)
+			}
+		}
+		if err := ep.Faults.Validate(); err != nil {
+			return fmt.Errorf("endpoints.%s.faults: %w", name, err)
+		}
+		if ep.Variant != nil && ep.Variant.Names != "" {
+			if _, err := ParseNameStyle(string(ep.Variant.Names)); err != nil {
+				return fmt.Errorf("endpoints.%s.variant.names: %w", name, err)
+			}
+		}
+	}
 	if p.Authorization == nil || len(p.Authorization.Claims) == 0 {
 		return nil
 	}
@@ -107,20 +310,144 @@ func isJSONScalar(v any) bool {
 		kind == reflect.Float32 || kind == reflect.Float64
 }
 
-// WritePolicy persists the current policy to Root/vcr.json.
+// WritePolicy persists the current policy to vcr.json in storage. It returns
+// ErrPolicyConflict, leaving the file alone, if vcr.json changed since the
+// store last read or wrote it; use UpdatePolicyFile to merge a change instead.
 func (v *VCR) WritePolicy() error {
-	if v.Root == "" {
-		return fmt.Errorf("empty root")
+	storage := v.storage()
+	if storage == nil {
+		return fmt.Errorf("no storage configured")
+	}
+	unlock, err := v.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	data, err := v.backend().ReadFile(PolicyFileName)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("read %s: %w", PolicyFileName, err)
+	}
+	v.mu.RLock()
+	sum := v.policySum
+	v.mu.RUnlock()
+	if err == nil && checksum(data) != sum {
+		return fmt.Errorf("write %s: %w", PolicyFileName, ErrPolicyConflict)
+	}
+	return v.writePolicy(storage, v.CurrentPolicy())
+}
+
+// UpdatePolicyFile applies update to vcr.json in storage as it is now, so
+// that edits made by other processes are kept, and then to the current
+// policy like UpdatePolicy.
+func (v *VCR) UpdatePolicyFile(update func(*Policy)) error {
+	storage := v.storage()
+	if storage == nil {
+		return fmt.Errorf("no storage configured")
+	}
+	unlock, err := v.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	policy, _, err := readPolicy(v.backend())
+	if err != nil {
+		return err
+	}
+	update(&policy)
+	if err := v.writePolicy(storage, policy); err != nil {
+		return err
 	}
-	path := filepath.Join(v.Root, PolicyFileName)
-	data, err := json.MarshalIndent(v.Policy, "", "  ")
+	v.UpdatePolicy(update)
+	return nil
+}
+
+// writePolicy writes policy to vcr.json and records its checksum. The caller
+// holds the write lock.
+func (v *VCR) writePolicy(storage Storage, policy Policy) error {
+	data, err := json.MarshalIndent(policy, "", "  ")
 	if err != nil {
 		return fmt.Errorf("marshal policy: %w", err)
 	}
 	data = append(data, '\n')
-	if err := os.WriteFile(path, data, 0600); err != nil {
-		return fmt.Errorf("write %s: %w", path, err)
+	if err := storage.WriteFile(PolicyFileName, data); err != nil {
+		return fmt.Errorf("write %s: %w", PolicyFileName, err)
+	}
+	v.mu.Lock()
+	v.policySum = checksum(data)
+	v.mu.Unlock()
+	return nil
+}
+
+// Filter returns the query parameters that participate in the variant.
+func (q QueryVariant) Filter(values url.Values) url.Values {
+	if len(q.Include) == 0 && len(q.Exclude) == 0 {
+		return values
+	}
+	out := url.Values{}
+	for key, vals := range values {
+		if len(q.Include) > 0 && !slices.Contains(q.Include, key) {
+			continue
+		}
+		if slices.Contains(q.Exclude, key) {
+			continue
+		}
+		out[key] = vals
+	}
+	return out
+}
+
+func (q QueryVariant) MarshalJSON() ([]byte, error) {
+	if len(q.Include) == 0 && len(q.Exclude) == 0 {
+		return json.Marshal(q.Enabled)
+	}
+	return json.Marshal(queryVariantObject{Include: q.Include, Exclude: q.Exclude})
+}
+
+func (q *QueryVariant) UnmarshalJSON(data []byte) error {
+	var enabled bool
+	if err := json.Unmarshal(data, &enabled); err == nil {
+		*q = QueryVariant{Enabled: enabled}
+		return nil
+	}
+	var obj queryVariantObject
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&obj); err != nil {
+		return fmt.Errorf("variant.query must be a bool or an object with include/exclude: %w", err)
+	}
+	switch {
+	case obj.Include != nil && obj.Exclude != nil:
+		return fmt.Errorf("variant.query: include and exclude cannot be combined")
+	case len(obj.Include) == 0 && len(obj.Exclude) == 0:
+		return fmt.Errorf("variant.query: include or exclude must list at least one parameter")
+	}
+	*q = QueryVariant{Enabled: true, Include: obj.Include, Exclude: obj.Exclude}
+	return nil
+}
+
+type queryVariantObject struct {
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+func (b BodyVariant) MarshalJSON() ([]byte, error) {
+	if len(b.Paths) == 0 {
+		return json.Marshal(b.Enabled)
+	}
+	return json.Marshal(b.Paths)
+}
+
+func (b *BodyVariant) UnmarshalJSON(data []byte) error {
+	var enabled bool
+	if err := json.Unmarshal(data, &enabled); err == nil {
+		*b = BodyVariant{Enabled: enabled}
+		return nil
+	}
+	var paths []string
+	if err := json.Unmarshal(data, &paths); err != nil {
+		return fmt.Errorf("variant.body must be a bool or a list of JSON paths: %w", err)
 	}
+	*b = BodyVariant{Enabled: true, Paths: paths}
 	return nil
 }
 
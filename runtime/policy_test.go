@@ -1,6 +1,10 @@
 package runtime
 
-import "testing"
+import (
+	"encoding/json"
+	"net/url"
+	"testing"
+)
 
 func TestPolicyQueryVariantDefaultEnabled(t *testing.T) {
 	enabled, explicit := (Policy{}).QueryVariantEnabled("X")
@@ -32,3 +36,141 @@ func TestPolicySetAndClearVariantQuery(t *testing.T) {
 	}
 }
 
+func TestPolicyRecordStatus(t *testing.T) {
+	var p Policy
+	if !p.RecordStatus("E", 404) || !p.RecordStatus("E", 500) {
+		t.Fatalf("expected every final status to be recorded by default")
+	}
+	if p.RecordStatus("E", 101) {
+		t.Fatalf("expected informational status to be skipped")
+	}
+
+	p.Endpoints = map[string]EndpointPolicy{"E": {Record: &RecordPolicy{Status: []int{200, 404}}}}
+	if !p.RecordStatus("E", 404) || p.RecordStatus("E", 500) {
+		t.Fatalf("expected record.status allowlist to apply")
+	}
+	if !p.RecordStatus("Other", 500) {
+		t.Fatalf("expected allowlist to be per endpoint")
+	}
+}
+
+func TestPolicyRecordMode(t *testing.T) {
+	var p Policy
+	if got := p.RecordMode("E"); got != RecordModeAll {
+		t.Fatalf("expected default mode all, got %q", got)
+	}
+
+	p.Mode = RecordModeOnce
+	p.Endpoints = map[string]EndpointPolicy{"E": {Record: &RecordPolicy{Mode: RecordModeNone}}}
+	if got := p.RecordMode("E"); got != RecordModeNone {
+		t.Fatalf("expected endpoint mode to win, got %q", got)
+	}
+	if got := p.RecordMode("Other"); got != RecordModeOnce {
+		t.Fatalf("expected global mode, got %q", got)
+	}
+	if err := p.Validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+
+	p.Endpoints["E"] = EndpointPolicy{Record: &RecordPolicy{Mode: "sometimes"}}
+	if err := p.Validate(); err == nil {
+		t.Fatalf("expected unknown mode to be rejected")
+	}
+}
+
+func TestPolicyNameStyle(t *testing.T) {
+	var p Policy
+	if got := p.NameStyle("E"); got != NameStyleHash {
+		t.Fatalf("expected default style hash, got %q", got)
+	}
+
+	p.Names = NameStyleReadable
+	p.Endpoints = map[string]EndpointPolicy{"E": {Variant: &VariantPolicy{Names: NameStyleHash}}}
+	if got := p.NameStyle("E"); got != NameStyleHash {
+		t.Fatalf("expected endpoint style to win, got %q", got)
+	}
+	if got := p.NameStyle("Other"); got != NameStyleReadable {
+		t.Fatalf("expected global style, got %q", got)
+	}
+	if err := p.Validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+
+	p.Names = "pretty"
+	if err := p.Validate(); err == nil {
+		t.Fatalf("expected unknown style to be rejected")
+	}
+}
+
+func TestQueryVariantJSON(t *testing.T) {
+	var p Policy
+	data := `{"upstream":"","endpoints":{"A":{"variant":{"query":false}},"B":{"variant":{"query":{"include":["status"]}}},"C":{"variant":{"query":{"exclude":["_ts"]}}}}}`
+	if err := json.Unmarshal([]byte(data), &p); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if enabled, explicit := p.QueryVariantEnabled("A"); enabled || !explicit {
+		t.Fatalf("unexpected A: enabled=%v explicit=%v", enabled, explicit)
+	}
+	b, _ := p.QueryVariant("B")
+	if !b.Enabled || len(b.Include) != 1 || b.Include[0] != "status" {
+		t.Fatalf("unexpected B: %+v", b)
+	}
+	c, _ := p.QueryVariant("C")
+	if !c.Enabled || len(c.Exclude) != 1 || c.Exclude[0] != "_ts" {
+		t.Fatalf("unexpected C: %+v", c)
+	}
+
+	out, err := json.Marshal(p)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if string(out) != data {
+		t.Fatalf("unexpected round trip:\n got %s\nwant %s", out, data)
+	}
+
+	if err := json.Unmarshal([]byte(`{"endpoints":{"A":{"variant":{"query":{"only":["x"]}}}}}`), &p); err == nil {
+		t.Fatalf("expected unknown variant.query field to be rejected")
+	}
+	for _, query := range []string{`{}`, `{"include":[]}`, `{"exclude":[]}`, `{"include":[],"exclude":[]}`, `{"include":["a"],"exclude":["b"]}`} {
+		if err := json.Unmarshal([]byte(`{"endpoints":{"A":{"variant":{"query":`+query+`}}}}`), &p); err == nil {
+			t.Fatalf("expected variant.query %s to be rejected", query)
+		}
+	}
+}
+
+func TestBodyVariantJSON(t *testing.T) {
+	var vp VariantPolicy
+	if err := json.Unmarshal([]byte(`{"body":["$.filter.status","$.page"]}`), &vp); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if vp.Body == nil || !vp.Body.Enabled || len(vp.Body.Paths) != 2 {
+		t.Fatalf("unexpected body variant: %+v", vp.Body)
+	}
+	data, err := json.Marshal(vp)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if string(data) != `{"body":["$.filter.status","$.page"]}` {
+		t.Fatalf("unexpected JSON: %s", data)
+	}
+	if err := json.Unmarshal([]byte(`{"body":false}`), &vp); err != nil || vp.Body.Enabled {
+		t.Fatalf("expected bool form, got %+v, %v", vp.Body, err)
+	}
+
+	p := Policy{Endpoints: map[string]EndpointPolicy{"E": {Variant: &VariantPolicy{Body: &BodyVariant{Enabled: true, Paths: []string{"filter"}}}}}}
+	if err := p.Validate(); err == nil {
+		t.Fatalf("expected invalid selector to be rejected")
+	}
+}
+
+func TestQueryVariantFilter(t *testing.T) {
+	q := url.Values{"status": {"open"}, "page": {"2"}, "_ts": {"123"}}
+
+	if got := (QueryVariant{Enabled: true, Include: []string{"status"}}).Filter(q); len(got) != 1 || got.Get("status") != "open" {
+		t.Fatalf("unexpected include filter: %v", got)
+	}
+	if got := (QueryVariant{Enabled: true, Exclude: []string{"_ts"}}).Filter(q); len(got) != 2 || got.Has("_ts") {
+		t.Fatalf("unexpected exclude filter: %v", got)
+	}
+}
+
@@ -5,20 +5,37 @@ import (
 	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"io"
+	"io/fs"
 	"net/http"
-	"os"
-	"path/filepath"
+	"net/url"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/gorilla/websocket"
 	"goa.design/clue/log"
 )
 
 // RecordingTransport is an http.RoundTripper that proxies to an upstream
-// RoundTripper and records JSON 200 OK GET responses into the VCR store, using
-// Goa mount points to identify endpoint names.
+// RoundTripper and records JSON responses into the VCR store, using Goa mount
+// points to identify endpoint names. Server-sent event (text/event-stream)
+// responses are streamed through and recorded event by event, with the time
+// each event arrived, once the stream ends. WebSocket upgrades are recorded as
+// the conversation of messages in both directions, once the connection
+// closes. Request payloads are persisted alongside the response and
+// participate in the stub diversifier. Error responses are recorded like any
+// other; endpoints[name].record.status narrows the set.
+//
+// The record mode (see RecordMode) decides whether existing stubs are replayed
+// instead of reaching the upstream, and whether misses are recorded.
 type RecordingTransport struct {
+	// Mode overrides the record mode configured in the policy when set.
+	Mode RecordMode
+
 	ctx     context.Context
 	store   *VCR
 	matcher *RouteMatcher
@@ -26,7 +43,10 @@ type RecordingTransport struct {
 
 	mu           sync.Mutex
 	maxVariants  int
-	variantsSeen map[string]map[string]struct{}
+	variantsSeen map[string]map[string]url.Values
+	// sequenced holds the stub keys recorded as sequences by this transport.
+	// The first response for a key starts a new sequence; later ones append.
+	sequenced map[string]bool
 }
 
 func NewRecordingTransport(ctx context.Context, store *VCR, endpoints []Endpoint, base http.RoundTripper, maxVariants int) *RecordingTransport {
@@ -42,7 +62,8 @@ func NewRecordingTransport(ctx context.Context, store *VCR, endpoints []Endpoint
 		matcher:      NewRouteMatcher(endpoints),
 		base:         base,
 		maxVariants:  maxVariants,
-		variantsSeen: map[string]map[string]struct{}{},
+		variantsSeen: map[string]map[string]url.Values{},
+		sequenced:    map[string]bool{},
 	}
 }
 
@@ -52,72 +73,188 @@ func (t *RecordingTransport) RoundTrip(req *http.Request) (*http.Response, error
 	}
 
 	endpointName, vars, ok := t.matcher.Match(req)
+	var reqBody []byte
 	div := ""
 	if ok {
-		div = RequestDiversifier(t.store.Policy, endpointName, req.URL.Query(), vars)
+		var bodyErr error
+		reqBody, bodyErr = ReadRequestBody(req)
+		if bodyErr != nil {
+			return nil, bodyErr
+		}
+		div = RequestDiversifier(t.store.CurrentPolicy(), endpointName, req.URL.Query(), vars, reqBody, diversifierHeader(req))
+	}
+
+	mode := RecordModeAll
+	if ok {
+		mode = t.recordMode(endpointName)
+	}
+	if mode != RecordModeAll {
+		ctx := log.With(t.ctx, log.KV{K: "vcr.endpoint.name", V: endpointName}, log.KV{K: "vcr.mode", V: string(mode)})
+		if div != "" {
+			ctx = log.With(ctx, log.KV{K: "vcr.variant", V: div})
+		}
+		if resp, handled := t.replay(ctx, req, mode, endpointName, vars, reqBody, div); handled {
+			return resp, nil
+		}
+		if !t.recordsMiss(mode, endpointName) {
+			log.Info(ctx, log.KV{K: "vcr.action", V: "passthrough"})
+			return t.base.RoundTrip(req)
+		}
+	}
+
+	upgrade := ok && websocket.IsWebSocketUpgrade(req)
+	if upgrade {
+		// Compressed frames cannot be recorded; don't negotiate compression.
+		req.Header.Del("Sec-WebSocket-Extensions")
 	}
 
+	startedAt := time.Now()
 	resp, err := t.base.RoundTrip(req)
 	if err != nil || resp == nil {
 		return resp, err
 	}
+	wait := time.Since(startedAt)
 
-	// Record only GET 200 responses for known endpoints.
-	if !ok || req.Method != http.MethodGet || resp.StatusCode != http.StatusOK {
+	if conn, isConn := resp.Body.(io.ReadWriteCloser); upgrade && isConn && resp.StatusCode == http.StatusSwitchingProtocols {
+		if !t.store.CurrentPolicy().AllowRecord(req) {
+			return resp, err
+		}
+		// Pass frames through and record the conversation when it ends.
+		resp.Body = newWebSocketCapture(conn, func(messages []WebSocketMessage, elapsed time.Duration) {
+			if messages == nil {
+				messages = []WebSocketMessage{}
+			}
+			blob, _ := json.MarshalIndent(messages, "", "  ")
+			blob = append(blob, '\n')
+			t.write(endpointName, div, req, reqBody, ResponseMeta{
+				Status:      resp.StatusCode,
+				Headers:     resp.Header.Clone(),
+				MimeType:    "application/json",
+				Size:        len(blob),
+				HTTPVersion: resp.Proto,
+				StartedAt:   startedAt,
+				Timings:     Timings{Wait: wait, Receive: elapsed},
+			}, blob)
+		})
+		return resp, err
+	}
+
+	// Record only known endpoints, and only statuses allowed by policy.
+	if !ok || !t.store.CurrentPolicy().RecordStatus(endpointName, resp.StatusCode) {
 		return resp, err
 	}
 
 	// Check authorization policy: if claims don't match, skip recording.
-	if !t.store.Policy.AllowRecord(req) {
+	if !t.store.CurrentPolicy().AllowRecord(req) {
 		return resp, err
 	}
 
-	// If policy/query options are implicit and we exceed max variants, flip policy and delete stubs.
-	if div != "" {
-		if _, explicit := t.store.Policy.QueryVariantEnabled(endpointName); !explicit {
-			if triggered := t.observeVariantAndMaybeDisableQuery(endpointName, div); triggered {
-				log.Warn(log.With(t.ctx,
+	// If policy/query options are implicit and we exceed max variants, narrow policy and delete stubs.
+	// Only the query part is observed: distinct payloads are not a query explosion.
+	// Modes other than "all" keep existing stubs, so the heuristic only runs in that mode.
+	if query := req.URL.Query(); len(query) > 0 && mode == RecordModeAll {
+		if _, explicit := t.store.CurrentPolicy().QueryVariantEnabled(endpointName); !explicit {
+			if excluded, triggered := t.observeVariantAndMaybeDisableQuery(endpointName, query); triggered {
+				ctx := log.With(t.ctx,
 					log.KV{K: "vcr.endpoint.name", V: endpointName},
 					log.KV{K: "vcr.variant", V: div},
-				),
-					log.KV{K: "vcr.action", V: "heuristic"},
-					log.KV{K: "vcr.heuristic", V: "variant.query"},
-					log.KV{K: "vcr.max_variants", V: t.maxVariants},
-					log.KV{K: "msg", V: "too many query variants; auto-setting endpoints.<name>.variant.query=false and deleting existing stubs"},
 				)
-				return resp, err // wait for next call to record undiversified stub
+				if excluded != "" {
+					log.Warn(ctx,
+						log.KV{K: "vcr.action", V: "heuristic"},
+						log.KV{K: "vcr.heuristic", V: "variant.query.exclude"},
+						log.KV{K: "vcr.query.param", V: excluded},
+						log.KV{K: "vcr.max_variants", V: t.maxVariants},
+						log.KV{K: "msg", V: "too many query variants; auto-excluding the noisy parameter via endpoints.<name>.variant.query and deleting existing stubs"},
+					)
+				} else {
+					log.Warn(ctx,
+						log.KV{K: "vcr.action", V: "heuristic"},
+						log.KV{K: "vcr.heuristic", V: "variant.query"},
+						log.KV{K: "vcr.max_variants", V: t.maxVariants},
+						log.KV{K: "msg", V: "too many query variants; auto-setting endpoints.<name>.variant.query=false and deleting existing stubs"},
+					)
+				}
+				return resp, err // wait for next call to record the narrowed stub
 			}
 		}
 	}
 
+	if isEventStream(resp.Header.Get("Content-Type")) {
+		// Pass events through as they arrive and record the stream when it ends.
+		resp.Body = newEventStreamCapture(resp.Body, func(events []StreamEvent, elapsed time.Duration) {
+			if events == nil {
+				events = []StreamEvent{}
+			}
+			blob, _ := json.MarshalIndent(events, "", "  ")
+			blob = append(blob, '\n')
+			t.write(endpointName, div, req, reqBody, ResponseMeta{
+				Status:      resp.StatusCode,
+				Headers:     resp.Header.Clone(),
+				MimeType:    EventStreamMimeType,
+				Size:        len(blob),
+				HTTPVersion: resp.Proto,
+				StartedAt:   startedAt,
+				Timings:     Timings{Wait: wait, Receive: elapsed},
+			}, blob)
+		})
+		return resp, err
+	}
+
+	receiveStart := time.Now()
 	body, readErr := io.ReadAll(resp.Body)
 	_ = resp.Body.Close()
+	receive := time.Since(receiveStart)
 	if readErr != nil {
 		resp.Body = io.NopCloser(bytes.NewReader(body))
 		return resp, err
 	}
 	rawBody := body
+	headers := resp.Header.Clone()
 
-	// Handle gzip if upstream returned it anyway.
+	// Handle gzip if upstream returned it anyway. The blob is stored
+	// decompressed, so the recorded headers must not claim otherwise.
 	if resp.Header.Get("Content-Encoding") == "gzip" {
 		reader, gzErr := gzip.NewReader(bytes.NewReader(body))
 		if gzErr == nil {
 			body, _ = io.ReadAll(reader)
 			_ = reader.Close()
+			headers.Del("Content-Encoding")
+			headers.Del("Content-Length")
 		}
 	}
 
-	// Only record JSON bodies.
-	if !json.Valid(body) {
+	// Only record JSON (or empty, e.g. 204 No Content) bodies.
+	empty := len(bytes.TrimSpace(body)) == 0
+	if !empty && !json.Valid(body) {
 		resp.Body = io.NopCloser(bytes.NewReader(rawBody))
 		resp.ContentLength = int64(len(rawBody))
 		return resp, err
 	}
 
 	pretty, mimeType := formatJSONBlob(body, resp.Header)
+	if empty {
+		pretty, mimeType = nil, resp.Header.Get("Content-Type")
+	}
 	resp.Body = io.NopCloser(bytes.NewReader(rawBody))
 	resp.ContentLength = int64(len(rawBody))
 
+	t.write(endpointName, div, req, reqBody, ResponseMeta{
+		Status:      resp.StatusCode,
+		Headers:     headers,
+		MimeType:    mimeType,
+		Size:        len(pretty),
+		HTTPVersion: resp.Proto,
+		RedirectURL: resp.Header.Get("Location"),
+		StartedAt:   startedAt,
+		Timings:     Timings{Wait: wait, Receive: receive},
+	}, pretty)
+	return resp, err
+}
+
+// write saves a recorded response as the stub for endpointName and div, or
+// appends it to the stub's sequence when the endpoint records sequences.
+func (t *RecordingTransport) write(endpointName, div string, req *http.Request, reqBody []byte, meta ResponseMeta, blob []byte) {
 	ctx := log.With(t.ctx, log.KV{K: "vcr.endpoint.name", V: endpointName})
 	if div != "" {
 		ctx = log.With(ctx, log.KV{K: "vcr.variant", V: div})
@@ -126,84 +263,187 @@ func (t *RecordingTransport) RoundTrip(req *http.Request) (*http.Response, error
 	exists, existsErr := t.store.HasStub(endpointName, div)
 	if existsErr != nil {
 		log.Error(ctx, existsErr, log.KV{K: "msg", V: "stub exists check failed"})
-		return resp, err
+		return
 	}
 	action := "create"
 	if exists {
 		action = "update"
 	}
+	write := t.store.WriteStub
+	if t.store.CurrentPolicy().RecordSequence(endpointName) {
+		key := stubKey(endpointName, div)
+		t.mu.Lock()
+		if t.sequenced[key] {
+			write, action = t.store.AppendStub, "append"
+		}
+		t.sequenced[key] = true
+		t.mu.Unlock()
+	}
 
-	if writeErr := t.store.WriteStub(endpointName, RequestSpec{URL: req.URL.String()}, ResponseMeta{
-		Status:   resp.StatusCode,
-		Headers:  firstHeaderValues(resp.Header),
-		MimeType: mimeType,
-		Size:     len(pretty),
-	}, pretty, div); writeErr != nil {
-		log.Error(ctx, writeErr, log.KV{K: "msg", V: "write failed"})
-		return resp, err
+	reqSpec := RequestSpec{
+		Method:      req.Method,
+		URL:         req.URL.String(),
+		HTTPVersion: req.Proto,
+		Headers:     RecordedRequestHeaders(req.Header, variantCookies(t.store.CurrentPolicy(), endpointName, req)),
+		Body:        reqBody,
+		MimeType:    req.Header.Get("Content-Type"),
+	}
+	if err := write(endpointName, reqSpec, meta, blob, div); err != nil {
+		log.Error(ctx, err, log.KV{K: "msg", V: "write failed"})
+		return
 	}
 
-	log.Info(ctx, log.KV{K: "vcr.action", V: action})
-	return resp, err
+	log.Info(ctx, log.KV{K: "vcr.action", V: action}, log.KV{K: "http.status", V: meta.Status})
 }
 
-func (t *RecordingTransport) observeVariantAndMaybeDisableQuery(endpointName, diversifier string) bool {
-	if t.maxVariants <= 0 {
+func (t *RecordingTransport) recordMode(endpointName string) RecordMode {
+	if t.Mode != "" {
+		return t.Mode
+	}
+	return t.store.CurrentPolicy().RecordMode(endpointName)
+}
+
+// replay answers req from an existing stub. In RecordModeNone a miss is
+// answered with 501. It reports false when the request should reach the upstream.
+func (t *RecordingTransport) replay(ctx context.Context, req *http.Request, mode RecordMode, endpointName string, vars map[string]string, reqBody []byte, div string) (*http.Response, bool) {
+	t.store.indexStubsOnce(t.matcher)
+	meta, body, _, err := t.store.nextResponse(endpointName, div)
+	if errors.Is(err, ErrSequenceExhausted) {
+		log.Info(ctx, log.KV{K: "vcr.action", V: "exhausted"})
+		return vcrErrorResponse(req, http.StatusNotImplemented, "vcr: stub sequence exhausted"), true
+	}
+	if err == nil && meta.Status == http.StatusSwitchingProtocols {
+		// WebSocket conversations are replayed by the playback server only;
+		// pass the connection through and keep the recorded one.
+		log.Info(ctx, log.KV{K: "vcr.action", V: "passthrough"})
+		resp, err := t.base.RoundTrip(req)
+		if err != nil {
+			return vcrErrorResponse(req, http.StatusBadGateway, "vcr: upstream request failed"), true
+		}
+		return resp, true
+	}
+	if err == nil {
+		body, err = renderStub(req, endpointName, vars, reqBody, meta, body)
+		if err != nil {
+			log.Error(ctx, err, log.KV{K: "msg", V: "stub template failed"})
+			return vcrErrorResponse(req, http.StatusInternalServerError, err.Error()), true
+		}
+		log.Info(ctx, log.KV{K: "vcr.action", V: "replay"})
+		return stubResponse(req, endpointName, meta, body, false), true
+	}
+	if errors.Is(err, ErrIncompleteStub) && mode != RecordModeNone {
+		// Recording the request again replaces the stub.
+		log.Error(ctx, err, log.KV{K: "msg", V: "incomplete stub, recording it again"})
+		return nil, false
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		log.Error(ctx, err, log.KV{K: "msg", V: "stub read failed"})
+		return vcrErrorResponse(req, http.StatusInternalServerError, "vcr: failed to read stub"), true
+	}
+	if mode == RecordModeNone {
+		log.Info(ctx, log.KV{K: "vcr.action", V: "miss"})
+		return vcrErrorResponse(req, http.StatusNotImplemented, "vcr: unstubbed endpoint"), true
+	}
+	return nil, false
+}
+
+// recordsMiss reports whether a request without a stub is recorded in mode.
+func (t *RecordingTransport) recordsMiss(mode RecordMode, endpointName string) bool {
+	switch mode {
+	case RecordModeAll, RecordModeNewEpisodes:
+		return true
+	case RecordModeOnce:
+		recorded, err := t.store.hasEndpointStubs(endpointName)
+		return err == nil && !recorded
+	default:
 		return false
 	}
+}
+
+// observeVariantAndMaybeDisableQuery tracks the distinct queries seen for the
+// endpoint. Past maxVariants it persists a narrower query policy: it excludes
+// the single parameter responsible for the explosion when there is one, and
+// disables query variants otherwise. It returns the excluded parameter, if any.
+func (t *RecordingTransport) observeVariantAndMaybeDisableQuery(endpointName string, query url.Values) (string, bool) {
+	if t.maxVariants <= 0 {
+		return "", false
+	}
 
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
-	// Ignore heuristic if user explicitly set variant.query (true or false).
-	if _, explicit := t.store.Policy.QueryVariantEnabled(endpointName); explicit {
-		return false
+	// Ignore heuristic if user explicitly set variant.query.
+	if _, explicit := t.store.CurrentPolicy().QueryVariantEnabled(endpointName); explicit {
+		return "", false
 	}
 
 	seen := t.variantsSeen[endpointName]
 	if seen == nil {
-		seen = map[string]struct{}{}
+		seen = map[string]url.Values{}
 		t.variantsSeen[endpointName] = seen
 	}
-	seen[diversifier] = struct{}{}
+	seen[NormalizeValues(query)] = query
 	if len(seen) <= t.maxVariants {
-		return false
+		return "", false
 	}
 
-	t.store.Policy.SetVariantQuery(endpointName, false)
-	if err := t.store.WritePolicy(); err != nil {
+	excluded := noisyQueryParam(seen, t.maxVariants)
+	err := t.store.UpdatePolicyFile(func(p *Policy) {
+		if excluded != "" {
+			p.SetQueryVariant(endpointName, QueryVariant{Enabled: true, Exclude: []string{excluded}})
+		} else {
+			p.SetVariantQuery(endpointName, false)
+		}
+	})
+	if err != nil {
 		log.Error(t.ctx, err, log.KV{K: "msg", V: "failed to persist policy update"})
-		t.store.Policy.ClearVariantQuery(endpointName)
-		return false
+		return "", false
 	}
 
 	t.deleteEndpointStubs(endpointName)
 	delete(t.variantsSeen, endpointName)
-	return true
+	return excluded, true
 }
 
-func (t *RecordingTransport) deleteEndpointStubs(endpointName string) {
-	entries, err := os.ReadDir(t.store.Root)
-	if err != nil {
-		log.Error(t.ctx, err, log.KV{K: "msg", V: "failed to read stub dir for deletion"})
-		return
+// noisyQueryParam returns the query parameter whose removal brings the distinct
+// queries in seen back within maxVariants while other parameters still vary
+// the stubs, or "" if there is none.
+func noisyQueryParam(seen map[string]url.Values, maxVariants int) string {
+	var names []string
+	for _, query := range seen {
+		for name := range query {
+			if !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
 	}
+	sort.Strings(names)
 
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
-		}
-		name := entry.Name()
-		if name == PolicyFileName {
-			continue
+	best, bestCount := "", 0
+	for _, name := range names {
+		rest := map[string]struct{}{}
+		others := false
+		for _, query := range seen {
+			without := QueryVariant{Enabled: true, Exclude: []string{name}}.Filter(query)
+			if len(without) > 0 {
+				others = true
+			}
+			rest[NormalizeValues(without)] = struct{}{}
 		}
-		if !strings.HasSuffix(name, ".vcr.har") && !strings.HasSuffix(name, ".vcr.json") {
+		if !others || len(rest) > maxVariants {
 			continue
 		}
-		if name == endpointName+".vcr.har" || name == endpointName+".vcr.json" || strings.HasPrefix(name, endpointName+"--") {
-			_ = os.Remove(filepath.Join(t.store.Root, name))
+		if best == "" || len(rest) < bestCount {
+			best, bestCount = name, len(rest)
 		}
 	}
+	return best
+}
+
+func (t *RecordingTransport) deleteEndpointStubs(endpointName string) {
+	if err := t.store.deleteEndpointStubs(endpointName); err != nil {
+		log.Error(t.ctx, err, log.KV{K: "msg", V: "failed to delete endpoint stubs"})
+	}
 }
 
 func formatJSONBlob(body []byte, headers http.Header) ([]byte, string) {
@@ -219,17 +459,68 @@ func formatJSONBlob(body []byte, headers http.Header) ([]byte, string) {
 	return pretty.Bytes(), contentType
 }
 
-func firstHeaderValues(headers http.Header) map[string]string {
+// ReadRequestBody drains req.Body and replaces it with an in-memory copy so the
+// request can still be sent (or decoded) after the payload has been inspected.
+func ReadRequestBody(req *http.Request) ([]byte, error) {
+	if req == nil || req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := io.ReadAll(req.Body)
+	_ = req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// RecordedRequestHeaders returns a copy of headers suitable for persisting in a
+// stub. Credentials are dropped so they never end up in committed testdata:
+// the Cookie header only keeps the cookies named in cookies, usually those
+// that stub variants are chosen by.
+func RecordedRequestHeaders(headers http.Header, cookies []string) http.Header {
 	if len(headers) == 0 {
 		return nil
 	}
-	out := make(map[string]string, len(headers))
-	for name, values := range headers {
-		if len(values) == 0 {
+	out := headers.Clone()
+	out.Del("Authorization")
+	out.Del("Proxy-Authorization")
+	out.Del(LoopbackHeader)
+	out.Del("Cookie")
+	var kept []string
+	for _, line := range headers.Values("Cookie") {
+		parsed, err := http.ParseCookie(line)
+		if err != nil {
 			continue
 		}
-		out[name] = values[0]
+		for _, c := range parsed {
+			if slices.Contains(cookies, c.Name) {
+				kept = append(kept, c.String())
+			}
+		}
+	}
+	if len(kept) > 0 {
+		out.Set("Cookie", strings.Join(kept, "; "))
 	}
 	return out
 }
 
+// variantCookies returns the names of the request cookies that the stub
+// variants of the endpoint are chosen by: its cookie variants, or every cookie
+// if the Cookie header is a header variant.
+func variantCookies(policy Policy, endpointName string, req *http.Request) []string {
+	if !slices.ContainsFunc(policy.HeaderVariants(endpointName), func(name string) bool {
+		return strings.EqualFold(name, "Cookie")
+	}) {
+		return policy.CookieVariants(endpointName)
+	}
+	var names []string
+	for _, c := range req.Cookies() {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
@@ -2,10 +2,16 @@ package runtime
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
+	"io"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -64,7 +70,7 @@ func TestRecordingTransportVariantHeuristicDisablesQuery(t *testing.T) {
 	_, _ = tr.RoundTrip(req1)
 
 	// After first request, diversified stub should exist.
-	div1 := RequestDiversifier(store.Policy, "GetThing", req1.URL.Query(), map[string]string{"id": "123"})
+	div1 := RequestDiversifier(store.Policy, "GetThing", req1.URL.Query(), map[string]string{"id": "123"}, nil, nil)
 	if div1 == "" {
 		t.Fatalf("expected diversifier")
 	}
@@ -102,3 +108,405 @@ func TestRecordingTransportVariantHeuristicDisablesQuery(t *testing.T) {
 	}
 }
 
+func TestRecordingTransportRecordsPostWithBodyVariant(t *testing.T) {
+	tmp := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmp, PolicyFileName), []byte("{\"upstream\":\"https://example.com\"}\n"), 0600); err != nil {
+		t.Fatalf("write policy: %v", err)
+	}
+	store, err := New(tmp)
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+
+	endpoints := []Endpoint{
+		{Name: "CreateThing", Method: http.MethodPost, Pattern: "/things"},
+	}
+	base := staticRoundTripper{
+		status:  http.StatusCreated,
+		headers: http.Header{"Content-Type": []string{"application/json"}},
+		body:    []byte(`{"id":"1"}`),
+	}
+	tr := NewRecordingTransport(nil, store, endpoints, base, 5)
+
+	for _, payload := range []string{`{"name":"a"}`, `{"name":"b"}`} {
+		req, err := http.NewRequest(http.MethodPost, "http://example.com/things", strings.NewReader(payload))
+		if err != nil {
+			t.Fatalf("new request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if _, err := tr.RoundTrip(req); err != nil {
+			t.Fatalf("round trip: %v", err)
+		}
+
+		div := RequestDiversifier(store.Policy, "CreateThing", nil, nil, []byte(payload), nil)
+		spec, err := store.ReadRequest("CreateThing", div)
+		if err != nil {
+			t.Fatalf("expected stub for payload %s: %v", payload, err)
+		}
+		if spec.Method != http.MethodPost || string(spec.Body) != payload || spec.MimeType != "application/json" {
+			t.Fatalf("unexpected request spec: %+v", spec)
+		}
+	}
+}
+
+func TestRecordingTransportBodyPathVariantIgnoresNonces(t *testing.T) {
+	store, err := NewWithStorage(memoryStorageWithPolicy(t, `{"upstream":"https://example.com","endpoints":{"SearchThings":{"variant":{"body":["$.filter.status"]}}}}`))
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	endpoints := []Endpoint{
+		{Name: "SearchThings", Method: http.MethodPost, Pattern: "/things/search"},
+	}
+	post := func(payload string) *http.Request {
+		req, err := http.NewRequest(http.MethodPost, "http://example.com/things/search", strings.NewReader(payload))
+		if err != nil {
+			t.Fatalf("new request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req
+	}
+
+	base := &countingRoundTripper{body: `[{"id":"1"}]`}
+	tr := NewRecordingTransport(nil, store, endpoints, base, 5)
+	if _, err := tr.RoundTrip(post(`{"filter":{"status":"open"},"nonce":"n1"}`)); err != nil {
+		t.Fatalf("round trip: %v", err)
+	}
+
+	d := NewStubDoer(store, endpoints)
+	resp, err := d.Do(post(`{"nonce":"n2","filter":{"status":"open"}}`))
+	if err != nil {
+		t.Fatalf("do: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected stub for same filter with new nonce, got %d", resp.StatusCode)
+	}
+	resp, err = d.Do(post(`{"filter":{"status":"closed"},"nonce":"n3"}`))
+	if err != nil {
+		t.Fatalf("do: %v", err)
+	}
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("expected miss for another filter, got %d", resp.StatusCode)
+	}
+}
+
+func TestRecordingTransportRecordsErrorStatus(t *testing.T) {
+	tmp := t.TempDir()
+	policyJSON := `{"upstream":"https://example.com","endpoints":{"GetOther":{"record":{"status":[200]}}}}`
+	if err := os.WriteFile(filepath.Join(tmp, PolicyFileName), []byte(policyJSON), 0600); err != nil {
+		t.Fatalf("write policy: %v", err)
+	}
+	store, err := New(tmp)
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+
+	endpoints := []Endpoint{
+		{Name: "GetThing", Method: http.MethodGet, Pattern: "/things/{id}"},
+		{Name: "GetOther", Method: http.MethodGet, Pattern: "/others/{id}"},
+	}
+	base := staticRoundTripper{
+		status:  http.StatusNotFound,
+		headers: http.Header{"Content-Type": []string{"application/json"}},
+		body:    []byte(`{"name":"not_found","message":"no such thing"}`),
+	}
+	tr := NewRecordingTransport(nil, store, endpoints, base, 5)
+
+	_, _ = tr.RoundTrip(mustRequest(t, http.MethodGet, "http://example.com/things/123"))
+	meta, _, err := store.ReadResponse("GetThing")
+	if err != nil {
+		t.Fatalf("expected 404 stub recorded: %v", err)
+	}
+	if meta.Status != http.StatusNotFound {
+		t.Fatalf("unexpected recorded status: %d", meta.Status)
+	}
+
+	_, _ = tr.RoundTrip(mustRequest(t, http.MethodGet, "http://example.com/others/123"))
+	if ok, _ := store.HasStub("GetOther"); ok {
+		t.Fatalf("expected 404 NOT recorded when record.status excludes it")
+	}
+}
+
+func TestRecordingTransportRecordsRequestHeadersWithoutCredentials(t *testing.T) {
+	tmp := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmp, PolicyFileName), []byte("{\"upstream\":\"https://example.com\"}\n"), 0600); err != nil {
+		t.Fatalf("write policy: %v", err)
+	}
+	store, err := New(tmp)
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+
+	endpoints := []Endpoint{
+		{Name: "GetThing", Method: http.MethodGet, Pattern: "/things/{id}"},
+	}
+	base := staticRoundTripper{
+		status:  http.StatusOK,
+		headers: http.Header{"Content-Type": []string{"application/json"}},
+		body:    []byte(`{"id":"1"}`),
+	}
+	tr := NewRecordingTransport(nil, store, endpoints, base, 5)
+
+	req := mustRequest(t, http.MethodGet, "http://example.com/things/1")
+	req.Header.Set("Accept-Language", "fr")
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Cookie", "sid=secret")
+	if _, err := tr.RoundTrip(req); err != nil {
+		t.Fatalf("round trip: %v", err)
+	}
+
+	spec, err := store.ReadRequest("GetThing")
+	if err != nil {
+		t.Fatalf("read request: %v", err)
+	}
+	if spec.Headers.Get("Accept-Language") != "fr" || spec.HTTPVersion != "HTTP/1.1" {
+		t.Fatalf("unexpected recorded request: %+v", spec)
+	}
+	if spec.Headers.Get("Authorization") != "" {
+		t.Fatalf("expected Authorization header to be dropped")
+	}
+	if spec.Headers.Get("Cookie") != "" {
+		t.Fatalf("expected Cookie header to be dropped")
+	}
+}
+
+func TestRecordingTransportKeepsVariantCookiesOnly(t *testing.T) {
+	for _, tc := range []struct {
+		policy string
+		want   string
+	}{
+		{`{"upstream":"https://example.com"}`, ""},
+		{`{"upstream":"https://example.com","endpoints":{"GetThing":{"variant":{"cookies":["region"]}}}}`, "region=eu"},
+		{`{"upstream":"https://example.com","endpoints":{"GetThing":{"variant":{"headers":["cookie"]}}}}`, "sid=secret; region=eu"},
+	} {
+		store, err := NewWithStorage(memoryStorageWithPolicy(t, tc.policy))
+		if err != nil {
+			t.Fatalf("new store: %v", err)
+		}
+		endpoints := []Endpoint{
+			{Name: "GetThing", Method: http.MethodGet, Pattern: "/things/{id}"},
+		}
+		tr := NewRecordingTransport(nil, store, endpoints, &countingRoundTripper{body: `{"id":"1"}`}, 5)
+		req := mustRequest(t, http.MethodGet, "http://example.com/things/1")
+		req.Header.Set("Cookie", "sid=secret; region=eu")
+		if _, err := tr.RoundTrip(req); err != nil {
+			t.Fatalf("round trip: %v", err)
+		}
+		keys, err := store.ListStubs()
+		if err != nil || len(keys) != 1 {
+			t.Fatalf("expected one stub, got %v (%v)", keys, err)
+		}
+		endpointName, div, _ := strings.Cut(keys[0], "--")
+		spec, err := store.ReadRequest(endpointName, div)
+		if err != nil {
+			t.Fatalf("read request: %v", err)
+		}
+		if got := spec.Headers.Get("Cookie"); got != tc.want {
+			t.Fatalf("policy %s: expected recorded Cookie %q, got %q", tc.policy, tc.want, got)
+		}
+	}
+}
+
+// countingRoundTripper counts upstream calls and answers with a fixed JSON body.
+type countingRoundTripper struct {
+	calls int
+	body  string
+	// header holds the headers of the last request.
+	header http.Header
+}
+
+func (rt *countingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.calls++
+	rt.header = req.Header.Clone()
+	return staticRoundTripper{
+		status:  http.StatusOK,
+		headers: http.Header{"Content-Type": []string{"application/json"}},
+		body:    []byte(rt.body),
+	}.RoundTrip(req)
+}
+
+func TestRecordingTransportModes(t *testing.T) {
+	endpoints := []Endpoint{
+		{Name: "GetThing", Method: http.MethodGet, Pattern: "/things/{id}"},
+	}
+	newStore := func(t *testing.T) *VCR {
+		t.Helper()
+		storage := NewMemoryStorage()
+		if err := storage.WriteFile(PolicyFileName, []byte(`{"upstream":"https://example.com","endpoints":{"GetThing":{"variant":{"path":true}}}}`)); err != nil {
+			t.Fatalf("write policy: %v", err)
+		}
+		store, err := NewWithStorage(storage)
+		if err != nil {
+			t.Fatalf("new store: %v", err)
+		}
+		return store
+	}
+	get := func(t *testing.T, tr *RecordingTransport, id string) *http.Response {
+		t.Helper()
+		resp, err := tr.RoundTrip(mustRequest(t, http.MethodGet, "http://example.com/things/"+id))
+		if err != nil {
+			t.Fatalf("round trip: %v", err)
+		}
+		return resp
+	}
+	stubCount := func(t *testing.T, store *VCR) int {
+		t.Helper()
+		keys, err := store.ListStubs()
+		if err != nil {
+			t.Fatalf("list stubs: %v", err)
+		}
+		return len(keys)
+	}
+
+	t.Run("none", func(t *testing.T) {
+		store := newStore(t)
+		upstream := &countingRoundTripper{body: `{"id":"1"}`}
+		tr := NewRecordingTransport(nil, store, endpoints, upstream, 5)
+		tr.Mode = RecordModeNone
+		if resp := get(t, tr, "1"); resp.StatusCode != http.StatusNotImplemented || upstream.calls != 0 {
+			t.Fatalf("expected 501 without upstream call, got %d after %d calls", resp.StatusCode, upstream.calls)
+		}
+	})
+
+	t.Run("new_episodes", func(t *testing.T) {
+		store := newStore(t)
+		upstream := &countingRoundTripper{body: `{"id":"1"}`}
+		tr := NewRecordingTransport(nil, store, endpoints, upstream, 5)
+		tr.Mode = RecordModeNewEpisodes
+		get(t, tr, "1")
+		get(t, tr, "1")
+		get(t, tr, "2")
+		if upstream.calls != 2 || stubCount(t, store) != 2 {
+			t.Fatalf("expected replay of known variant and recording of new one, got %d calls, %d stubs", upstream.calls, stubCount(t, store))
+		}
+	})
+
+	t.Run("once", func(t *testing.T) {
+		store := newStore(t)
+		upstream := &countingRoundTripper{body: `{"id":"1"}`}
+		tr := NewRecordingTransport(nil, store, endpoints, upstream, 5)
+		tr.Mode = RecordModeOnce
+		get(t, tr, "1")
+		get(t, tr, "1")
+		get(t, tr, "2")
+		if upstream.calls != 2 || stubCount(t, store) != 1 {
+			t.Fatalf("expected new variant to pass through unrecorded, got %d calls, %d stubs", upstream.calls, stubCount(t, store))
+		}
+	})
+
+	t.Run("fallthrough from policy", func(t *testing.T) {
+		store := newStore(t)
+		store.Policy.Mode = RecordModeFallthrough
+		upstream := &countingRoundTripper{body: `{"id":"1"}`}
+		tr := NewRecordingTransport(nil, store, endpoints, upstream, 5)
+		if resp := get(t, tr, "1"); resp.StatusCode != http.StatusOK || upstream.calls != 1 || stubCount(t, store) != 0 {
+			t.Fatalf("expected proxied, unrecorded response, got %d after %d calls", resp.StatusCode, upstream.calls)
+		}
+	})
+
+	t.Run("all", func(t *testing.T) {
+		store := newStore(t)
+		upstream := &countingRoundTripper{body: `{"id":"1"}`}
+		tr := NewRecordingTransport(nil, store, endpoints, upstream, 5)
+		get(t, tr, "1")
+		get(t, tr, "1")
+		if upstream.calls != 2 || stubCount(t, store) != 1 {
+			t.Fatalf("expected every call to reach upstream, got %d calls", upstream.calls)
+		}
+	})
+}
+
+func TestRecordingTransportVariantHeuristicExcludesNoisyParam(t *testing.T) {
+	tmp := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmp, PolicyFileName), []byte("{\"upstream\":\"https://example.com\"}\n"), 0600); err != nil {
+		t.Fatalf("write policy: %v", err)
+	}
+	store, err := New(tmp)
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+
+	endpoints := []Endpoint{
+		{Name: "ListThings", Method: http.MethodGet, Pattern: "/things"},
+	}
+	base := staticRoundTripper{
+		status:  http.StatusOK,
+		headers: http.Header{"Content-Type": []string{"application/json"}},
+		body:    []byte(`[]`),
+	}
+	tr := NewRecordingTransport(nil, store, endpoints, base, 2)
+
+	for _, query := range []string{"status=open&_ts=1", "status=open&_ts=2", "status=closed&_ts=3"} {
+		_, _ = tr.RoundTrip(mustRequest(t, http.MethodGet, "http://example.com/things?"+query))
+	}
+
+	data, err := os.ReadFile(filepath.Join(tmp, PolicyFileName))
+	if err != nil {
+		t.Fatalf("read policy: %v", err)
+	}
+	var policy Policy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		t.Fatalf("parse policy: %v", err)
+	}
+	qv, explicit := policy.QueryVariant("ListThings")
+	if !explicit || !qv.Enabled || len(qv.Exclude) != 1 || qv.Exclude[0] != "_ts" {
+		t.Fatalf("expected variant.query to exclude _ts, got %+v (explicit=%v)", qv, explicit)
+	}
+	if keys, _ := store.ListStubs(); len(keys) != 0 {
+		t.Fatalf("expected existing stubs deleted, got %v", keys)
+	}
+
+	req := mustRequest(t, http.MethodGet, "http://example.com/things?status=open&_ts=99")
+	_, _ = tr.RoundTrip(req)
+	div := RequestDiversifier(store.Policy, "ListThings", url.Values{"status": {"open"}}, nil, nil, nil)
+	if ok, _ := store.HasStub("ListThings", div); !ok {
+		t.Fatalf("expected stub diversified by status only")
+	}
+}
+
+
+func TestRecordingTransportDecompressesGzipStubs(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		_, _ = io.WriteString(gz, `{"id":"1"}`)
+		_ = gz.Close()
+	}))
+	defer upstream.Close()
+
+	store, err := NewWithStorage(memoryStorageWithPolicy(t, `{"upstream":"`+upstream.URL+`"}`))
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	endpoints := []Endpoint{{Name: "GetThing", Method: http.MethodGet, Pattern: "/things"}}
+	tr := NewRecordingTransport(nil, store, endpoints, http.DefaultTransport, 0)
+	req := mustRequest(t, http.MethodGet, upstream.URL+"/things")
+	// Asking for gzip explicitly keeps the transport from decompressing.
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("round trip: %v", err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected the recorded client to get the upstream response as is")
+	}
+
+	d := NewStubDoer(store, endpoints)
+	resp, err = d.Do(mustRequest(t, http.MethodGet, "http://vcr.local/things"))
+	if err != nil {
+		t.Fatalf("do: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if enc := resp.Header.Get("Content-Encoding"); enc != "" {
+		t.Fatalf("expected no Content-Encoding on replay, got %q", enc)
+	}
+	if resp.Header.Get("Content-Length") != strconv.Itoa(len(body)) {
+		t.Fatalf("expected Content-Length %d, got %q", len(body), resp.Header.Get("Content-Length"))
+	}
+	var v map[string]string
+	if err := json.Unmarshal(body, &v); err != nil || v["id"] != "1" {
+		t.Fatalf("expected a plain JSON body, got %q %v", body, err)
+	}
+}
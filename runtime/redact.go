@@ -0,0 +1,126 @@
+package runtime
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+// RedactedValue replaces scrubbed values unless a pattern says otherwise.
+const RedactedValue = "[REDACTED]"
+
+// Validate checks that every path and pattern parses.
+func (r *RedactPolicy) Validate() error {
+	if r == nil {
+		return nil
+	}
+	for _, path := range r.Paths {
+		if _, err := parseJSONPath(path); err != nil {
+			return fmt.Errorf("paths: %w", err)
+		}
+	}
+	for _, p := range r.Patterns {
+		if _, err := regexp.Compile(p.Pattern); err != nil {
+			return fmt.Errorf("patterns: %w", err)
+		}
+	}
+	return nil
+}
+
+// apply returns scrubbed copies of a stub's request, response and body. Headers
+// are dropped first, then JSON paths are masked, then patterns are replaced.
+func (r *RedactPolicy) apply(req RequestSpec, resp ResponseMeta, body []byte) (RequestSpec, ResponseMeta, []byte) {
+	if r == nil {
+		return req, resp, body
+	}
+	req.Headers = dropHeaders(req.Headers, r.Headers)
+	resp.Headers = dropHeaders(resp.Headers, r.Headers)
+
+	req.Body = redactJSONPaths(req.Body, r.Paths)
+	redacted := redactJSONPaths(body, r.Paths)
+
+	for _, p := range r.Patterns {
+		re, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			continue
+		}
+		replace := p.Replace
+		if replace == "" {
+			replace = RedactedValue
+		}
+		req.URL = re.ReplaceAllString(req.URL, replace)
+		req.Body = re.ReplaceAll(req.Body, []byte(replace))
+		replaceHeaderValues(req.Headers, re, replace)
+		replaceHeaderValues(resp.Headers, re, replace)
+		resp.RedirectURL = re.ReplaceAllString(resp.RedirectURL, replace)
+		redacted = re.ReplaceAll(redacted, []byte(replace))
+	}
+
+	if resp.Size == len(body) {
+		resp.Size = len(redacted)
+	}
+	return req, resp, redacted
+}
+
+// dropHeaders returns a copy of h without the named headers.
+func dropHeaders(h http.Header, names []string) http.Header {
+	if h == nil {
+		return nil
+	}
+	out := h.Clone()
+	for _, name := range names {
+		out.Del(name)
+	}
+	return out
+}
+
+func replaceHeaderValues(h http.Header, re *regexp.Regexp, replace string) {
+	for name, vals := range h {
+		for i, val := range vals {
+			vals[i] = re.ReplaceAllString(val, replace)
+		}
+		h[name] = vals
+	}
+}
+
+// redactJSONPaths replaces the values selected by paths with RedactedValue. The
+// body is returned unchanged if it is not JSON or nothing matches; otherwise it
+// is re-encoded with sorted keys, indented if the original was.
+func redactJSONPaths(body []byte, paths []string) []byte {
+	if len(paths) == 0 || len(bytes.TrimSpace(body)) == 0 {
+		return body
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var doc any
+	if err := decoder.Decode(&doc); err != nil || decoder.More() {
+		return body
+	}
+	n := 0
+	for _, raw := range paths {
+		path, err := parseJSONPath(raw)
+		if err != nil || len(path) == 0 {
+			continue
+		}
+		n += path.walk(doc, func(any) any { return RedactedValue })
+	}
+	if n == 0 {
+		return body
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if bytes.Contains(bytes.TrimSpace(body), []byte("\n")) {
+		encoder.SetIndent("", "  ")
+	}
+	if err := encoder.Encode(doc); err != nil {
+		return body
+	}
+	if !bytes.HasSuffix(body, []byte("\n")) {
+		return bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,77 @@
+package runtime
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestWriteStubAppliesRedactPolicy(t *testing.T) {
+	store, err := NewWithStorage(memoryStorageWithPolicy(t, `{
+  "upstream": "https://example.com",
+  "redact": {
+    "headers": ["set-cookie", "X-Session"],
+    "paths": ["$.user.email", "$.items[*].token"],
+    "patterns": [{"pattern": "sk_live_[A-Za-z0-9]+"}, {"pattern": "(api_key=)[^&]+", "replace": "${1}xxx"}]
+  }
+}`))
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+
+	body := []byte("{\n  \"items\": [\n    {\"token\": \"t1\"},\n    {\"token\": \"t2\"}\n  ],\n  \"key\": \"sk_live_abc123\",\n  \"user\": {\"email\": \"a@example.com\", \"name\": \"Ann\"}\n}\n")
+	if err := store.WriteStub("GetMe", RequestSpec{
+		Method:  http.MethodPost,
+		URL:     "https://example.com/me?api_key=secret&x=1",
+		Headers: http.Header{"X-Session": {"s1"}, "Accept": {"application/json"}},
+		Body:    []byte(`{"user":{"email":"b@example.com"}}`),
+	}, ResponseMeta{
+		Status:   200,
+		Headers:  http.Header{"Set-Cookie": {"sid=1"}, "X-Trace": {"sk_live_zzz"}},
+		MimeType: "application/json",
+		Size:     len(body),
+	}, body); err != nil {
+		t.Fatalf("write stub: %v", err)
+	}
+
+	req, err := store.ReadRequest("GetMe")
+	if err != nil {
+		t.Fatalf("read request: %v", err)
+	}
+	if req.URL != "https://example.com/me?api_key=xxx&x=1" {
+		t.Fatalf("expected URL pattern replacement, got %q", req.URL)
+	}
+	if req.Headers.Get("X-Session") != "" || req.Headers.Get("Accept") == "" {
+		t.Fatalf("unexpected request headers: %v", req.Headers)
+	}
+	if string(req.Body) != `{"user":{"email":"[REDACTED]"}}` {
+		t.Fatalf("unexpected request body: %s", req.Body)
+	}
+
+	meta, got, err := store.ReadResponse("GetMe")
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if meta.Headers.Get("Set-Cookie") != "" || meta.Headers.Get("X-Trace") != RedactedValue {
+		t.Fatalf("unexpected response headers: %v", meta.Headers)
+	}
+	for _, secret := range []string{"t1", "t2", "sk_live_abc123", "a@example.com"} {
+		if strings.Contains(string(got), secret) {
+			t.Fatalf("expected %q to be redacted from %s", secret, got)
+		}
+	}
+	if !strings.Contains(string(got), "\"name\": \"Ann\"") || meta.Size != len(got) {
+		t.Fatalf("expected indented body with updated size, got %d bytes (size %d):\n%s", len(got), meta.Size, got)
+	}
+}
+
+func TestRedactPolicyValidate(t *testing.T) {
+	for _, r := range []*RedactPolicy{
+		{Paths: []string{"user.email"}},
+		{Patterns: []RedactPattern{{Pattern: "("}}},
+	} {
+		if err := (Policy{Redact: r}).Validate(); err == nil || !strings.HasPrefix(err.Error(), "redact.") {
+			t.Fatalf("expected redact error for %+v, got %v", r, err)
+		}
+	}
+}
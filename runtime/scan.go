@@ -0,0 +1,161 @@
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// SecretFinding is a likely secret that ScanStubs found in a stub.
+type SecretFinding struct {
+	// Stub is the stub key (endpoint name plus optional "--" diversifier).
+	Stub string
+	// Location says where the secret is, e.g. "response header Set-Cookie" or
+	// "response body".
+	Location string
+	// Rule names the check that matched, e.g. "jwt" or "email".
+	Rule string
+	// Excerpt is the start of the match; the rest is elided so that the
+	// report does not leak the secret again. For stubs that could not be
+	// scanned, it is the error.
+	Excerpt string
+}
+
+// sensitiveHeaders are headers that carry credentials or session state.
+var sensitiveHeaders = []string{
+	"Authorization",
+	"Cookie",
+	"Proxy-Authorization",
+	"Set-Cookie",
+	"X-Api-Key",
+	"X-Auth-Token",
+	"X-Csrf-Token",
+}
+
+// secretRules are the patterns ScanStubs looks for in URLs, header values and
+// bodies.
+var secretRules = []struct {
+	name string
+	re   *regexp.Regexp
+}{
+	{"jwt", regexp.MustCompile(`eyJ[A-Za-z0-9_-]{5,}\.[A-Za-z0-9_-]{5,}\.[A-Za-z0-9_-]*`)},
+	{"bearer-token", regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9._~+/=-]{16,}`)},
+	{"aws-access-key", regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"private-key", regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----`)},
+	{"secret-field", regexp.MustCompile(`(?i)"[a-z0-9_-]*(?:password|passwd|secret|token|api[_-]?key|access[_-]?key)[a-z0-9_-]*"\s*:\s*"[^"]+"`)},
+	{"secret-param", regexp.MustCompile(`(?i)[?&][a-z0-9_-]*(?:password|secret|token|api[_-]?key|signature)[a-z0-9_-]*=[^&#]+`)},
+	{"email", regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`)},
+}
+
+// ScanStubs looks for likely secrets (credentials headers, tokens, keys and
+// email addresses) in every stub. Values already replaced by RedactedValue are
+// not reported. Stubs that are incomplete or cannot be read are reported as
+// "incomplete-stub" or "unreadable-stub" findings and the scan goes on.
+// Findings are ordered by stub.
+func (v *VCR) ScanStubs() ([]SecretFinding, error) {
+	keys, err := v.ListStubs()
+	if err != nil {
+		return nil, err
+	}
+	storage := v.storage()
+	var findings []SecretFinding
+	for _, key := range keys {
+		stub, err := readStub(storage, key+".vcr.har")
+		if err == nil {
+			err = v.checkPending(storage, key)
+		}
+		if err != nil {
+			findings = append(findings, unscannedStub(key, err))
+			continue
+		}
+		add := func(location, text string) {
+			findings = append(findings, scanText(key, location, text)...)
+		}
+		add("request url", stub.Request.URL)
+		findings = append(findings, scanHeaders(key, "request", stub.Request.Headers)...)
+		add("request body", string(stub.Request.Body))
+		for i, resp := range stub.Sequence {
+			side := "response"
+			if len(stub.Sequence) > 1 {
+				side = fmt.Sprintf("response %d", i+1)
+			}
+			findings = append(findings, scanHeaders(key, side, resp.Headers)...)
+			body, err := storage.ReadFile(sequenceBlobPath(stub.HARName, i))
+			if err != nil {
+				findings = append(findings, unscannedStub(key, incompleteStub(stub, err)))
+				continue
+			}
+			add(side+" body", string(body))
+		}
+	}
+	return findings, nil
+}
+
+// unscannedStub reports a stub that could not be scanned.
+func unscannedStub(key string, err error) SecretFinding {
+	rule := "unreadable-stub"
+	if errors.Is(err, ErrIncompleteStub) {
+		rule = "incomplete-stub"
+	}
+	return SecretFinding{Stub: key, Location: "stub", Rule: rule, Excerpt: err.Error()}
+}
+
+func scanHeaders(key, side string, h http.Header) []SecretFinding {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var findings []SecretFinding
+	for _, name := range names {
+		location := side + " header " + name
+		for _, val := range h[name] {
+			if isSensitiveHeader(name) && val != RedactedValue {
+				findings = append(findings, SecretFinding{Stub: key, Location: location, Rule: "sensitive-header", Excerpt: excerpt(val)})
+				continue
+			}
+			findings = append(findings, scanText(key, location, val)...)
+		}
+	}
+	return findings
+}
+
+func scanText(key, location, text string) []SecretFinding {
+	if text == "" {
+		return nil
+	}
+	var findings []SecretFinding
+	for _, rule := range secretRules {
+		for _, match := range rule.re.FindAllString(text, -1) {
+			if strings.Contains(match, RedactedValue) {
+				continue
+			}
+			findings = append(findings, SecretFinding{Stub: key, Location: location, Rule: rule.name, Excerpt: excerpt(match)})
+		}
+	}
+	return findings
+}
+
+func isSensitiveHeader(name string) bool {
+	for _, s := range sensitiveHeaders {
+		if strings.EqualFold(s, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// excerpt keeps the first few characters of a match: at most 8, and at most
+// half of it, cut on a rune boundary.
+func excerpt(s string) string {
+	keep := min(8, len(s)/2)
+	for keep > 0 && !utf8.RuneStart(s[keep]) {
+		keep--
+	}
+	return s[:keep] + "..."
+}
@@ -0,0 +1,99 @@
+package runtime
+
+import (
+	"maps"
+	"net/http"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestScanStubsFlagsLikelySecrets(t *testing.T) {
+	store, err := NewWithStorage(memoryStorageWithPolicy(t, `{"upstream":"https://example.com"}`))
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	leaky := []byte(`{"access_token":"abcdef123456","owner":"ann@example.com","note":"ok"}`)
+	if err := store.WriteStub("Leaky", RequestSpec{URL: "https://example.com/leaky"}, ResponseMeta{
+		Status:  200,
+		Headers: http.Header{"Set-Cookie": {"sid=0123456789"}},
+	}, leaky); err != nil {
+		t.Fatalf("write stub: %v", err)
+	}
+	clean := []byte(`{"access_token":"[REDACTED]","note":"ok"}`)
+	if err := store.WriteStub("Clean", RequestSpec{URL: "https://example.com/clean"}, ResponseMeta{Status: 200}, clean); err != nil {
+		t.Fatalf("write stub: %v", err)
+	}
+
+	findings, err := store.ScanStubs()
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	rules := map[string]string{}
+	for _, f := range findings {
+		if f.Stub != "Leaky" {
+			t.Fatalf("unexpected finding in %s: %+v", f.Stub, f)
+		}
+		rules[f.Rule] = f.Location
+	}
+	want := map[string]string{
+		"sensitive-header": "response header Set-Cookie",
+		"secret-field":     "response body",
+		"email":            "response body",
+	}
+	for rule, location := range want {
+		if rules[rule] != location {
+			t.Fatalf("expected %s finding in %s, got %+v", rule, location, findings)
+		}
+	}
+	for _, f := range findings {
+		if f.Excerpt == "sid=0123456789" || len(f.Excerpt) > 11 {
+			t.Fatalf("expected excerpt to elide the secret, got %q", f.Excerpt)
+		}
+	}
+}
+
+func TestScanStubsReportsIncompleteStubs(t *testing.T) {
+	storage := memoryStorageWithPolicy(t, `{"upstream":"https://example.com"}`)
+	store, err := NewWithStorage(storage)
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	for _, name := range []string{"Broken", "Leaky", "Pending", "Torn"} {
+		body := []byte(`{"owner":"ann@example.com"}`)
+		if err := store.WriteStub(name, RequestSpec{URL: "https://example.com/" + name}, ResponseMeta{Status: 200}, body); err != nil {
+			t.Fatalf("write stub: %v", err)
+		}
+	}
+	if err := storage.WriteFile("Broken.vcr.har", []byte("{")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := storage.WriteFile(pendingName("Pending"), []byte("pid 42")); err != nil {
+		t.Fatalf("write marker: %v", err)
+	}
+	if err := storage.Remove("Torn.vcr.json"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+
+	findings, err := store.ScanStubs()
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	got := map[string]string{}
+	for _, f := range findings {
+		got[f.Stub] = f.Rule
+	}
+	want := map[string]string{"Broken": "unreadable-stub", "Leaky": "email", "Pending": "incomplete-stub", "Torn": "incomplete-stub"}
+	if !maps.Equal(got, want) {
+		t.Fatalf("unexpected findings: %+v", findings)
+	}
+}
+
+func TestExcerptKeepsWholeRunes(t *testing.T) {
+	for _, s := range []string{"ééééééééé", "a€€€€€€", "sid=0123456789", "日本語"} {
+		got := excerpt(s)
+		if !utf8.ValidString(got) || !strings.HasSuffix(got, "...") || strings.TrimSuffix(got, "...") == s {
+			t.Fatalf("unexpected excerpt of %q: %q", s, got)
+		}
+	}
+}
@@ -1,33 +1,57 @@
 package runtime
 
-import "goa.design/clue/mock"
+import (
+	"sync"
+
+	"goa.design/clue/mock"
+)
 
 // Scenario is a name-keyed queue of handlers, backed by clue/mock.Mock.
 //
+// Copies of a scenario share its handlers, so a scenario passed by value to a
+// playback handler still sees later calls to Replace.
+//
 // Generated code typically provides typed wrapper methods (Set*/Add*) around
 // these primitives.
 type Scenario struct {
-	m *mock.Mock
+	state *scenarioState
+}
+
+// scenarioState holds the handlers shared by copies of a Scenario.
+type scenarioState struct {
+	mu sync.RWMutex
+	m  *mock.Mock
 }
 
 // NewScenario returns a scenario backed by clue/mock.
 func NewScenario() Scenario {
-	return Scenario{m: mock.New()}
+	return Scenario{state: &scenarioState{m: mock.New()}}
 }
 
 func (s *Scenario) ensureMock() *mock.Mock {
-	if s.m == nil {
-		s.m = mock.New()
+	if s.state == nil {
+		s.state = &scenarioState{}
+	}
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+	if s.state.m == nil {
+		s.state.m = mock.New()
 	}
-	return s.m
+	return s.state.m
 }
 
 // Next returns the next handler for the named endpoint, if any.
 func (s Scenario) Next(name string) any {
-	if s.m == nil {
+	if s.state == nil {
 		return nil
 	}
-	return s.m.Next(name)
+	s.state.mu.RLock()
+	m := s.state.m
+	s.state.mu.RUnlock()
+	if m == nil {
+		return nil
+	}
+	return m.Next(name)
 }
 
 // Set sets the handler for name, overwriting any existing handler.
@@ -40,3 +64,21 @@ func (s *Scenario) Add(name string, handler any) {
 	s.ensureMock().Add(name, handler)
 }
 
+// Replace swaps the handlers of s, and of every copy of s, for those of other.
+// Handlers already queued in s are dropped.
+func (s *Scenario) Replace(other Scenario) {
+	var m *mock.Mock
+	if other.state != nil {
+		other.state.mu.RLock()
+		m = other.state.m
+		other.state.mu.RUnlock()
+	}
+	if m == nil {
+		m = mock.New()
+	}
+	s.ensureMock()
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+	s.state.m = m
+}
+
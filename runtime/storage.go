@@ -3,11 +3,30 @@ package runtime
 import (
 	"errors"
 	"fmt"
+	"net/http"
 	"os"
-	"path/filepath"
 	"strings"
+	"time"
 )
 
+// ErrSequenceExhausted is returned when every response of a stub sequence has
+// been served and the endpoint's sequence end policy is SequenceEndError.
+var ErrSequenceExhausted = errors.New("vcr: stub sequence exhausted")
+
+// ErrIncompleteStub is returned when a stub was only partly written, because
+// its recorder is still writing it or died midway: its HAR has no blob, or a
+// pending marker naming the recorder's pid is present. Recording the stub again
+// repairs it; removing the marker left by a crashed recorder serves the old
+// stub instead.
+var ErrIncompleteStub = errors.New("vcr: incomplete stub")
+
+// pendingName returns the name of the marker a recorder writes before the
+// files of the stub key and removes once they are all written. Like other dot
+// files, DirStorage.List leaves it out, so Watchers do not see it.
+func pendingName(key string) string {
+	return "." + key + ".vcr.pending"
+}
+
 // HasStub reports whether a stub exists for the endpoint and optional diversifier.
 func (v *VCR) HasStub(endpointName string, diversifier ...string) (bool, error) {
 	div, err := diversifierFromArgs(diversifier)
@@ -38,66 +57,416 @@ func (v *VCR) ReadRequest(endpointName string, diversifier ...string) (RequestSp
 }
 
 // ReadResponse resolves a stub by endpoint name and optional diversifier and returns the response metadata and JSON body.
+// If the stub body is templated, the template is returned unrendered and ResponseMeta.Template is set.
 func (v *VCR) ReadResponse(endpointName string, diversifier ...string) (ResponseMeta, []byte, error) {
 	div, err := diversifierFromArgs(diversifier)
 	if err != nil {
 		return ResponseMeta{}, nil, err
 	}
+	v.writeMu.RLock()
+	defer v.writeMu.RUnlock()
 	stub, err := v.findStub(endpointName, div)
 	if err != nil {
 		return ResponseMeta{}, nil, err
 	}
-	body, err := v.readStubBody(stub)
+	resp := stub.Response
+	body, err := v.readBlob(stub.BlobName, &resp)
 	if err != nil {
+		return ResponseMeta{}, nil, incompleteStub(stub, err)
+	}
+	if err := v.checkPending(v.storage(), strings.TrimSuffix(stub.HARName, ".vcr.har")); err != nil {
 		return ResponseMeta{}, nil, err
 	}
-	return stub.Response, body, nil
+	return resp, body, nil
 }
 
-// WriteStub writes a stub (HAR + JSON) into the root with an optional diversifier.
+// WriteStub writes a stub (HAR + JSON) into storage with an optional diversifier.
+// The policy's redact rules are applied first. Each file is replaced
+// atomically and, until both are written, a marker makes readers report
+// ErrIncompleteStub rather than pair the new blob with the old HAR.
 func (v *VCR) WriteStub(endpointName string, req RequestSpec, resp ResponseMeta, body []byte, diversifier ...string) error {
 	div, err := diversifierFromArgs(diversifier)
 	if err != nil {
 		return err
 	}
-	root := v.writeRoot()
-	if root == "" {
-		return fmt.Errorf("no write root configured")
+	req, resp, body = v.CurrentPolicy().Redact.apply(req, resp, body)
+	storage := v.storage()
+	if storage == nil {
+		return fmt.Errorf("no storage configured")
+	}
+	unlock, err := v.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	key := stubKey(endpointName, div)
+	harName := key + ".vcr.har"
+	jsonName := blobPathForHARPath(harName)
+	if err := beginStub(storage, key); err != nil {
+		return err
 	}
 
-	harPath := filepath.Join(root, stubKey(endpointName, div)+".vcr.har")
-	jsonPath := blobPathForHARPath(harPath)
+	// Replacing a sequence leaves only its first blob in use.
+	if old, err := readStub(v.backend(), harName); err == nil {
+		for i := 1; i < len(old.Sequence); i++ {
+			if err := storage.Remove(sequenceBlobPath(harName, i)); err != nil {
+				return err
+			}
+		}
+	}
 
-	if err := os.WriteFile(jsonPath, body, 0600); err != nil {
-		return fmt.Errorf("write %s: %w", jsonPath, err)
+	if err := storage.WriteFile(jsonName, body); err != nil {
+		return fmt.Errorf("write %s: %w", jsonName, err)
+	}
+	if err := writeStub(storage, harName, req, resp); err != nil {
+		return err
+	}
+	return endStub(storage, key)
+}
+
+// AppendStub adds a response to the stub's sequence, creating the stub if it
+// does not exist. The policy's redact rules are applied first.
+func (v *VCR) AppendStub(endpointName string, req RequestSpec, resp ResponseMeta, body []byte, diversifier ...string) error {
+	div, err := diversifierFromArgs(diversifier)
+	if err != nil {
+		return err
+	}
+	storage := v.storage()
+	if storage == nil {
+		return fmt.Errorf("no storage configured")
+	}
+	req, resp, body = v.CurrentPolicy().Redact.apply(req, resp, body)
+	unlock, err := v.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	key := stubKey(endpointName, div)
+	harName := key + ".vcr.har"
+	next := 0
+	if old, err := readStub(v.backend(), harName); err == nil {
+		next = len(old.Sequence)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
 	}
-	if err := writeStub(harPath, req, resp); err != nil {
+	if err := beginStub(storage, key); err != nil {
 		return err
 	}
+	jsonName := sequenceBlobPath(harName, next)
+	if err := storage.WriteFile(jsonName, body); err != nil {
+		return fmt.Errorf("write %s: %w", jsonName, err)
+	}
+	if _, err := appendStub(storage, harName, req, resp); err != nil {
+		return err
+	}
+	return endStub(storage, key)
+}
+
+// beginStub marks the stub key as being written. The marker names the
+// writing process, to help clean up after a recorder that died.
+func beginStub(storage Storage, key string) error {
+	name := pendingName(key)
+	marker := fmt.Sprintf("pid %d at %s\n", os.Getpid(), time.Now().UTC().Format(time.RFC3339))
+	if err := storage.WriteFile(name, []byte(marker)); err != nil {
+		return fmt.Errorf("write %s: %w", name, err)
+	}
+	return nil
+}
+
+// endStub removes the marker written by beginStub.
+func endStub(storage Storage, key string) error {
+	name := pendingName(key)
+	if err := storage.Remove(name); err != nil {
+		return fmt.Errorf("remove %s: %w", name, err)
+	}
+	return nil
+}
+
+// incompleteStub reports a missing blob of an existing stub as
+// ErrIncompleteStub; other errors are returned as is.
+func incompleteStub(s *stub, err error) error {
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	key := strings.TrimSuffix(s.HARName, ".vcr.har")
+	return fmt.Errorf("%s: %w: %v", key, ErrIncompleteStub, err)
+}
+
+// ResetSequences rewinds the playback cursors of the given stub keys (endpoint
+// name plus optional "--" diversifier), or of every stub if none is given, so
+// their sequences replay from the first response.
+func (v *VCR) ResetSequences(keys ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(keys) == 0 {
+		v.cursors = nil
+		return
+	}
+	for _, key := range keys {
+		delete(v.cursors, key)
+	}
+}
+
+// nextResponse resolves a stub like ReadResponse but walks its sequence: each
+// call returns the next recorded response, then follows the endpoint's
+// sequence end policy. It also returns the key of the stub that answered.
+func (v *VCR) nextResponse(endpointName, diversifier string) (ResponseMeta, []byte, string, error) {
+	v.writeMu.RLock()
+	defer v.writeMu.RUnlock()
+	stub, err := v.findStub(endpointName, diversifier)
+	if err != nil {
+		return ResponseMeta{}, nil, "", err
+	}
+	key := strings.TrimSuffix(stub.HARName, ".vcr.har")
+	if len(stub.Sequence) <= 1 {
+		resp := stub.Response
+		body, err := v.readBlob(stub.BlobName, &resp)
+		if err != nil {
+			return ResponseMeta{}, nil, key, incompleteStub(stub, err)
+		}
+		if err := v.checkPending(v.storage(), key); err != nil {
+			return ResponseMeta{}, nil, key, err
+		}
+		v.markServed(key)
+		return resp, body, key, nil
+	}
+
+	v.mu.Lock()
+	if v.cursors == nil {
+		v.cursors = map[string]int{}
+	}
+	i := v.cursors[key]
+	v.cursors[key] = i + 1
+	v.mu.Unlock()
+
+	n := len(stub.Sequence)
+	if i >= n {
+		switch v.CurrentPolicy().SequenceEnd(endpointName) {
+		case SequenceEndCycle:
+			i %= n
+		case SequenceEndError:
+			return ResponseMeta{}, nil, key, fmt.Errorf("%s: %w", key, ErrSequenceExhausted)
+		default:
+			i = n - 1
+		}
+	}
+	resp := stub.Sequence[i]
+	body, err := v.readBlob(sequenceBlobPath(stub.HARName, i), &resp)
+	if err != nil {
+		return ResponseMeta{}, nil, key, incompleteStub(stub, err)
+	}
+	if err := v.checkPending(v.storage(), key); err != nil {
+		return ResponseMeta{}, nil, key, err
+	}
+	v.markServed(key)
+	return resp, body, key, nil
+}
+
+// ListStubs returns the keys (endpoint name plus optional "--" diversifier) of
+// every stub in storage.
+func (v *VCR) ListStubs() ([]string, error) {
+	storage := v.storage()
+	if storage == nil {
+		return nil, nil
+	}
+	names, err := storage.List()
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, name := range names {
+		if key, ok := strings.CutSuffix(name, ".vcr.har"); ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// hasEndpointStubs reports whether any stub exists for the endpoint, whatever
+// its diversifier.
+func (v *VCR) hasEndpointStubs(endpointName string) (bool, error) {
+	keys, err := v.ListStubs()
+	if err != nil {
+		return false, err
+	}
+	for _, key := range keys {
+		if key == endpointName || strings.HasPrefix(key, endpointName+"--") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// deleteEndpointStubs removes every stub file of the endpoint, whatever its
+// diversifier.
+func (v *VCR) deleteEndpointStubs(endpointName string) error {
+	storage := v.storage()
+	if storage == nil {
+		return nil
+	}
+	unlock, err := v.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	names, err := v.backend().List()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if name == PolicyFileName {
+			continue
+		}
+		key, ok := stubKeyForName(name)
+		if !ok || (key != endpointName && !strings.HasPrefix(key, endpointName+"--")) {
+			continue
+		}
+		if err := storage.Remove(name); err != nil {
+			return err
+		}
+		if strings.HasSuffix(name, ".vcr.har") {
+			if err := storage.Remove(pendingName(key)); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
 func (v *VCR) findStub(endpointName string, diversifier string) (*stub, error) {
-	if v.Root == "" {
+	storage := v.storage()
+	if storage == nil {
 		return nil, os.ErrNotExist
 	}
-	harPath := filepath.Join(v.Root, stubKey(endpointName, diversifier)+".vcr.har")
-	stub, err := readStub(harPath)
+	key := stubKey(endpointName, diversifier)
+	stub, err := v.readStub(key + ".vcr.har")
 	if err == nil {
 		return stub, nil
 	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	v.mu.RLock()
+	alias, ok := v.aliases[key]
+	v.mu.RUnlock()
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	stub, err = v.readStub(alias + ".vcr.har")
 	if errors.Is(err, os.ErrNotExist) {
 		return nil, os.ErrNotExist
 	}
-	return nil, err
+	return stub, err
+}
+
+// checkPending returns ErrIncompleteStub if the stub key is marked as being
+// written, by another process or by a recorder that died. Reads check it once
+// their files are read, so that a write starting meanwhile is noticed.
+func (v *VCR) checkPending(storage Storage, key string) error {
+	marker, err := storage.ReadFile(pendingName(key))
+	if err != nil {
+		return nil
+	}
+	return fmt.Errorf("%s: %w: written by %s", key, ErrIncompleteStub, strings.TrimSpace(string(marker)))
+}
+
+// IndexStubs records, for every stub in storage, the keys the stub would have
+// under each naming style, so that lookups find stubs recorded before the names
+// policy changed. The matcher resolves each stub's endpoint and route params
+// from its recorded request.
+func (v *VCR) IndexStubs(matcher *RouteMatcher) error {
+	storage := v.storage()
+	if storage == nil || matcher == nil {
+		return nil
+	}
+	keys, err := v.ListStubs()
+	if err != nil {
+		return err
+	}
+	policy := v.CurrentPolicy()
+	aliases := map[string]string{}
+	for _, key := range keys {
+		stub, err := v.readStub(key + ".vcr.har")
+		if err != nil {
+			// Unreadable stubs are only found under their own name.
+			continue
+		}
+		method := stub.Request.Method
+		if method == "" {
+			method = http.MethodGet
+		}
+		req, err := http.NewRequest(method, stub.Request.URL, nil)
+		if err != nil {
+			continue
+		}
+		endpointName, vars, ok := matcher.Match(req)
+		if !ok {
+			continue
+		}
+		for _, style := range []NameStyle{NameStyleHash, NameStyleReadable} {
+			div := requestDiversifier(policy, endpointName, req.URL.Query(), vars, stub.Request.Body, stub.Request.Headers, style)
+			alias := stubKey(endpointName, div)
+			if _, taken := aliases[alias]; alias != key && !taken {
+				aliases[alias] = key
+			}
+		}
+	}
+
+	v.mu.Lock()
+	v.aliases = aliases
+	v.indexed = true
+	v.mu.Unlock()
+	return nil
 }
 
-func (v *VCR) readStubBody(stub *stub) ([]byte, error) {
-	return os.ReadFile(stub.BlobPath)
+// indexStubsOnce builds the alias index on first use. If the scan fails, stubs
+// are only found under their own names.
+func (v *VCR) indexStubsOnce(matcher *RouteMatcher) {
+	v.mu.RLock()
+	indexed := v.indexed
+	v.mu.RUnlock()
+	if indexed {
+		return
+	}
+	if err := v.IndexStubs(matcher); err != nil {
+		v.mu.Lock()
+		v.indexed = true
+		v.mu.Unlock()
+	}
 }
 
-func (v *VCR) writeRoot() string {
-	return v.Root
+// readBlob reads a stub body, preferring the template name+TemplateExt if one
+// exists, in which case it sets resp.Template.
+func (v *VCR) readBlob(name string, resp *ResponseMeta) ([]byte, error) {
+	storage := v.storage()
+	body, err := storage.ReadFile(name + TemplateExt)
+	if err == nil {
+		resp.Template = true
+		return body, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return storage.ReadFile(name)
+}
+
+// storage returns the stub cache once stubs are preloaded, else the backend.
+func (v *VCR) storage() Storage {
+	if c := v.cache.Load(); c != nil {
+		return c
+	}
+	return v.backend()
+}
+
+// backend returns the configured backend, defaulting to Root on disk for
+// stores built without New.
+func (v *VCR) backend() Storage {
+	if v.Storage == nil && v.Root != "" {
+		return NewDirStorage(v.Root)
+	}
+	return v.Storage
 }
 
 func diversifierFromArgs(args []string) (string, error) {
@@ -0,0 +1,231 @@
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrReadOnlyStorage is returned when writing to a Storage that cannot be
+// modified, such as an embedded file system.
+var ErrReadOnlyStorage = errors.New("vcr: storage is read-only")
+
+// Storage is the backend holding vcr.json and stub files. Names are flat file
+// names such as "GetThing--q-1a2b.vcr.har"; the backend decides where they live.
+type Storage interface {
+	// ReadFile returns the contents of name. A missing file yields an error
+	// matching fs.ErrNotExist.
+	ReadFile(name string) ([]byte, error)
+	// WriteFile creates or replaces name. Readers should see either the old
+	// or the new contents, never a partial write.
+	WriteFile(name string, data []byte) error
+	// Remove deletes name. Removing a missing file is not an error.
+	Remove(name string) error
+	// List returns the names of all files in sorted order.
+	List() ([]string, error)
+}
+
+// LockingStorage is a Storage that several processes may share. VCR holds its
+// lock while it writes stubs or vcr.json.
+type LockingStorage interface {
+	Storage
+	// Lock waits until no other process holds the lock, takes it and returns
+	// the func that releases it.
+	Lock() (unlock func(), err error)
+}
+
+// lockFileName is the file DirStorage locks. Like other dot files, List
+// leaves it out.
+const lockFileName = ".vcr.lock"
+
+// DirStorage stores files in a directory on disk. Files are replaced
+// atomically, and Lock takes an advisory lock on the directory.
+type DirStorage struct {
+	// Dir is the directory holding policy and stubs.
+	Dir string
+}
+
+// NewDirStorage returns a Storage backed by dir.
+func NewDirStorage(dir string) *DirStorage {
+	return &DirStorage{Dir: dir}
+}
+
+func (s *DirStorage) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(s.Dir, name))
+}
+
+func (s *DirStorage) WriteFile(name string, data []byte) error {
+	return writeFileAtomic(filepath.Join(s.Dir, name), data, 0600)
+}
+
+// Lock takes an advisory lock on the directory, shared with other processes
+// that use a DirStorage for it. It does nothing on platforms without flock.
+func (s *DirStorage) Lock() (func(), error) {
+	f, err := os.OpenFile(filepath.Join(s.Dir, lockFileName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("lock %s: %w", s.Dir, err)
+	}
+	if err := lockFile(f); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("lock %s: %w", s.Dir, err)
+	}
+	return func() {
+		_ = unlockFile(f)
+		_ = f.Close()
+	}, nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path, flushes it to
+// disk and renames it over path, so that readers see either the old or the
+// new contents even if the process dies midway.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	committed := false
+	defer func() {
+		if !committed {
+			_ = os.Remove(tmp)
+		}
+	}()
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	committed = true
+	return nil
+}
+
+func (s *DirStorage) Remove(name string) error {
+	err := os.Remove(filepath.Join(s.Dir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// List leaves out directories and dot files, such as the lock file and the
+// temporary files of writes in progress.
+func (s *DirStorage) List() ([]string, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	return names, nil
+}
+
+// FSStorage serves files from the top level of an fs.FS and rejects writes.
+// Use it with fs.Sub to play back stubs embedded via //go:embed.
+type FSStorage struct {
+	FS fs.FS
+}
+
+// NewFSStorage returns a read-only Storage backed by fsys.
+func NewFSStorage(fsys fs.FS) *FSStorage {
+	return &FSStorage{FS: fsys}
+}
+
+func (s *FSStorage) ReadFile(name string) ([]byte, error) {
+	return fs.ReadFile(s.FS, name)
+}
+
+func (s *FSStorage) WriteFile(name string, data []byte) error {
+	return fmt.Errorf("write %s: %w", name, ErrReadOnlyStorage)
+}
+
+func (s *FSStorage) Remove(name string) error {
+	return fmt.Errorf("remove %s: %w", name, ErrReadOnlyStorage)
+}
+
+func (s *FSStorage) List() ([]string, error) {
+	entries, err := fs.ReadDir(s.FS, ".")
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	return names, nil
+}
+
+// MemoryStorage keeps files in memory. It is safe for concurrent use and is
+// mostly useful in unit tests.
+type MemoryStorage struct {
+	mu    sync.RWMutex
+	files map[string][]byte
+}
+
+// NewMemoryStorage returns an empty in-memory Storage.
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{files: map[string][]byte{}}
+}
+
+func (s *MemoryStorage) ReadFile(name string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	data, ok := s.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func (s *MemoryStorage) WriteFile(name string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.files == nil {
+		s.files = map[string][]byte{}
+	}
+	s.files[name] = append([]byte(nil), data...)
+	return nil
+}
+
+func (s *MemoryStorage) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.files, name)
+	return nil
+}
+
+func (s *MemoryStorage) List() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.files))
+	for name := range s.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
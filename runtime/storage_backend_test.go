@@ -0,0 +1,278 @@
+package runtime
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+)
+
+func TestStorageImplementationsRoundTrip(t *testing.T) {
+	backends := map[string]Storage{
+		"dir":    NewDirStorage(t.TempDir()),
+		"memory": NewMemoryStorage(),
+	}
+	for name, storage := range backends {
+		t.Run(name, func(t *testing.T) {
+			if _, err := storage.ReadFile("missing.vcr.har"); !errors.Is(err, fs.ErrNotExist) {
+				t.Fatalf("expected fs.ErrNotExist, got %v", err)
+			}
+			if err := storage.WriteFile("b.vcr.json", []byte("{}")); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			if err := storage.WriteFile("a.vcr.har", []byte("{}")); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			names, err := storage.List()
+			if err != nil {
+				t.Fatalf("list: %v", err)
+			}
+			if !slices.Equal(names, []string{"a.vcr.har", "b.vcr.json"}) {
+				t.Fatalf("unexpected names: %v", names)
+			}
+			if err := storage.Remove("a.vcr.har"); err != nil {
+				t.Fatalf("remove: %v", err)
+			}
+			if err := storage.Remove("a.vcr.har"); err != nil {
+				t.Fatalf("remove missing: %v", err)
+			}
+			if data, err := storage.ReadFile("b.vcr.json"); err != nil || string(data) != "{}" {
+				t.Fatalf("unexpected read: %q, %v", data, err)
+			}
+		})
+	}
+}
+
+func TestFSStorageServesStubsReadOnly(t *testing.T) {
+	mem := NewMemoryStorage()
+	if err := mem.WriteFile(PolicyFileName, []byte(`{"upstream":"https://example.com"}`)); err != nil {
+		t.Fatalf("write policy: %v", err)
+	}
+	recorder, err := NewWithStorage(mem)
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	body := []byte("{\"ok\":true}\n")
+	if err := recorder.WriteStub("Known", RequestSpec{URL: "http://example.com/known"}, ResponseMeta{
+		Status:   200,
+		MimeType: "application/json",
+		Size:     len(body),
+	}, body); err != nil {
+		t.Fatalf("write stub: %v", err)
+	}
+
+	// Copy the recorded files into an fs.FS, as //go:embed would.
+	fsys := fstest.MapFS{}
+	names, _ := mem.List()
+	for _, name := range names {
+		data, _ := mem.ReadFile(name)
+		fsys[name] = &fstest.MapFile{Data: data}
+	}
+
+	store, err := NewWithStorage(NewFSStorage(fsys))
+	if err != nil {
+		t.Fatalf("new fs store: %v", err)
+	}
+	keys, err := store.ListStubs()
+	if err != nil || !slices.Equal(keys, []string{"Known"}) {
+		t.Fatalf("unexpected stubs: %v, %v", keys, err)
+	}
+
+	d := NewStubDoer(store, []Endpoint{
+		{Name: "Known", Method: http.MethodGet, Pattern: "/known"},
+	})
+	resp, err := d.Do(mustRequest(t, http.MethodGet, "http://example.com/known"))
+	if err != nil {
+		t.Fatalf("do: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %d", resp.StatusCode)
+	}
+
+	if err := store.WritePolicy(); !errors.Is(err, ErrReadOnlyStorage) {
+		t.Fatalf("expected ErrReadOnlyStorage, got %v", err)
+	}
+}
+
+func TestDirStorageReplacesFilesAtomically(t *testing.T) {
+	dir := t.TempDir()
+	storage := NewDirStorage(dir)
+	for _, body := range []string{`{"v":1}`, `{"v":2}`} {
+		if err := storage.WriteFile("a.vcr.json", []byte(body)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	unlock, err := storage.Lock()
+	if err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+	unlock()
+	if err := os.WriteFile(filepath.Join(dir, ".a.vcr.json.123.tmp"), []byte("{"), 0600); err != nil {
+		t.Fatalf("write temp: %v", err)
+	}
+	if err := storage.WriteFile(pendingName("a"), []byte("pid 1")); err != nil {
+		t.Fatalf("write marker: %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("read dir: %v", err)
+	}
+	var files []string
+	for _, e := range entries {
+		files = append(files, e.Name())
+	}
+	if !slices.Equal(files, []string{".a.vcr.json.123.tmp", ".a.vcr.pending", ".vcr.lock", "a.vcr.json"}) {
+		t.Fatalf("unexpected files: %q", files)
+	}
+	if names, err := storage.List(); err != nil || !slices.Equal(names, []string{"a.vcr.json"}) {
+		t.Fatalf("expected dot files to be left out, got %q %v", names, err)
+	}
+	if data, err := storage.ReadFile("a.vcr.json"); err != nil || string(data) != `{"v":2}` {
+		t.Fatalf("unexpected read: %q %v", data, err)
+	}
+}
+
+func TestIncompleteStubsAreReported(t *testing.T) {
+	storage := memoryStorageWithPolicy(t, `{"upstream":"https://example.com"}`)
+	store, err := NewWithStorage(storage)
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	write := func(body string) {
+		t.Helper()
+		if err := store.WriteStub("GetThing", RequestSpec{URL: "http://example.com/things"}, ResponseMeta{Status: 200, MimeType: "application/json", Size: len(body)}, []byte(body)); err != nil {
+			t.Fatalf("write stub: %v", err)
+		}
+	}
+	write(`{}`)
+	if names, _ := storage.List(); slices.Contains(names, pendingName("GetThing")) {
+		t.Fatalf("expected the pending marker to be removed, got %q", names)
+	}
+
+	// A recorder died between the blob and the HAR.
+	if err := storage.WriteFile(pendingName("GetThing"), []byte("pid 42")); err != nil {
+		t.Fatalf("write marker: %v", err)
+	}
+	if _, _, err := store.ReadResponse("GetThing"); !errors.Is(err, ErrIncompleteStub) || !strings.Contains(err.Error(), "pid 42") {
+		t.Fatalf("expected an incomplete stub, got %v", err)
+	}
+	d := NewStubDoer(store, []Endpoint{{Name: "GetThing", Method: http.MethodGet, Pattern: "/things"}})
+	resp, err := d.Do(mustRequest(t, http.MethodGet, "http://example.com/things"))
+	if err != nil {
+		t.Fatalf("do: %v", err)
+	}
+	if body, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusInternalServerError || !strings.Contains(string(body), "incomplete stub") {
+		t.Fatalf("unexpected response: %d %s", resp.StatusCode, body)
+	}
+
+	// Recording the stub again repairs it.
+	write(`{"v":2}`)
+	if _, body, err := store.ReadResponse("GetThing"); err != nil || string(body) != `{"v":2}` {
+		t.Fatalf("expected the stub to be repaired, got %q %v", body, err)
+	}
+
+	// A HAR without its blob is incomplete too.
+	if err := storage.Remove("GetThing.vcr.json"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if _, _, err := store.ReadResponse("GetThing"); !errors.Is(err, ErrIncompleteStub) {
+		t.Fatalf("expected an incomplete stub, got %v", err)
+	}
+}
+
+func TestConcurrentWritesNeverServeMismatchedStubs(t *testing.T) {
+	store, err := New(writePolicyDir(t, `{"upstream":"https://example.com"}`))
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	write := func(n int) error {
+		body := `"` + strings.Repeat("x", n) + `"`
+		return store.WriteStub("GetThing", RequestSpec{URL: "http://example.com/things"}, ResponseMeta{Status: 200, MimeType: "application/json", Size: len(body)}, []byte(body))
+	}
+	if err := write(0); err != nil {
+		t.Fatalf("write stub: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for w := range 2 {
+		wg.Go(func() {
+			for i := range 200 {
+				if err := write(w*200 + i); err != nil {
+					t.Errorf("write stub: %v", err)
+					return
+				}
+			}
+		})
+	}
+	for range 4 {
+		wg.Go(func() {
+			for range 2000 {
+				meta, body, err := store.ReadResponse("GetThing")
+				if err != nil {
+					t.Errorf("read: %v", err)
+					return
+				}
+				if meta.Size != len(body) {
+					t.Errorf("mismatched stub: size %d, body %d bytes", meta.Size, len(body))
+					return
+				}
+			}
+		})
+	}
+	wg.Wait()
+}
+
+func TestWritePolicyDetectsConcurrentEdits(t *testing.T) {
+	dir := writePolicyDir(t, `{"upstream":"https://example.com"}`)
+	store, err := New(dir)
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	other, err := New(dir)
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	other.UpdatePolicy(func(p *Policy) { p.Fallback = true })
+	if err := other.WritePolicy(); err != nil {
+		t.Fatalf("write policy: %v", err)
+	}
+
+	store.UpdatePolicy(func(p *Policy) { p.Names = NameStyleReadable })
+	if err := store.WritePolicy(); !errors.Is(err, ErrPolicyConflict) {
+		t.Fatalf("expected a conflict, got %v", err)
+	}
+	if err := store.UpdatePolicyFile(func(p *Policy) { p.SetVariantQuery("GetThing", false) }); err != nil {
+		t.Fatalf("update policy file: %v", err)
+	}
+	policy, _, err := readPolicy(NewDirStorage(dir))
+	if err != nil {
+		t.Fatalf("read policy: %v", err)
+	}
+	if enabled, explicit := policy.QueryVariantEnabled("GetThing"); !policy.Fallback || enabled || !explicit {
+		t.Fatalf("expected both edits on disk, got %+v", policy)
+	}
+	if enabled, _ := store.CurrentPolicy().QueryVariantEnabled("GetThing"); enabled {
+		t.Fatalf("expected the update in memory")
+	}
+	if err := store.WritePolicy(); err != nil {
+		t.Fatalf("expected no conflict after the update, got %v", err)
+	}
+}
+
+// writePolicyDir returns a temporary directory holding vcr.json.
+func writePolicyDir(t *testing.T, policy string) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, PolicyFileName), []byte(policy), 0600); err != nil {
+		t.Fatalf("write policy: %v", err)
+	}
+	return dir
+}
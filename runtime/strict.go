@@ -0,0 +1,123 @@
+package runtime
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// StrictReport lists what makes a strict playback run fail: requests that
+// were not answered from a stub and stubs that answered no request.
+type StrictReport struct {
+	// Unmatched lists requests that matched no endpoint, as "METHOD /path".
+	Unmatched []string
+	// Unstubbed lists requests answered with 501 because no stub (or no
+	// further response of a sequence) exists, as "METHOD /path (stub key)".
+	Unstubbed []string
+	// Unused lists the keys of stubs in storage that were never served.
+	Unused []string
+}
+
+// OK reports whether playback was exhaustive.
+func (r StrictReport) OK() bool {
+	return len(r.Unmatched) == 0 && len(r.Unstubbed) == 0 && len(r.Unused) == 0
+}
+
+func (r StrictReport) String() string {
+	if r.OK() {
+		return "vcr strict: every request was served from a stub and every stub was served\n"
+	}
+	var b strings.Builder
+	section := func(title string, items []string) {
+		if len(items) == 0 {
+			return
+		}
+		fmt.Fprintf(&b, "%s (%d):\n", title, len(items))
+		for _, item := range items {
+			fmt.Fprintf(&b, "  %s\n", item)
+		}
+	}
+	section("vcr strict: unmatched requests", r.Unmatched)
+	section("vcr strict: unstubbed requests", r.Unstubbed)
+	section("vcr strict: unused stubs", r.Unused)
+	return b.String()
+}
+
+// StrictReport returns the requests that StubDoers in strict mode could not
+// answer from a stub, and the stubs in storage that no request was served from.
+func (v *VCR) StrictReport() (StrictReport, error) {
+	keys, err := v.ListStubs()
+	if err != nil {
+		return StrictReport{}, err
+	}
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	report := StrictReport{
+		Unmatched: slices.Clone(v.unmatched),
+		Unstubbed: slices.Clone(v.unstubbed),
+	}
+	for _, key := range keys {
+		if v.hits[key] == 0 {
+			report.Unused = append(report.Unused, key)
+		}
+	}
+	slices.Sort(report.Unused)
+	return report, nil
+}
+
+// markServed counts a request answered by the stub key.
+func (v *VCR) markServed(key string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.hits == nil {
+		v.hits = map[string]int{}
+	}
+	v.hits[key]++
+}
+
+// StubHits returns how many requests each stub key has answered. Stubs that
+// answered none are left out.
+func (v *VCR) StubHits() map[string]int {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return maps.Clone(v.hits)
+}
+
+// strictMiss records a request that a strict StubDoer could not answer from a
+// stub. An empty key means the request matched no endpoint. Repeated requests
+// are listed once.
+func (d *StubDoer) strictMiss(req *http.Request, key string) {
+	if !d.Strict {
+		return
+	}
+	v := d.Store
+	entry := req.Method + " " + req.URL.Path
+	list := &v.unmatched
+	if key != "" {
+		entry += " (" + key + ")"
+		list = &v.unstubbed
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if !slices.Contains(*list, entry) {
+		*list = append(*list, entry)
+	}
+}
+
+// StrictMiddleware records the requests that match none of d's endpoints when
+// d is in strict mode, since they never reach d.
+func StrictMiddleware(d *StubDoer, next http.Handler) http.Handler {
+	if next == nil {
+		return http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if d != nil && d.Strict && d.Store != nil && d.Matcher != nil {
+			if _, _, ok := d.Matcher.Match(r); !ok {
+				d.strictMiss(r, "")
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,75 @@
+package runtime
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestStrictReportListsMissesAndUnusedStubs(t *testing.T) {
+	store, err := NewWithStorage(memoryStorageWithPolicy(t, `{"upstream":"https://example.com","endpoints":{"Poll":{"sequence":{"end":"error"}}}}`))
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	body := []byte(`{}`)
+	meta := ResponseMeta{Status: 200, MimeType: "application/json", Size: len(body)}
+	for _, name := range []string{"Known", "Unused"} {
+		if err := store.WriteStub(name, RequestSpec{URL: "http://example.com/" + strings.ToLower(name)}, meta, body); err != nil {
+			t.Fatalf("write stub: %v", err)
+		}
+	}
+	if err := store.AppendStub("Poll", RequestSpec{URL: "http://example.com/poll"}, meta, body); err != nil {
+		t.Fatalf("append stub: %v", err)
+	}
+	if err := store.AppendStub("Poll", RequestSpec{URL: "http://example.com/poll"}, meta, body); err != nil {
+		t.Fatalf("append stub: %v", err)
+	}
+	d := NewStubDoer(store, []Endpoint{
+		{Name: "Known", Method: http.MethodGet, Pattern: "/known"},
+		{Name: "Missing", Method: http.MethodGet, Pattern: "/missing"},
+		{Name: "Poll", Method: http.MethodGet, Pattern: "/poll"},
+		{Name: "Unused", Method: http.MethodGet, Pattern: "/unused"},
+	})
+
+	// Misses are only recorded in strict mode.
+	if _, err := d.Do(mustRequest(t, http.MethodGet, "http://example.com/missing")); err != nil {
+		t.Fatalf("do: %v", err)
+	}
+	if report, _ := store.StrictReport(); len(report.Unstubbed) != 0 {
+		t.Fatalf("unexpected misses without strict mode: %+v", report)
+	}
+
+	d.Strict = true
+	for _, path := range []string{"/known", "/known", "/missing", "/missing", "/poll", "/poll", "/poll"} {
+		if _, err := d.Do(mustRequest(t, http.MethodGet, "http://example.com"+path)); err != nil {
+			t.Fatalf("do %s: %v", path, err)
+		}
+	}
+	srv := httptest.NewServer(StrictMiddleware(d, http.NotFoundHandler()))
+	defer srv.Close()
+	if resp, err := http.Get(srv.URL + "/nowhere"); err == nil {
+		_ = resp.Body.Close()
+	}
+
+	report, err := store.StrictReport()
+	if err != nil {
+		t.Fatalf("report: %v", err)
+	}
+	if report.OK() {
+		t.Fatalf("expected a failing report")
+	}
+	if !slices.Equal(report.Unmatched, []string{"GET /nowhere"}) {
+		t.Fatalf("unexpected unmatched: %q", report.Unmatched)
+	}
+	if !slices.Equal(report.Unstubbed, []string{"GET /missing (Missing)", "GET /poll (Poll)"}) {
+		t.Fatalf("unexpected unstubbed: %q", report.Unstubbed)
+	}
+	if !slices.Equal(report.Unused, []string{"Unused"}) {
+		t.Fatalf("unexpected unused: %q", report.Unused)
+	}
+	if s := report.String(); !strings.Contains(s, "unused stubs (1):\n  Unused\n") {
+		t.Fatalf("unexpected report:\n%s", s)
+	}
+}
@@ -2,11 +2,17 @@ package runtime
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"io"
+	"math/rand/v2"
 	"net/http"
+	"net/url"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 // StubDoer serves HTTP responses from VCR stubs by matching requests against a
@@ -14,6 +20,39 @@ import (
 type StubDoer struct {
 	Store   *VCR
 	Matcher *RouteMatcher
+	// Mode selects how stub misses are handled. With RecordModeNone they are
+	// answered with the nearest stub if Policy.FallbackEnabled, else with 501;
+	// with any other mode they are sent to Policy.Upstream through Upstream.
+	// If empty, the record mode of the endpoint in the policy is used (see
+	// Policy.RecordMode), except that RecordModeAll, which only applies to
+	// recording, answers misses like RecordModeNone.
+	Mode RecordMode
+	// Upstream is the transport used for requests without a stub. Use a
+	// RecordingTransport to save the upstream responses as new stubs, so later
+	// requests are served from them. If nil, http.DefaultTransport is used and
+	// nothing is recorded.
+	Upstream http.RoundTripper
+	// StreamTiming replays recorded server-sent events with their original
+	// delays instead of all at once.
+	StreamTiming bool
+	// Latency, if set, overrides the latency configured in the policy.
+	Latency *Latency
+	// Strict records every request answered with 501 for lack of a stub, so
+	// that Store.StrictReport can fail a playback run that was not exhaustive.
+	Strict bool
+	// Journal, if set, records every request to a known endpoint. See
+	// JournalMiddleware for requests answered by scenario handlers.
+	Journal *Journal
+	// Faults, if set, overrides the fault profile configured in the policy.
+	Faults *Faults
+	// FaultSeed, if set, overrides Policy.FaultSeed. Sequential requests
+	// with the same seed suffer the same faults.
+	FaultSeed *uint64
+
+	// settingsMu guards Latency and Faults once the doer serves requests.
+	settingsMu sync.RWMutex
+	faultMu    sync.Mutex
+	faultRand  *rand.Rand
 }
 
 func NewStubDoer(store *VCR, endpoints []Endpoint) *StubDoer {
@@ -30,42 +69,207 @@ func (d *StubDoer) Do(req *http.Request) (*http.Response, error) {
 
 	endpointName, vars, ok := d.Matcher.Match(req)
 	if !ok {
+		d.strictMiss(req, "")
 		return vcrErrorResponse(req, http.StatusNotImplemented, "vcr: unstubbed endpoint"), nil
 	}
 
-	div := RequestDiversifier(d.Store.Policy, endpointName, req.URL.Query(), vars)
-	meta, body, err := d.Store.ReadResponse(endpointName, div)
+	body, err := ReadRequestBody(req)
+	if err != nil {
+		return vcrErrorResponse(req, http.StatusBadRequest, "vcr: failed to read request body"), nil
+	}
+
+	div := RequestDiversifier(d.Store.CurrentPolicy(), endpointName, req.URL.Query(), vars, body, diversifierHeader(req))
+	call := callFromContext(req.Context())
+	journaled := call == nil && d.Journal != nil
+	if journaled {
+		// Requests that do not come through JournalMiddleware are journaled here.
+		c := newCall(req, endpointName, vars, body, div)
+		call = &c
+	}
+	resp, err := d.serve(req, endpointName, vars, body, div, call)
+	if journaled {
+		if resp != nil {
+			call.Status = resp.StatusCode
+		}
+		d.Journal.record(*call)
+	}
+	return resp, err
+}
+
+// serve answers a request to a matched endpoint and records what answered it
+// in call, if not nil.
+func (d *StubDoer) serve(req *http.Request, endpointName string, vars map[string]string, body []byte, div string, call *Call) (*http.Response, error) {
+	match, meta, respBody, err := d.lookup(req, endpointName, vars, div)
 	if err != nil {
 		if os.IsNotExist(err) {
+			setStubMatch(req.Context(), StubMatch{Endpoint: endpointName, Requested: div})
+			if d.forwards(endpointName) {
+				call.resolve(CallUpstream, "")
+				return d.forward(req)
+			}
+			call.resolve(CallMiss, "")
+			d.strictMiss(req, stubKey(endpointName, div))
 			return vcrErrorResponse(req, http.StatusNotImplemented, "vcr: unstubbed endpoint"), nil
 		}
+		call.resolve(CallMiss, match.Stub)
+		if errors.Is(err, ErrSequenceExhausted) {
+			setStubMatch(req.Context(), match)
+			d.strictMiss(req, match.Stub)
+			return vcrErrorResponse(req, http.StatusNotImplemented, "vcr: stub sequence exhausted"), nil
+		}
+		if errors.Is(err, ErrIncompleteStub) {
+			return vcrErrorResponse(req, http.StatusInternalServerError, err.Error()), nil
+		}
 		return vcrErrorResponse(req, http.StatusInternalServerError, "vcr: failed to read stub"), nil
 	}
+	setStubMatch(req.Context(), match)
+	call.resolve(CallStub, match.Stub)
+	respBody, err = renderStub(req, endpointName, vars, body, meta, respBody)
+	if err != nil {
+		return vcrErrorResponse(req, http.StatusInternalServerError, err.Error()), nil
+	}
+	if err := sleep(req.Context(), d.latency(endpointName).Delay(meta.Timings)); err != nil {
+		return nil, err
+	}
+	return d.injectFault(req, endpointName, stubResponse(req, endpointName, meta, respBody, d.StreamTiming))
+}
+
+// SetLatency replaces Latency while the doer serves requests. Pass nil to
+// use the latency configured in the policy again.
+func (d *StubDoer) SetLatency(l *Latency) {
+	d.settingsMu.Lock()
+	defer d.settingsMu.Unlock()
+	d.Latency = l
+}
+
+// SetFaults replaces Faults while the doer serves requests. Pass nil to use
+// the fault profile configured in the policy again.
+func (d *StubDoer) SetFaults(f *Faults) {
+	d.settingsMu.Lock()
+	defer d.settingsMu.Unlock()
+	d.Faults = f
+}
+
+// latency returns the simulated latency of the endpoint's stub responses.
+func (d *StubDoer) latency(endpointName string) Latency {
+	d.settingsMu.RLock()
+	l := d.Latency
+	d.settingsMu.RUnlock()
+	if l != nil {
+		return *l
+	}
+	return d.Store.CurrentPolicy().ResponseLatency(endpointName)
+}
+
+// lookup returns the next response of the stub for div. When there is none
+// and misses are not forwarded, it tries the nearest stub if the policy
+// enables fallback.
+func (d *StubDoer) lookup(req *http.Request, endpointName string, vars map[string]string, div string) (StubMatch, ResponseMeta, []byte, error) {
+	d.Store.indexStubsOnce(d.Matcher)
+	match := StubMatch{Endpoint: endpointName, Requested: div}
+	meta, respBody, key, err := d.Store.nextResponse(endpointName, div)
+	match.Stub = key
+	if os.IsNotExist(err) && !d.forwards(endpointName) && d.Store.CurrentPolicy().FallbackEnabled(endpointName) {
+		match.Stub, match.Fallback, meta, respBody, err = d.nearestStub(req, endpointName, vars, div)
+	}
+	return match, meta, respBody, err
+}
+
+// forwards reports whether misses of the endpoint are sent to the upstream.
+func (d *StubDoer) forwards(endpointName string) bool {
+	if d.Mode != "" {
+		return d.Mode != RecordModeNone
+	}
+	mode := d.Store.CurrentPolicy().RecordMode(endpointName)
+	return mode != RecordModeNone && mode != RecordModeAll
+}
+
+// hopHeaders lists the incoming headers that describe the connection to the
+// playback server rather than the request, which forward leaves out.
+var hopHeaders = []string{"Accept-Encoding", "Connection", "Content-Length", "Keep-Alive", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+// forward sends a request that has no stub to Policy.Upstream.
+func (d *StubDoer) forward(req *http.Request) (*http.Response, error) {
+	upstream, err := url.Parse(d.Store.CurrentPolicy().Upstream)
+	if err != nil || upstream.Host == "" {
+		return vcrErrorResponse(req, http.StatusBadGateway, "vcr: no upstream to fall through to"), nil
+	}
+	target := *upstream
+	target.Path = strings.TrimSuffix(upstream.Path, "/") + req.URL.Path
+	target.RawPath = ""
+	target.RawQuery = req.URL.RawQuery
+	out := req.Clone(req.Context())
+	out.URL = &target
+	out.Host = upstream.Host
+	out.RequestURI = ""
+	// The upstream, and a recorder in front of it, see the headers playback
+	// diversified by, not only those the Goa client set.
+	if out.Header == nil {
+		out.Header = http.Header{}
+	}
+	for name, values := range IncomingHeader(req.Context()) {
+		if _, set := out.Header[name]; !set && !slices.Contains(hopHeaders, name) {
+			out.Header[name] = slices.Clone(values)
+		}
+	}
+
+	rt := d.Upstream
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	resp, err := rt.RoundTrip(out)
+	if err != nil {
+		return vcrErrorResponse(req, http.StatusBadGateway, "vcr: upstream request failed"), nil
+	}
+	return resp, nil
+}
 
+// stubResponse builds the HTTP response recorded in a stub. Event stream
+// stubs are served as text/event-stream; when timed, each event is held back
+// until its recorded offset.
+func stubResponse(req *http.Request, endpointName string, meta ResponseMeta, respBody []byte, timed bool) *http.Response {
 	status := meta.Status
 	if status == 0 {
 		status = http.StatusOK
 	}
 
 	h := make(http.Header, len(meta.Headers)+2)
-	for k, v := range meta.Headers {
+	for k, values := range meta.Headers {
 		if strings.EqualFold(k, "Content-Length") || strings.EqualFold(k, "Transfer-Encoding") {
 			continue
 		}
-		h.Set(k, v)
+		for _, v := range values {
+			h.Add(k, v)
+		}
 	}
 	if h.Get("Content-Type") == "" && meta.MimeType != "" {
 		h.Set("Content-Type", meta.MimeType)
 	}
 
-	h.Set("Content-Length", strconv.Itoa(len(body)))
+	var body io.ReadCloser
+	var events []StreamEvent
+	if isEventStream(h.Get("Content-Type")) && json.Unmarshal(respBody, &events) == nil {
+		// Event stream stubs hold the recorded events; serve them as SSE.
+		if timed {
+			body = &timedEventReader{ctx: req.Context(), events: events}
+		} else {
+			respBody = encodeEventStream(events)
+		}
+	}
+	length := int64(-1)
+	if body == nil {
+		body = io.NopCloser(bytes.NewReader(respBody))
+		length = int64(len(respBody))
+		h.Set("Content-Length", strconv.Itoa(len(respBody)))
+	}
+	setStubResult(req.Context(), endpointName, status, h)
 	return &http.Response{
 		StatusCode:    status,
 		Header:        h,
-		Body:          io.NopCloser(bytes.NewReader(body)),
-		ContentLength: int64(len(body)),
+		Body:          body,
+		ContentLength: length,
 		Request:       req,
-	}, nil
+	}
 }
 
 func vcrErrorResponse(req *http.Request, status int, msg string) *http.Response {
@@ -3,6 +3,8 @@ package runtime
 import (
 	"io"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
@@ -69,6 +71,247 @@ func TestStubDoerServesStub(t *testing.T) {
 	}
 }
 
+func TestStubDoerServesPostByBody(t *testing.T) {
+	tmp := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmp, PolicyFileName), []byte("{\"upstream\":\"https://example.com\"}\n"), 0600); err != nil {
+		t.Fatalf("write policy: %v", err)
+	}
+	store, err := New(tmp)
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+
+	for _, name := range []string{"a", "b"} {
+		payload := []byte(`{"name":"` + name + `"}`)
+		body := []byte(`{"id":"` + name + `"}`)
+		div := RequestDiversifier(store.Policy, "CreateThing", nil, nil, payload, nil)
+		if err := store.WriteStub("CreateThing", RequestSpec{Method: http.MethodPost, URL: "http://example.com/things", Body: payload}, ResponseMeta{
+			Status:   http.StatusCreated,
+			MimeType: "application/json",
+			Size:     len(body),
+		}, body, div); err != nil {
+			t.Fatalf("write stub: %v", err)
+		}
+	}
+
+	d := NewStubDoer(store, []Endpoint{
+		{Name: "CreateThing", Method: http.MethodPost, Pattern: "/things"},
+	})
+	req, err := http.NewRequest(http.MethodPost, "http://example.com/things", strings.NewReader("{\n  \"name\": \"b\"\n}\n"))
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	resp, err := d.Do(req)
+	if err != nil {
+		t.Fatalf("do: %v", err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || string(b) != `{"id":"b"}` {
+		t.Fatalf("unexpected response: %d %q", resp.StatusCode, string(b))
+	}
+}
+
+func TestStubDoerReplaysRepeatedHeaders(t *testing.T) {
+	tmp := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmp, PolicyFileName), []byte("{\"upstream\":\"https://example.com\"}\n"), 0600); err != nil {
+		t.Fatalf("write policy: %v", err)
+	}
+	store, err := New(tmp)
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+
+	body := []byte("[]\n")
+	links := []string{`<http://example.com/things?page=2>; rel="next"`, `<http://example.com/things?page=9>; rel="last"`}
+	if err := store.WriteStub("ListThings", RequestSpec{URL: "http://example.com/things"}, ResponseMeta{
+		Status:   200,
+		Headers:  http.Header{"Link": links, "Vary": []string{"Accept", "Accept-Language"}},
+		MimeType: "application/json",
+		Size:     len(body),
+	}, body); err != nil {
+		t.Fatalf("write stub: %v", err)
+	}
+
+	d := NewStubDoer(store, []Endpoint{
+		{Name: "ListThings", Method: http.MethodGet, Pattern: "/things"},
+	})
+	resp, err := d.Do(mustRequest(t, http.MethodGet, "http://example.com/things"))
+	if err != nil {
+		t.Fatalf("do: %v", err)
+	}
+	if got := resp.Header.Values("Link"); len(got) != 2 || got[0] != links[0] || got[1] != links[1] {
+		t.Fatalf("unexpected Link headers: %q", got)
+	}
+	if got := resp.Header.Values("Vary"); len(got) != 2 {
+		t.Fatalf("unexpected Vary headers: %q", got)
+	}
+}
+
+func TestStubDoerFallthroughForwardsMisses(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"path":"`+r.URL.Path+`"}`)
+	}))
+	defer upstream.Close()
+
+	storage := NewMemoryStorage()
+	if err := storage.WriteFile(PolicyFileName, []byte(`{"upstream":"`+upstream.URL+`"}`)); err != nil {
+		t.Fatalf("write policy: %v", err)
+	}
+	store, err := NewWithStorage(storage)
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+
+	d := NewStubDoer(store, []Endpoint{
+		{Name: "Known", Method: http.MethodGet, Pattern: "/known"},
+	})
+	resp, err := d.Do(mustRequest(t, http.MethodGet, "http://vcr.local/known"))
+	if err != nil {
+		t.Fatalf("do: %v", err)
+	}
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("expected 501 without fallthrough, got %d", resp.StatusCode)
+	}
+
+	d.Mode = RecordModeFallthrough
+	resp, err = d.Do(mustRequest(t, http.MethodGet, "http://vcr.local/known"))
+	if err != nil {
+		t.Fatalf("do: %v", err)
+	}
+	defer resp.Body.Close()
+	got, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(got) != `{"path":"/known"}` {
+		t.Fatalf("unexpected fallthrough response: %d %s", resp.StatusCode, got)
+	}
+}
+
+func TestStubDoerRecordsMissesThroughRecorder(t *testing.T) {
+	storage := NewMemoryStorage()
+	if err := storage.WriteFile(PolicyFileName, []byte(`{"upstream":"https://example.com"}`)); err != nil {
+		t.Fatalf("write policy: %v", err)
+	}
+	store, err := NewWithStorage(storage)
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	endpoints := []Endpoint{
+		{Name: "Known", Method: http.MethodGet, Pattern: "/known"},
+	}
+
+	base := &countingRoundTripper{body: `{"ok":true}`}
+	recorder := NewRecordingTransport(nil, store, endpoints, base, 0)
+	recorder.Mode = RecordModeNewEpisodes
+	d := NewStubDoer(store, endpoints)
+	d.Mode = RecordModeNewEpisodes
+	d.Upstream = recorder
+
+	for i := 0; i < 2; i++ {
+		resp, err := d.Do(mustRequest(t, http.MethodGet, "http://vcr.local/known"))
+		if err != nil {
+			t.Fatalf("do: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status: %d", resp.StatusCode)
+		}
+	}
+	if base.calls != 1 {
+		t.Fatalf("expected one upstream call, got %d", base.calls)
+	}
+	if ok, _ := store.HasStub("Known"); !ok {
+		t.Fatalf("expected miss to be recorded")
+	}
+}
+
+func TestStubDoerHandlesMissesByEndpointRecordMode(t *testing.T) {
+	store, err := NewWithStorage(memoryStorageWithPolicy(t, `{"upstream":"https://example.com","mode":"new_episodes","endpoints":{"Frozen":{"record":{"mode":"none"}},"Live":{"record":{"mode":"fallthrough"}}}}`))
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	endpoints := []Endpoint{
+		{Name: "Known", Method: http.MethodGet, Pattern: "/known"},
+		{Name: "Frozen", Method: http.MethodGet, Pattern: "/frozen"},
+		{Name: "Live", Method: http.MethodGet, Pattern: "/live"},
+	}
+	base := &countingRoundTripper{body: `{"ok":true}`}
+	d := NewStubDoer(store, endpoints)
+	d.Upstream = NewRecordingTransport(nil, store, endpoints, base, 0)
+	do := func(path string) int {
+		t.Helper()
+		resp, err := d.Do(mustRequest(t, http.MethodGet, "http://vcr.local"+path))
+		if err != nil {
+			t.Fatalf("do: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for range 2 {
+		if status := do("/known"); status != http.StatusOK {
+			t.Fatalf("expected new_episodes to record the miss, got %d", status)
+		}
+	}
+	if base.calls != 1 {
+		t.Fatalf("expected the second call to be served from the new stub, got %d upstream calls", base.calls)
+	}
+	if status := do("/frozen"); status != http.StatusNotImplemented || base.calls != 1 {
+		t.Fatalf("expected none to answer 501 without calling the upstream, got %d after %d calls", status, base.calls)
+	}
+	if status := do("/live"); status != http.StatusOK || base.calls != 2 {
+		t.Fatalf("expected fallthrough to proxy the miss, got %d after %d calls", status, base.calls)
+	}
+	if ok, _ := store.HasStub("Live"); ok {
+		t.Fatalf("expected fallthrough not to record the miss")
+	}
+
+	d.Mode = RecordModeNone
+	if status := do("/live"); status != http.StatusNotImplemented {
+		t.Fatalf("expected Mode to override the policy, got %d", status)
+	}
+}
+
+func TestStubDoerRecordsMissesByIncomingHeaders(t *testing.T) {
+	store, err := NewWithStorage(memoryStorageWithPolicy(t, `{"upstream":"https://example.com","endpoints":{"Known":{"variant":{"headers":["X-Tenant"],"cookies":["region"]}}}}`))
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	endpoints := []Endpoint{
+		{Name: "Known", Method: http.MethodGet, Pattern: "/known"},
+	}
+	base := &countingRoundTripper{body: `{"ok":true}`}
+	recorder := NewRecordingTransport(nil, store, endpoints, base, 0)
+	recorder.Mode = RecordModeNewEpisodes
+	d := NewStubDoer(store, endpoints)
+	d.Mode = RecordModeNewEpisodes
+	d.Upstream = recorder
+
+	// The headers are not declared in the design, so the Goa client request
+	// does not carry them; only the incoming playback request does.
+	incoming := http.Header{"X-Tenant": {"acme"}, "Cookie": {"region=eu"}, "Connection": {"close"}}
+	for i := 0; i < 2; i++ {
+		req := mustRequest(t, http.MethodGet, "http://vcr.local/known")
+		req = req.WithContext(WithIncomingHeader(req.Context(), incoming))
+		resp, err := d.Do(req)
+		if err != nil {
+			t.Fatalf("do: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status: %d", resp.StatusCode)
+		}
+	}
+	if base.calls != 1 {
+		t.Fatalf("expected the recorded stub to be replayed, got %d upstream calls", base.calls)
+	}
+	if base.header.Get("X-Tenant") != "acme" || base.header.Get("Cookie") != "region=eu" || base.header.Get("Connection") != "" {
+		t.Fatalf("unexpected upstream headers: %v", base.header)
+	}
+	div := RequestDiversifier(store.CurrentPolicy(), "Known", nil, nil, nil, incoming)
+	if ok, err := store.HasStub("Known", div); !ok || err != nil {
+		t.Fatalf("expected the stub under the playback key: %v %v", ok, err)
+	}
+}
+
 func mustRequest(t *testing.T, method, rawurl string) *http.Request {
 	t.Helper()
 	req, err := http.NewRequest(method, rawurl, nil)
@@ -78,3 +321,152 @@ func mustRequest(t *testing.T, method, rawurl string) *http.Request {
 	return req
 }
 
+
+func TestStubDoerResolvesStubsRecordedUnderOtherNames(t *testing.T) {
+	store, err := NewWithStorage(memoryStorageWithPolicy(t, `{"upstream":"https://example.com"}`))
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	query := url.Values{"status": {"open"}}
+	hashed := RequestDiversifier(store.Policy, "ListThings", query, nil, nil, nil)
+	body := []byte("[]\n")
+	if err := store.WriteStub("ListThings", RequestSpec{Method: http.MethodGet, URL: "http://example.com/things?status=open"}, ResponseMeta{
+		Status:   200,
+		MimeType: "application/json",
+		Size:     len(body),
+	}, body, hashed); err != nil {
+		t.Fatalf("write stub: %v", err)
+	}
+
+	store.Policy.Names = NameStyleReadable
+	if has, _ := store.HasStub("ListThings", "q.status=open"); has {
+		t.Fatalf("expected no readable stub before indexing")
+	}
+	d := NewStubDoer(store, []Endpoint{
+		{Name: "ListThings", Method: http.MethodGet, Pattern: "/things"},
+	})
+	resp, err := d.Do(mustRequest(t, http.MethodGet, "http://example.com/things?status=open"))
+	if err != nil {
+		t.Fatalf("do: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected hashed stub to be served under readable name, got %d", resp.StatusCode)
+	}
+	if has, _ := store.HasStub("ListThings", "q.status=open"); !has {
+		t.Fatalf("expected index to resolve readable name")
+	}
+}
+
+func memoryStorageWithPolicy(t *testing.T, policy string) *MemoryStorage {
+	t.Helper()
+	storage := NewMemoryStorage()
+	if err := storage.WriteFile(PolicyFileName, []byte(policy)); err != nil {
+		t.Fatalf("write policy: %v", err)
+	}
+	return storage
+}
+
+func TestStubDoerReplaysRecordedSequences(t *testing.T) {
+	storage := memoryStorageWithPolicy(t, `{"upstream":"https://example.com","endpoints":{"GetJob":{"sequence":{"end":"error"}}}}`)
+	store, err := NewWithStorage(storage)
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	endpoints := []Endpoint{
+		{Name: "GetJob", Method: http.MethodGet, Pattern: "/jobs/{id}"},
+	}
+
+	base := &countingRoundTripper{}
+	tr := NewRecordingTransport(nil, store, endpoints, base, 5)
+	for _, state := range []string{"pending", "pending", "done"} {
+		base.body = `{"state":"` + state + `"}`
+		if _, err := tr.RoundTrip(mustRequest(t, http.MethodGet, "http://example.com/jobs/1")); err != nil {
+			t.Fatalf("round trip: %v", err)
+		}
+	}
+
+	d := NewStubDoer(store, endpoints)
+	next := func() (int, string) {
+		t.Helper()
+		resp, err := d.Do(mustRequest(t, http.MethodGet, "http://example.com/jobs/1"))
+		if err != nil {
+			t.Fatalf("do: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, strings.Join(strings.Fields(string(body)), "")
+	}
+	for _, want := range []string{`{"state":"pending"}`, `{"state":"pending"}`, `{"state":"done"}`} {
+		if status, body := next(); status != http.StatusOK || body != want {
+			t.Fatalf("expected %s, got %d %s", want, status, body)
+		}
+	}
+	if status, _ := next(); status != http.StatusNotImplemented {
+		t.Fatalf("expected exhausted sequence to fail, got %d", status)
+	}
+
+	store.ResetSequences("GetJob")
+	if _, body := next(); body != `{"state":"pending"}` {
+		t.Fatalf("expected reset sequence to start over, got %s", body)
+	}
+
+	store.Policy.Endpoints["GetJob"] = EndpointPolicy{Sequence: &SequencePolicy{End: SequenceEndCycle}}
+	next()
+	next()
+	if _, body := next(); body != `{"state":"pending"}` {
+		t.Fatalf("expected cycle to start over, got %s", body)
+	}
+
+	store.Policy.Endpoints["GetJob"] = EndpointPolicy{Sequence: &SequencePolicy{}}
+	store.ResetSequences()
+	for range 4 {
+		next()
+	}
+	if _, body := next(); body != `{"state":"done"}` {
+		t.Fatalf("expected last response to repeat, got %s", body)
+	}
+
+	// A new recording session replaces the sequence.
+	base.body = `{"state":"queued"}`
+	tr = NewRecordingTransport(nil, store, endpoints, base, 5)
+	if _, err := tr.RoundTrip(mustRequest(t, http.MethodGet, "http://example.com/jobs/1")); err != nil {
+		t.Fatalf("round trip: %v", err)
+	}
+	if _, err := storage.ReadFile("GetJob~2.vcr.json"); err == nil {
+		t.Fatalf("expected stale sequence blobs to be removed")
+	}
+}
+
+func TestSequenceBlobsKeepReadableStubsApart(t *testing.T) {
+	storage := memoryStorageWithPolicy(t, `{"upstream":"https://example.com","names":"readable","endpoints":{"GetJob":{"variant":{"path":true},"sequence":{}}}}`)
+	store, err := NewWithStorage(storage)
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	endpoints := []Endpoint{
+		{Name: "GetJob", Method: http.MethodGet, Pattern: "/jobs/{id}"},
+	}
+	record := func(tr *RecordingTransport, base *countingRoundTripper, path, body string) {
+		t.Helper()
+		base.body = body
+		if _, err := tr.RoundTrip(mustRequest(t, http.MethodGet, "http://example.com"+path)); err != nil {
+			t.Fatalf("round trip: %v", err)
+		}
+	}
+
+	base := &countingRoundTripper{}
+	tr := NewRecordingTransport(nil, store, endpoints, base, 5)
+	record(tr, base, "/jobs/1.2", `{"id":"1.2"}`)
+	record(tr, base, "/jobs/1", `{"state":"pending"}`)
+	record(tr, base, "/jobs/1", `{"state":"done"}`)
+	// A new session rewrites the stub of job 1 and removes its sequence blobs.
+	tr = NewRecordingTransport(nil, store, endpoints, base, 5)
+	record(tr, base, "/jobs/1", `{"state":"queued"}`)
+
+	_, body, err := store.ReadResponse("GetJob", "p.id=1.2")
+	if err != nil {
+		t.Fatalf("read stub of job 1.2: %v", err)
+	}
+	if got := strings.Join(strings.Fields(string(body)), ""); got != `{"id":"1.2"}` {
+		t.Fatalf("expected the stub of job 1.2 to be intact, got %s", got)
+	}
+}
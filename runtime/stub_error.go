@@ -0,0 +1,58 @@
+package runtime
+
+import (
+	"context"
+	"net/http"
+
+	goa "goa.design/goa/v3/pkg"
+)
+
+// StubResult describes the stub that answered a StubDoer request. Generated
+// background clients capture it to turn recorded error responses into Goa
+// service errors.
+type StubResult struct {
+	// Endpoint is the name of the endpoint whose stub was served.
+	Endpoint string
+	// Status is the recorded response status.
+	Status int
+	// Header holds the recorded response headers.
+	Header http.Header
+}
+
+type stubResultKey struct{}
+
+// WithStubResult returns a context that captures the stub served by StubDoer
+// for requests made with it. The returned StubResult is zero until a stub is
+// served.
+func WithStubResult(ctx context.Context) (context.Context, *StubResult) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	res := &StubResult{}
+	return context.WithValue(ctx, stubResultKey{}, res), res
+}
+
+func setStubResult(ctx context.Context, endpointName string, status int, header http.Header) {
+	if ctx == nil {
+		return
+	}
+	res, _ := ctx.Value(stubResultKey{}).(*StubResult)
+	if res == nil {
+		return
+	}
+	res.Endpoint = endpointName
+	res.Status = status
+	res.Header = header
+}
+
+// StubStatusError converts a recorded error status that has no matching design
+// error into a Goa service error whose timeout, temporary and fault flags make
+// the Goa HTTP server answer with a comparable status class.
+func StubStatusError(status int, err error) *goa.ServiceError {
+	timeout := status == http.StatusRequestTimeout || status == http.StatusGatewayTimeout
+	temporary := status == http.StatusServiceUnavailable ||
+		status == http.StatusTooManyRequests ||
+		status == http.StatusGatewayTimeout
+	fault := status >= 500 && !timeout && !temporary
+	return goa.NewServiceError(err, "stub_status", timeout, temporary, fault)
+}
@@ -0,0 +1,67 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	goahttp "goa.design/goa/v3/http"
+)
+
+func TestStubDoerReportsStubResult(t *testing.T) {
+	tmp := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmp, PolicyFileName), []byte("{\"upstream\":\"https://example.com\"}\n"), 0600); err != nil {
+		t.Fatalf("write policy: %v", err)
+	}
+	store, err := New(tmp)
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+
+	body := []byte("{\"message\":\"nope\"}\n")
+	if err := store.WriteStub("Known", RequestSpec{URL: "http://example.com/known"}, ResponseMeta{
+		Status:   http.StatusNotFound,
+		MimeType: "application/json",
+		Size:     len(body),
+	}, body); err != nil {
+		t.Fatalf("write stub: %v", err)
+	}
+
+	d := NewStubDoer(store, []Endpoint{
+		{Name: "Known", Method: http.MethodGet, Pattern: "/known"},
+	})
+	ctx, res := WithStubResult(context.Background())
+	req := mustRequest(t, http.MethodGet, "http://example.com/known").WithContext(ctx)
+	resp, err := d.Do(req)
+	if err != nil {
+		t.Fatalf("do: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unexpected status: %d", resp.StatusCode)
+	}
+	if res.Endpoint != "Known" || res.Status != http.StatusNotFound {
+		t.Fatalf("unexpected stub result: %+v", res)
+	}
+}
+
+func TestStubStatusErrorStatusClass(t *testing.T) {
+	cases := map[int]int{
+		http.StatusConflict:            http.StatusBadRequest,
+		http.StatusRequestTimeout:      http.StatusRequestTimeout,
+		http.StatusTooManyRequests:     http.StatusServiceUnavailable,
+		http.StatusInternalServerError: http.StatusInternalServerError,
+		http.StatusServiceUnavailable:  http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:      http.StatusGatewayTimeout,
+	}
+	for recorded, want := range cases {
+		err := StubStatusError(recorded, errors.New("recorded"))
+		got := goahttp.NewErrorResponse(context.Background(), err).StatusCode()
+		if got != want {
+			t.Fatalf("status %d: expected server status %d, got %d", recorded, want, got)
+		}
+	}
+}
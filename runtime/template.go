@@ -0,0 +1,110 @@
+package runtime
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"text/template"
+	"time"
+)
+
+// TemplateExt is appended to the name of a stub body blob, e.g.
+// "GetThing.vcr.json.tmpl", to hold a text/template rendered for each request
+// instead of a static body. A template takes precedence over the recorded blob
+// of the same name, so recording again does not replace it. A template that
+// fails to render is answered with 500.
+const TemplateExt = ".tmpl"
+
+// TemplateData is what templated stub bodies are rendered with. Templates can
+// also call now (RFC 3339, or now "2006-01-02"), uuid and json.
+type TemplateData struct {
+	// Endpoint is the name of the matched endpoint.
+	Endpoint string
+	// Method is the request method.
+	Method string
+	// Path is the request path.
+	Path string
+	// Vars holds the route params, e.g. {{ .Vars.id }}.
+	Vars map[string]string
+	// Query holds the query values, e.g. {{ .Query.Get "page" }}.
+	Query url.Values
+	// Header holds the request headers, e.g. {{ .Header.Get "X-Tenant-ID" }}.
+	Header http.Header
+	// Body is the request payload decoded from JSON, or the raw payload as a
+	// string if it is not JSON.
+	Body any
+}
+
+// templateFuncs are the helpers available to templated stub bodies.
+var templateFuncs = template.FuncMap{
+	// now returns the current UTC time formatted with the given layout, or
+	// RFC 3339.
+	"now": func(layout ...string) string {
+		if len(layout) == 0 {
+			return time.Now().UTC().Format(time.RFC3339)
+		}
+		return time.Now().UTC().Format(layout[0])
+	},
+	// uuid returns a random version 4 UUID.
+	"uuid": func() string {
+		var b [16]byte
+		_, _ = rand.Read(b[:])
+		b[6] = b[6]&0x0f | 0x40
+		b[8] = b[8]&0x3f | 0x80
+		return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+	},
+	// json encodes a value as JSON, e.g. {{ json .Vars.id }} gives "456".
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// newTemplateData returns the data a templated stub body is rendered with for
+// req.
+func newTemplateData(req *http.Request, endpointName string, vars map[string]string, body []byte) TemplateData {
+	data := TemplateData{
+		Endpoint: endpointName,
+		Method:   req.Method,
+		Path:     req.URL.Path,
+		Vars:     vars,
+		Query:    req.URL.Query(),
+		Header:   diversifierHeader(req),
+	}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &data.Body); err != nil {
+			data.Body = string(body)
+		}
+	}
+	return data
+}
+
+// renderStub renders the body of a stub served for req if it is templated,
+// and returns it unchanged otherwise.
+func renderStub(req *http.Request, endpointName string, vars map[string]string, reqBody []byte, meta ResponseMeta, body []byte) ([]byte, error) {
+	if !meta.Template {
+		return body, nil
+	}
+	body, err := renderStubTemplate(endpointName, body, newTemplateData(req, endpointName, vars, reqBody))
+	if err != nil {
+		return nil, fmt.Errorf("vcr: failed to render stub template: %w", err)
+	}
+	return body, nil
+}
+
+// renderStubTemplate renders a templated stub body. Missing map keys render as
+// empty values.
+func renderStubTemplate(name string, body []byte, data TemplateData) ([]byte, error) {
+	tmpl, err := template.New(name).Funcs(templateFuncs).Option("missingkey=zero").Parse(string(body))
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,87 @@
+package runtime
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderStubTemplate(t *testing.T) {
+	req := mustRequest(t, http.MethodPost, "http://example.com/things/456?page=2")
+	req.Header.Set("X-Tenant-ID", "acme")
+	data := newTemplateData(req, "UpdateThing", map[string]string{"id": "456"}, []byte(`{"name":"widget"}`))
+
+	out, err := renderStubTemplate("UpdateThing", []byte(
+		`{"id":{{ json .Vars.id }},"page":"{{ .Query.Get "page" }}","tenant":"{{ .Header.Get "X-Tenant-ID" }}",`+
+			`"name":{{ json .Body.name }},"missing":"{{ .Vars.nope }}","uuid":"{{ uuid }}","day":"{{ now "2006-01-02" }}"}`,
+	), data)
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	var got map[string]string
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatalf("rendered invalid JSON: %v\n%s", err, out)
+	}
+	if got["id"] != "456" || got["page"] != "2" || got["tenant"] != "acme" || got["name"] != "widget" || got["missing"] != "" {
+		t.Fatalf("unexpected render: %s", out)
+	}
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(got["uuid"]) {
+		t.Fatalf("unexpected uuid: %q", got["uuid"])
+	}
+	if got["day"] != time.Now().UTC().Format("2006-01-02") {
+		t.Fatalf("unexpected date: %q", got["day"])
+	}
+
+	if _, err := renderStubTemplate("Bad", []byte(`{{ .Nope`), data); err == nil {
+		t.Fatalf("expected a parse error")
+	}
+}
+
+func TestStubDoerRendersTemplatedStubs(t *testing.T) {
+	storage := memoryStorageWithPolicy(t, `{"upstream":"https://example.com"}`)
+	store, err := NewWithStorage(storage)
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	recorded := []byte(`{"id":"123"}`)
+	if err := store.WriteStub("GetThing", RequestSpec{URL: "http://example.com/things/123"}, ResponseMeta{Status: 200, MimeType: "application/json", Size: len(recorded)}, recorded); err != nil {
+		t.Fatalf("write stub: %v", err)
+	}
+	d := NewStubDoer(store, []Endpoint{{Name: "GetThing", Method: http.MethodGet, Pattern: "/things/{id}"}})
+
+	get := func(id string) (*http.Response, string) {
+		t.Helper()
+		resp, err := d.Do(mustRequest(t, http.MethodGet, "http://example.com/things/"+id))
+		if err != nil {
+			t.Fatalf("do: %v", err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		return resp, string(b)
+	}
+
+	if _, body := get("456"); body != string(recorded) {
+		t.Fatalf("expected the recorded body without a template, got %s", body)
+	}
+
+	if err := storage.WriteFile("GetThing.vcr.json"+TemplateExt, []byte(`{"id":{{ json .Vars.id }}}`)); err != nil {
+		t.Fatalf("write template: %v", err)
+	}
+	resp, body := get("456")
+	if body != `{"id":"456"}` || resp.ContentLength != int64(len(body)) {
+		t.Fatalf("unexpected templated response: %d %s", resp.ContentLength, body)
+	}
+	if meta, raw, err := store.ReadResponse("GetThing"); err != nil || !meta.Template || !strings.Contains(string(raw), "{{") {
+		t.Fatalf("expected ReadResponse to return the raw template, got %+v %s %v", meta, raw, err)
+	}
+
+	if err := storage.WriteFile("GetThing.vcr.json"+TemplateExt, []byte(`{{ .Vars.id`)); err != nil {
+		t.Fatalf("write template: %v", err)
+	}
+	if resp, body := get("456"); resp.StatusCode != http.StatusInternalServerError || !strings.Contains(body, "template") {
+		t.Fatalf("expected a template error, got %d %s", resp.StatusCode, body)
+	}
+}
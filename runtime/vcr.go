@@ -1,18 +1,59 @@
 package runtime
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"maps"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 )
 
 // PolicyFileName is the name of the VCR policy file.
 const PolicyFileName = "vcr.json"
 
+const (
+	// RecordModeAll always proxies to the upstream and re-records every stub.
+	RecordModeAll RecordMode = "all"
+	// RecordModeOnce records an endpoint only while it has no stubs at all.
+	// Afterwards existing stubs are replayed and new variants pass through
+	// without being recorded.
+	RecordModeOnce RecordMode = "once"
+	// RecordModeNewEpisodes replays existing stubs and records new variants.
+	RecordModeNewEpisodes RecordMode = "new_episodes"
+	// RecordModeNone replays existing stubs only; a miss is an error.
+	RecordModeNone RecordMode = "none"
+	// RecordModeFallthrough replays existing stubs and proxies misses to the
+	// upstream without recording them.
+	RecordModeFallthrough RecordMode = "fallthrough"
+)
+
+const (
+	// NameStyleHash names stubs by hashes of their variant, e.g.
+	// "GetThing--p-9f1c...--q-ab34...". It is the default.
+	NameStyleHash NameStyle = "hash"
+	// NameStyleReadable names stubs by their variant values qualified by
+	// source, e.g. "GetThing--p.id=123--q.status=open", falling back to
+	// hashes for long names and for values with upper-case letters.
+	NameStyleReadable NameStyle = "readable"
+)
+
+const (
+	// SequenceEndLast repeats the last response.
+	SequenceEndLast SequenceEnd = "last"
+	// SequenceEndCycle starts over with the first response.
+	SequenceEndCycle SequenceEnd = "cycle"
+	// SequenceEndError answers with ErrSequenceExhausted.
+	SequenceEndError SequenceEnd = "error"
+)
+
 type (
 	// Policy represents the on-disk schema for vcr.json.
 	Policy struct {
@@ -20,10 +61,61 @@ type (
 		Upstream string `json:"upstream"`
 		// Authorization holds authorization policy for recording.
 		Authorization *AuthorizationPolicy `json:"authorization,omitempty"`
+		// Mode is the default record mode for all endpoints. If empty, RecordModeAll.
+		Mode RecordMode `json:"mode,omitempty"`
+		// Names is the default stub naming style for all endpoints. If empty,
+		// NameStyleHash.
+		Names NameStyle `json:"names,omitempty"`
+		// Fallback lets playback answer a request whose exact variant has no
+		// stub with the nearest stub of the endpoint. See StubFallback.
+		Fallback bool `json:"fallback,omitempty"`
+		// Redact scrubs secrets from stubs before they are written.
+		Redact *RedactPolicy `json:"redact,omitempty"`
+		// Latency delays the responses served from stubs during playback.
+		Latency *Latency `json:"latency,omitempty"`
+		// Faults injects failures into the responses served from stubs during
+		// playback.
+		Faults *Faults `json:"faults,omitempty"`
+		// FaultSeed seeds the generator that draws faults. If nil, a random
+		// seed is used and logged.
+		FaultSeed *uint64 `json:"fault_seed,omitempty"`
 		// Endpoints holds per-endpoint policy options keyed by endpoint name.
 		Endpoints map[string]EndpointPolicy `json:"endpoints,omitempty"`
 	}
 
+	// RedactPolicy lists what to scrub from requests and responses before a
+	// stub is written. It applies to every endpoint. Redacted request fields
+	// are also what refresh sends upstream, so fields the upstream needs must
+	// not be redacted.
+	RedactPolicy struct {
+		// Headers lists request and response headers to drop, e.g. "Set-Cookie".
+		// Names are case-insensitive.
+		Headers []string `json:"headers,omitempty"`
+		// Paths lists JSON paths, e.g. "$.user.email" or "$.items[*].token",
+		// whose values are replaced by RedactedValue in request and response
+		// bodies.
+		Paths []string `json:"paths,omitempty"`
+		// Patterns lists regular expressions replaced in the request URL, header
+		// values and bodies of requests and responses.
+		Patterns []RedactPattern `json:"patterns,omitempty"`
+	}
+
+	// RedactPattern is a regular expression to scrub from stubs.
+	RedactPattern struct {
+		// Pattern is an RE2 regular expression.
+		Pattern string `json:"pattern"`
+		// Replace is the replacement, which may refer to submatches as $1. If
+		// empty, RedactedValue.
+		Replace string `json:"replace,omitempty"`
+	}
+
+	// RecordMode controls whether requests are answered from existing stubs or
+	// from the upstream, and whether upstream responses are recorded.
+	RecordMode string
+
+	// NameStyle controls how the diversifier part of stub file names is built.
+	NameStyle string
+
 	// AuthorizationPolicy configures authorization checks for recording.
 	AuthorizationPolicy struct {
 		// Claims is a map of required JWT claim names to their required values.
@@ -34,13 +126,42 @@ type (
 		Claims map[string]any `json:"claims,omitempty"`
 	}
 
-	// VCR is the runtime store for VCR stubs. It loads policy from a single root
-	// directory and provides centralized stub I/O.
+	// VCR is the runtime store for VCR stubs. It loads policy from a single
+	// Storage (usually a root directory) and provides centralized stub I/O.
 	VCR struct {
-		// Root is the storage directory for policy and stubs.
+		// Root is the storage directory for policy and stubs. It is empty when
+		// the store was created with NewWithStorage.
 		Root string
-		// Policy is loaded from Root.
+		// Storage holds policy and stub files. New uses a DirStorage for Root.
+		Storage Storage
+		// Policy is loaded from Storage. Once the store serves requests, read
+		// it with CurrentPolicy and change it with UpdatePolicy or
+		// ReloadPolicy.
 		Policy Policy
+
+		// cache holds the stubs read into memory by Preload.
+		cache atomic.Pointer[stubCache]
+
+		// writeMu serializes the writes of stubs and vcr.json; see lock.
+		// Reads of a stub hold it for reading, so that they never see a stub
+		// half written by this store.
+		writeMu sync.RWMutex
+
+		mu sync.RWMutex
+		// aliases maps stub keys under the other naming style to the stored
+		// key. It is built by IndexStubs.
+		aliases map[string]string
+		indexed bool
+		// cursors holds the next sequence entry to serve per stub key.
+		cursors map[string]int
+		// hits counts the requests answered by each stub key.
+		hits map[string]int
+		// unmatched and unstubbed list the requests that strict StubDoers
+		// could not answer from a stub. See StrictReport.
+		unmatched, unstubbed []string
+		// policySum is the checksum of vcr.json as last read or written, to
+		// detect edits by other processes.
+		policySum uint64
 	}
 
 	// Endpoint defines an API endpoint for VCR recording and playback.
@@ -55,21 +176,108 @@ type (
 
 	// RequestSpec represents a parsed HTTP request from HAR metadata.
 	RequestSpec struct {
-		URL  string
-		Host string // extracted from URL for validation
+		Method string
+		URL    string
+		Host   string // extracted from URL for validation
+		// HTTPVersion is the request protocol, e.g. "HTTP/1.1".
+		HTTPVersion string
+		// Headers holds the recorded request headers. Credentials are omitted.
+		Headers http.Header
+		// Body is the request payload, persisted as HAR postData.
+		Body []byte
+		// MimeType is the Content-Type of Body.
+		MimeType string
 	}
 
 	EndpointPolicy struct {
 		Variant *VariantPolicy `json:"variant,omitempty"`
+		Record  *RecordPolicy  `json:"record,omitempty"`
+		// Fallback overrides Policy.Fallback for the endpoint.
+		Fallback *bool `json:"fallback,omitempty"`
+		// Sequence, if set, records successive responses for the same stub
+		// key as an ordered sequence.
+		Sequence *SequencePolicy `json:"sequence,omitempty"`
+		// WebSocket configures the playback of recorded WebSocket conversations.
+		WebSocket *WebSocketPolicy `json:"websocket,omitempty"`
+		// Latency overrides Policy.Latency for the endpoint.
+		Latency *Latency `json:"latency,omitempty"`
+		// Faults overrides Policy.Faults for the endpoint.
+		Faults *Faults `json:"faults,omitempty"`
+	}
+
+	// WebSocketPolicy configures WebSocket conversation playback.
+	WebSocketPolicy struct {
+		// Match waits for each recorded client message and ends the
+		// conversation when the client sends something else. Otherwise server
+		// messages are replayed in order and client messages are ignored.
+		Match bool `json:"match,omitempty"`
+	}
+
+	// SequencePolicy configures stub sequences, which replay polling flows such
+	// as "pending", "pending", "done". Each recording session starts a new
+	// sequence; every further response for the key is appended to the HAR, with
+	// its body in "<key>~2.vcr.json", "<key>~3.vcr.json" and so on. Playback
+	// serves them in order; VCR.ResetSequences rewinds it.
+	SequencePolicy struct {
+		// End selects what playback does once every response was served. If
+		// empty, SequenceEndLast.
+		End SequenceEnd `json:"end,omitempty"`
+	}
+
+	// SequenceEnd is the playback behavior after the last response of a
+	// stub sequence.
+	SequenceEnd string
+
+	// RecordPolicy configures which upstream responses are recorded.
+	RecordPolicy struct {
+		// Status lists the response status codes to record. If empty, responses
+		// with any final (non-1xx) status are recorded.
+		Status []int `json:"status,omitempty"`
+		// Mode overrides Policy.Mode for the endpoint.
+		Mode RecordMode `json:"mode,omitempty"`
+	}
+
+	// QueryVariant is the value of variant.query. In JSON it is either a bool
+	// or an object with a non-empty list of parameters to include or to
+	// exclude, not both, which implies Enabled.
+	QueryVariant struct {
+		Enabled bool
+		// Include, if set, limits the variant to these parameters.
+		Include []string
+		// Exclude removes these parameters from the variant. It cannot be
+		// combined with Include.
+		Exclude []string
+	}
+
+	// BodyVariant is the value of variant.body. In JSON it is either a bool or
+	// a list of JSON path selectors such as "$.filter.status", which implies
+	// Enabled.
+	BodyVariant struct {
+		Enabled bool
+		// Paths, if set, limits the variant to these fields of JSON payloads
+		// instead of the whole payload.
+		Paths []string
 	}
 
 	VariantPolicy struct {
-		// Query controls whether query strings participate in stub variants.
-		// If nil, query variants are enabled and may be auto-tuned by heuristics.
-		Query *bool `json:"query,omitempty"`
+		// Query controls whether query strings participate in stub variants,
+		// either as a bool or as an {"include": [...]} / {"exclude": [...]}
+		// parameter selection. If nil, query variants are enabled and may be
+		// auto-tuned by heuristics.
+		Query *QueryVariant `json:"query,omitempty"`
 		// Path controls whether route params participate in stub variants.
 		// If nil, path variants are disabled.
 		Path *bool `json:"path,omitempty"`
+		// Body controls whether request payloads participate in stub variants,
+		// either as a bool or as a list of JSON path selectors. If nil, body
+		// variants are enabled for the whole payload.
+		Body *BodyVariant `json:"body,omitempty"`
+		// Headers lists request headers whose values participate in stub variants.
+		Headers []string `json:"headers,omitempty"`
+		// Cookies lists request cookies whose values participate in stub variants.
+		Cookies []string `json:"cookies,omitempty"`
+		// Names overrides Policy.Names for the endpoint.
+		Names NameStyle `json:"names,omitempty"`
 	}
 )
 
@@ -88,7 +296,22 @@ func New(root string) (*VCR, error) {
 		return nil, fmt.Errorf("not a directory: %s", clean)
 	}
 
-	policy, err := readPolicy(clean)
+	v, err := NewWithStorage(NewDirStorage(clean))
+	if err != nil {
+		return nil, err
+	}
+	v.Root = clean
+	return v, nil
+}
+
+// NewWithStorage creates a VCR store backed by storage, which must contain a
+// vcr.json policy file.
+func NewWithStorage(storage Storage) (*VCR, error) {
+	if storage == nil {
+		return nil, fmt.Errorf("nil storage")
+	}
+
+	policy, sum, err := readPolicy(storage)
 	if err != nil {
 		return nil, err
 	}
@@ -98,8 +321,9 @@ func New(root string) (*VCR, error) {
 	}
 
 	return &VCR{
-		Root:   clean,
-		Policy: policy,
+		Storage:   storage,
+		Policy:    policy,
+		policySum: sum,
 	}, nil
 }
 
@@ -115,28 +339,28 @@ func (p Policy) Host() string {
 // readResult loads a HAR file and unmarshals the corresponding JSON stub into a
 // response body type, validates it, then converts it to a service result type.
 func readResult[Body any, Result any](
+	storage Storage,
 	path string,
 	toResult func(*Body) Result,
 	validate func(*Body) error,
 ) (Result, error) {
 	var zero Result
 
-	har, err := readHAR(path)
+	har, err := readHAR(storage, path)
 	if err != nil {
 		return zero, fmt.Errorf("read har %s: %w", path, err)
 	}
-	if len(har.Log.Entries) != 1 {
-		return zero, fmt.Errorf("har %s must contain exactly one entry", path)
+	if err := checkEntries(har); err != nil {
+		return zero, fmt.Errorf("har %s: %w", path, err)
 	}
 
 	jsonPath := blobPathForHARPath(path)
-	jsonFile, err := os.Open(jsonPath)
+	data, err := storage.ReadFile(jsonPath)
 	if err != nil {
 		return zero, fmt.Errorf("open vcr json %s: %w", jsonPath, err)
 	}
-	defer jsonFile.Close()
 
-	body, err := decodeJSON[Body](jsonFile)
+	body, err := decodeJSON[Body](bytes.NewReader(data))
 	if err != nil {
 		return zero, fmt.Errorf("decode vcr json %s: %w", jsonPath, err)
 	}
@@ -167,17 +391,95 @@ func decodeJSON[Body any](r io.Reader) (Body, error) {
 	return body, nil
 }
 
-func readPolicy(dir string) (Policy, error) {
-	path := filepath.Join(dir, PolicyFileName)
-	data, err := os.ReadFile(path)
+// CurrentPolicy returns the policy in effect. It is safe to call while
+// ReloadPolicy runs.
+func (v *VCR) CurrentPolicy() Policy {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.Policy
+}
+
+// UpdatePolicy applies update to a copy of the policy and makes the copy the
+// current policy, so that readers holding the previous one are unaffected.
+// The Policy setters, such as SetQueryVariant, are safe to use in update.
+func (v *VCR) UpdatePolicy(update func(*Policy)) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	p := v.Policy
+	p.Endpoints = maps.Clone(p.Endpoints)
+	update(&p)
+	v.Policy = p
+}
+
+// ReloadPolicy reads vcr.json from storage again and, if it is valid, replaces
+// Policy with it. Each adjust func is applied to the new policy before it takes
+// effect, e.g. to keep command-line overrides. Stubs are indexed again on next
+// use.
+func (v *VCR) ReloadPolicy(adjust ...func(*Policy)) error {
+	storage := v.backend()
+	if storage == nil {
+		return fmt.Errorf("no storage configured")
+	}
+	if c := v.cache.Load(); c != nil {
+		if err := c.refresh(PolicyFileName); err != nil {
+			return err
+		}
+	}
+	policy, sum, err := readPolicy(storage)
+	if err != nil {
+		return err
+	}
+	if err := policy.Validate(); err != nil {
+		return fmt.Errorf("invalid policy: %w", err)
+	}
+	for _, f := range adjust {
+		f(&policy)
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.Policy = policy
+	v.policySum = sum
+	v.indexed = false
+	return nil
+}
+
+// lock serializes writes to storage: it takes writeMu and, if the backend is
+// a LockingStorage, its lock, so that recorders sharing a Root do not
+// interleave their writes.
+func (v *VCR) lock() (unlock func(), err error) {
+	v.writeMu.Lock()
+	l, ok := v.backend().(LockingStorage)
+	if !ok {
+		return v.writeMu.Unlock, nil
+	}
+	release, err := l.Lock()
+	if err != nil {
+		v.writeMu.Unlock()
+		return nil, err
+	}
+	return func() {
+		release()
+		v.writeMu.Unlock()
+	}, nil
+}
+
+// readPolicy reads vcr.json and returns it along with its checksum.
+func readPolicy(storage Storage) (Policy, uint64, error) {
+	data, err := storage.ReadFile(PolicyFileName)
 	if err != nil {
-		return Policy{}, fmt.Errorf("read %s: %w", path, err)
+		return Policy{}, 0, fmt.Errorf("read %s: %w", PolicyFileName, err)
 	}
 
 	var policy Policy
 	if err := json.Unmarshal(data, &policy); err != nil {
-		return Policy{}, fmt.Errorf("parse %s: %w", path, err)
+		return Policy{}, 0, fmt.Errorf("parse %s: %w", PolicyFileName, err)
 	}
-	return policy, nil
+	return policy, checksum(data), nil
+}
+
+func checksum(data []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(data)
+	return h.Sum64()
 }
 
@@ -0,0 +1,264 @@
+package runtime
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"goa.design/clue/log"
+)
+
+// DefaultWatchInterval is the polling period of a Watcher.
+const DefaultWatchInterval = 500 * time.Millisecond
+
+const (
+	// FileAdded is a file that appeared in storage.
+	FileAdded FileChangeKind = "added"
+	// FileModified is a file whose contents changed.
+	FileModified FileChangeKind = "modified"
+	// FileRemoved is a file that disappeared from storage.
+	FileRemoved FileChangeKind = "removed"
+)
+
+type (
+	// FileChangeKind says how a watched file changed.
+	FileChangeKind string
+
+	// FileChange is a change to a file in storage found by a Watcher.
+	FileChange struct {
+		// Name is the file name in storage.
+		Name string
+		// Kind says how the file changed.
+		Kind FileChangeKind
+	}
+
+	// Watcher polls the storage of a store and applies edits while playback
+	// runs: a changed vcr.json is reloaded and changed stubs are indexed
+	// again, so edits made in an editor show up without a restart. Each change
+	// is logged.
+	Watcher struct {
+		// Store is the store to keep up to date.
+		Store *VCR
+		// Interval is the polling period. If zero, DefaultWatchInterval.
+		Interval time.Duration
+		// Reload reads vcr.json again. If nil, Store.ReloadPolicy is used.
+		Reload func() error
+
+		// mu serializes checks, so that Check may be called while Run is
+		// active.
+		mu    sync.Mutex
+		files map[string]string
+	}
+
+	// statStorage is implemented by storages that report file metadata
+	// without reading files.
+	statStorage interface {
+		Stat(name string) (fs.FileInfo, error)
+	}
+)
+
+// Stat returns the metadata of name.
+func (s *DirStorage) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(filepath.Join(s.Dir, name))
+}
+
+// Run checks storage every Interval until ctx ends. The files present when
+// Run starts are the baseline; only later changes are applied.
+func (w *Watcher) Run(ctx context.Context) error {
+	if err := w.baseline(); err != nil {
+		return err
+	}
+	interval := w.Interval
+	if interval <= 0 {
+		interval = DefaultWatchInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if _, err := w.Check(ctx); err != nil {
+				log.Errorf(ctx, err, "vcr watch failed")
+			}
+		}
+	}
+}
+
+// baseline records the files present, unless a check already did.
+func (w *Watcher) baseline() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.files != nil {
+		return nil
+	}
+	files, err := w.snapshot()
+	if err != nil {
+		return err
+	}
+	w.files = files
+	return nil
+}
+
+// Check compares storage with the previous check, applies the changes and
+// returns them. The first check only records the files present. It is safe to
+// call while Run is active.
+func (w *Watcher) Check(ctx context.Context) ([]FileChange, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	files, err := w.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	if w.files == nil {
+		w.files = files
+		return nil, nil
+	}
+	var changes []FileChange
+	for name, sum := range files {
+		switch prev, ok := w.files[name]; {
+		case !ok:
+			changes = append(changes, FileChange{Name: name, Kind: FileAdded})
+		case prev != sum:
+			changes = append(changes, FileChange{Name: name, Kind: FileModified})
+		}
+	}
+	for name := range w.files {
+		if _, ok := files[name]; !ok {
+			changes = append(changes, FileChange{Name: name, Kind: FileRemoved})
+		}
+	}
+	w.files = files
+	slices.SortFunc(changes, func(a, b FileChange) int { return strings.Compare(a.Name, b.Name) })
+
+	var stubs []string
+	for _, c := range changes {
+		if c.Name == PolicyFileName {
+			w.reloadPolicy(ctx)
+			continue
+		}
+		stubs = append(stubs, c.Name)
+		log.Print(ctx, log.KV{K: "msg", V: "vcr stub file " + string(c.Kind)}, log.KV{K: "vcr.file", V: c.Name})
+	}
+	if len(stubs) > 0 {
+		if err := w.Store.invalidateStubs(stubs...); err != nil {
+			return changes, err
+		}
+	}
+	return changes, nil
+}
+
+// reloadPolicy reloads vcr.json and logs the settings that changed. An
+// invalid policy is logged and the current one kept.
+func (w *Watcher) reloadPolicy(ctx context.Context) {
+	reload := w.Reload
+	if reload == nil {
+		reload = func() error { return w.Store.ReloadPolicy() }
+	}
+	before := w.Store.CurrentPolicy()
+	if err := reload(); err != nil {
+		log.Errorf(ctx, err, "vcr policy reload failed, keeping the current policy")
+		return
+	}
+	changed := policyChanges(before, w.Store.CurrentPolicy())
+	if len(changed) == 0 {
+		changed = []string{"nothing"}
+	}
+	log.Print(ctx, log.KV{K: "msg", V: "vcr policy reloaded"}, log.KV{K: "vcr.changed", V: strings.Join(changed, ",")})
+}
+
+// snapshot returns a fingerprint of every file in storage, from its metadata
+// when the storage reports it, else from its contents.
+func (w *Watcher) snapshot() (map[string]string, error) {
+	storage := w.Store.backend()
+	if storage == nil {
+		return nil, fmt.Errorf("no storage configured")
+	}
+	names, err := storage.List()
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]string, len(names))
+	for _, name := range names {
+		if s, ok := storage.(statStorage); ok {
+			info, err := s.Stat(name)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			files[name] = fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size())
+			continue
+		}
+		data, err := storage.ReadFile(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		h := fnv.New64a()
+		_, _ = h.Write(data)
+		files[name] = fmt.Sprintf("%x", h.Sum64())
+	}
+	return files, nil
+}
+
+// policyChanges lists the vcr.json settings that differ between two policies,
+// naming endpoint settings "endpoints.<name>".
+func policyChanges(old, updated Policy) []string {
+	a, b := policyFields(old), policyFields(updated)
+	var changed []string
+	for _, key := range unionKeys(a, b) {
+		if bytes.Equal(a[key], b[key]) {
+			continue
+		}
+		if key != "endpoints" {
+			changed = append(changed, key)
+			continue
+		}
+		var ea, eb map[string]json.RawMessage
+		_ = json.Unmarshal(a[key], &ea)
+		_ = json.Unmarshal(b[key], &eb)
+		for _, name := range unionKeys(ea, eb) {
+			if !bytes.Equal(ea[name], eb[name]) {
+				changed = append(changed, "endpoints."+name)
+			}
+		}
+	}
+	return changed
+}
+
+func policyFields(p Policy) map[string]json.RawMessage {
+	var fields map[string]json.RawMessage
+	if data, err := json.Marshal(p); err == nil {
+		_ = json.Unmarshal(data, &fields)
+	}
+	return fields
+}
+
+func unionKeys(a, b map[string]json.RawMessage) []string {
+	var keys []string
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,173 @@
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWatcherAppliesPolicyAndStubChanges(t *testing.T) {
+	storage := memoryStorageWithPolicy(t, `{"upstream":"https://example.com"}`)
+	store, err := NewWithStorage(storage)
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	ctx := context.Background()
+	w := &Watcher{Store: store}
+	if changes, err := w.Check(ctx); err != nil || len(changes) != 0 {
+		t.Fatalf("unexpected baseline: %v %v", changes, err)
+	}
+
+	body := []byte(`{}`)
+	if err := store.WriteStub("GetThing", RequestSpec{URL: "http://example.com/things/1"}, ResponseMeta{Status: 200, MimeType: "application/json", Size: len(body)}, body); err != nil {
+		t.Fatalf("write stub: %v", err)
+	}
+	if err := storage.WriteFile(PolicyFileName, []byte(`{"upstream":"https://example.com","fallback":true,"endpoints":{"GetThing":{"variant":{"query":false}}}}`)); err != nil {
+		t.Fatalf("write policy: %v", err)
+	}
+	store.mu.Lock()
+	store.indexed = true
+	store.mu.Unlock()
+
+	changes, err := w.Check(ctx)
+	if err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	if !slices.Equal(changes, []FileChange{
+		{Name: "GetThing.vcr.har", Kind: FileAdded},
+		{Name: "GetThing.vcr.json", Kind: FileAdded},
+		{Name: PolicyFileName, Kind: FileModified},
+	}) {
+		t.Fatalf("unexpected changes: %+v", changes)
+	}
+	if p := store.CurrentPolicy(); !p.Fallback {
+		t.Fatalf("expected the policy to be reloaded, got %+v", p)
+	}
+	if store.indexed {
+		t.Fatalf("expected stub changes to invalidate the index")
+	}
+
+	// An invalid policy is ignored.
+	if err := storage.WriteFile(PolicyFileName, []byte(`{"upstream":"https://example.com","faults":{"error":101}}`)); err != nil {
+		t.Fatalf("write policy: %v", err)
+	}
+	if _, err := w.Check(ctx); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	if p := store.CurrentPolicy(); !p.Fallback || p.Faults != nil {
+		t.Fatalf("expected the previous policy to be kept, got %+v", p)
+	}
+
+	if err := storage.Remove("GetThing.vcr.json"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if changes, _ := w.Check(ctx); !slices.Equal(changes, []FileChange{{Name: "GetThing.vcr.json", Kind: FileRemoved}}) {
+		t.Fatalf("unexpected changes: %+v", changes)
+	}
+}
+
+func TestWatcherUsesFileMetadataOfDirStorage(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, PolicyFileName), []byte(`{"upstream":"https://example.com"}`), 0600); err != nil {
+		t.Fatalf("write policy: %v", err)
+	}
+	store, err := New(dir)
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	w := &Watcher{Store: store, Reload: func() error {
+		return store.ReloadPolicy(func(p *Policy) { p.Fallback = true })
+	}}
+	if _, err := w.Check(context.Background()); err != nil {
+		t.Fatalf("baseline: %v", err)
+	}
+	path := filepath.Join(dir, PolicyFileName)
+	if err := os.WriteFile(path, []byte(`{"upstream":"https://example.org"}`), 0600); err != nil {
+		t.Fatalf("write policy: %v", err)
+	}
+	later := time.Now().Add(time.Second)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	changes, err := w.Check(context.Background())
+	if err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	if !slices.Equal(changes, []FileChange{{Name: PolicyFileName, Kind: FileModified}}) {
+		t.Fatalf("unexpected changes: %+v", changes)
+	}
+	if p := store.CurrentPolicy(); p.Upstream != "https://example.org" || !p.Fallback {
+		t.Fatalf("expected an adjusted reload, got %+v", p)
+	}
+}
+
+func TestPolicyChangesNamesSettings(t *testing.T) {
+	before := Policy{Upstream: "https://example.com", Endpoints: map[string]EndpointPolicy{"A": {}, "B": {}}}
+	after := Policy{Upstream: "https://example.com", Fallback: true, Endpoints: map[string]EndpointPolicy{"A": {}, "C": {}}}
+	if got := policyChanges(before, after); !slices.Equal(got, []string{"endpoints.B", "endpoints.C", "fallback"}) {
+		t.Fatalf("unexpected changes: %q", got)
+	}
+	if got := policyChanges(before, before); len(got) != 0 {
+		t.Fatalf("unexpected changes: %q", got)
+	}
+}
+
+func TestReloadPolicyIsSafeDuringPlayback(t *testing.T) {
+	storage := memoryStorageWithPolicy(t, `{"upstream":"https://example.com"}`)
+	store, err := NewWithStorage(storage)
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	body := []byte(`{}`)
+	if err := store.WriteStub("GetThing", RequestSpec{URL: "http://example.com/things"}, ResponseMeta{Status: 200, MimeType: "application/json", Size: len(body)}, body); err != nil {
+		t.Fatalf("write stub: %v", err)
+	}
+	d := NewStubDoer(store, []Endpoint{{Name: "GetThing", Method: http.MethodGet, Pattern: "/things"}})
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Go(func() {
+			for range 20 {
+				resp, err := d.Do(mustRequest(t, http.MethodGet, "http://example.com/things"))
+				if err != nil || resp.StatusCode != http.StatusOK {
+					t.Errorf("do: %v", err)
+					return
+				}
+			}
+		})
+	}
+	for range 20 {
+		if err := store.ReloadPolicy(); err != nil {
+			t.Fatalf("reload: %v", err)
+		}
+	}
+	wg.Wait()
+}
+
+func TestWatcherCheckIsSafeWhileRunning(t *testing.T) {
+	storage := memoryStorageWithPolicy(t, `{"upstream":"https://example.com"}`)
+	store, err := NewWithStorage(storage)
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	w := &Watcher{Store: store, Interval: time.Millisecond}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Go(func() { _ = w.Run(ctx) })
+	for i := range 20 {
+		if err := storage.WriteFile(fmt.Sprintf("GetThing--%d.vcr.json", i), []byte(`{}`)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if _, err := w.Check(ctx); err != nil {
+			t.Fatalf("check: %v", err)
+		}
+	}
+	cancel()
+	wg.Wait()
+}
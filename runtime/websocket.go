@@ -0,0 +1,389 @@
+package runtime
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"goa.design/clue/log"
+)
+
+const (
+	webSocketFromClient = "client"
+	webSocketFromServer = "server"
+
+	webSocketText   = "text"
+	webSocketBinary = "binary"
+	webSocketClose  = "close"
+)
+
+// WebSocketMessage is one message of a recorded WebSocket conversation.
+// WebSocket stubs have status 101 and store their messages as a JSON array in
+// the blob.
+type WebSocketMessage struct {
+	// At is the time between the upgrade and the message.
+	At time.Duration
+	// From is "client" or "server".
+	From string
+	// Type is "text", "binary" or "close".
+	Type string
+	// Data is the text, the base64-encoded binary payload or the close reason.
+	Data string
+	// Code is the status code of a close message.
+	Code int
+}
+
+type webSocketMessageJSON struct {
+	At   int64  `json:"at"`
+	From string `json:"from"`
+	Type string `json:"type"`
+	Data string `json:"data"`
+	Code int    `json:"code,omitempty"`
+}
+
+// MarshalJSON encodes At in milliseconds.
+func (m WebSocketMessage) MarshalJSON() ([]byte, error) {
+	return json.Marshal(webSocketMessageJSON{
+		At:   m.At.Milliseconds(),
+		From: m.From,
+		Type: m.Type,
+		Data: m.Data,
+		Code: m.Code,
+	})
+}
+
+func (m *WebSocketMessage) UnmarshalJSON(data []byte) error {
+	var raw webSocketMessageJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*m = WebSocketMessage{
+		At:   time.Duration(raw.At) * time.Millisecond,
+		From: raw.From,
+		Type: raw.Type,
+		Data: raw.Data,
+		Code: raw.Code,
+	}
+	return nil
+}
+
+// webSocketFrame is a complete data or close message read off the wire.
+type webSocketFrame struct {
+	opcode  int
+	payload []byte
+}
+
+// webSocketFrameParser reassembles the messages of one direction of a
+// WebSocket connection. Ping and pong frames are dropped.
+type webSocketFrameParser struct {
+	buf     []byte
+	opcode  int
+	payload []byte
+}
+
+// feed appends data and returns the messages it completes.
+func (p *webSocketFrameParser) feed(data []byte) []webSocketFrame {
+	p.buf = append(p.buf, data...)
+	var out []webSocketFrame
+	for {
+		fin, opcode, payload, rest, ok := cutWebSocketFrame(p.buf)
+		if !ok {
+			return out
+		}
+		p.buf = rest
+		switch {
+		case opcode == websocket.CloseMessage:
+			out = append(out, webSocketFrame{opcode: opcode, payload: payload})
+			continue
+		case opcode >= websocket.CloseMessage:
+			continue
+		case opcode == 0:
+			p.payload = append(p.payload, payload...)
+		default:
+			p.opcode, p.payload = opcode, payload
+		}
+		if fin {
+			out = append(out, webSocketFrame{opcode: p.opcode, payload: p.payload})
+			p.opcode, p.payload = 0, nil
+		}
+	}
+}
+
+// cutWebSocketFrame decodes the first frame of buf, unmasking its payload.
+func cutWebSocketFrame(buf []byte) (fin bool, opcode int, payload, rest []byte, ok bool) {
+	if len(buf) < 2 {
+		return false, 0, nil, buf, false
+	}
+	fin = buf[0]&0x80 != 0
+	opcode = int(buf[0] & 0x0f)
+	masked := buf[1]&0x80 != 0
+	n := uint64(buf[1] & 0x7f)
+	off := 2
+	switch n {
+	case 126:
+		if len(buf) < 4 {
+			return false, 0, nil, buf, false
+		}
+		n, off = uint64(binary.BigEndian.Uint16(buf[2:4])), 4
+	case 127:
+		if len(buf) < 10 {
+			return false, 0, nil, buf, false
+		}
+		n, off = binary.BigEndian.Uint64(buf[2:10]), 10
+	}
+	var key []byte
+	if masked {
+		if len(buf) < off+4 {
+			return false, 0, nil, buf, false
+		}
+		key, off = buf[off:off+4], off+4
+	}
+	if uint64(len(buf)-off) < n {
+		return false, 0, nil, buf, false
+	}
+	end := off + int(n)
+	payload = append([]byte(nil), buf[off:end]...)
+	if masked {
+		for i := range payload {
+			payload[i] ^= key[i%4]
+		}
+	}
+	return fin, opcode, payload, buf[end:], true
+}
+
+// webSocketCapture passes an upgraded connection through while recording the
+// messages in both directions: reads carry server messages, writes client
+// messages. When the connection is closed, done receives the conversation and
+// the time it lasted.
+type webSocketCapture struct {
+	conn  io.ReadWriteCloser
+	start time.Time
+	done  func(messages []WebSocketMessage, elapsed time.Duration)
+
+	mu       sync.Mutex
+	client   webSocketFrameParser
+	server   webSocketFrameParser
+	messages []WebSocketMessage
+	once     sync.Once
+}
+
+func newWebSocketCapture(conn io.ReadWriteCloser, done func([]WebSocketMessage, time.Duration)) *webSocketCapture {
+	return &webSocketCapture{conn: conn, start: time.Now(), done: done}
+}
+
+func (c *webSocketCapture) Read(p []byte) (int, error) {
+	n, err := c.conn.Read(p)
+	if n > 0 {
+		c.record(webSocketFromServer, &c.server, p[:n])
+	}
+	return n, err
+}
+
+func (c *webSocketCapture) Write(p []byte) (int, error) {
+	n, err := c.conn.Write(p)
+	if n > 0 {
+		c.record(webSocketFromClient, &c.client, p[:n])
+	}
+	return n, err
+}
+
+func (c *webSocketCapture) Close() error {
+	err := c.conn.Close()
+	c.once.Do(func() {
+		c.mu.Lock()
+		messages := c.messages
+		c.mu.Unlock()
+		c.done(messages, time.Since(c.start))
+	})
+	return err
+}
+
+func (c *webSocketCapture) record(from string, p *webSocketFrameParser, data []byte) {
+	at := time.Since(c.start)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, frame := range p.feed(data) {
+		msg := WebSocketMessage{At: at, From: from}
+		switch frame.opcode {
+		case websocket.TextMessage:
+			msg.Type, msg.Data = webSocketText, string(frame.payload)
+		case websocket.BinaryMessage:
+			msg.Type, msg.Data = webSocketBinary, base64.StdEncoding.EncodeToString(frame.payload)
+		case websocket.CloseMessage:
+			msg.Type = webSocketClose
+			if len(frame.payload) >= 2 {
+				msg.Code = int(binary.BigEndian.Uint16(frame.payload))
+				msg.Data = string(frame.payload[2:])
+			}
+		default:
+			continue
+		}
+		c.messages = append(c.messages, msg)
+	}
+}
+
+// WebSocketUpgrader upgrades an HTTP request to a WebSocket connection. It is
+// satisfied by *websocket.Upgrader.
+type WebSocketUpgrader interface {
+	Upgrade(w http.ResponseWriter, r *http.Request, responseHeader http.Header) (*websocket.Conn, error)
+}
+
+type webSocketRequestKey struct{}
+
+type webSocketRequest struct {
+	w http.ResponseWriter
+	r *http.Request
+}
+
+// WebSocketMiddleware keeps the response writer and request of WebSocket
+// upgrade requests in their context, so StubDoer.ReplayWebSocket can upgrade
+// them from within a Goa endpoint.
+func WebSocketMiddleware(next http.Handler) http.Handler {
+	if next == nil {
+		return http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r != nil && websocket.IsWebSocketUpgrade(r) {
+			in := &webSocketRequest{w: w}
+			r = r.WithContext(context.WithValue(r.Context(), webSocketRequestKey{}, in))
+			in.r = r
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ReplayWebSocket upgrades the WebSocket request stored in ctx by
+// WebSocketMiddleware and plays back the conversation recorded for it. Server
+// messages are sent in order; client messages are ignored, or awaited and
+// compared with the recording when the policy sets websocket.match. With
+// StreamTiming, server messages keep their recorded delays. The upgrade is
+// delayed by the endpoint latency.
+//
+// A missing conversation yields an error matching fs.ErrNotExist, before the
+// connection is upgraded. Failures after the upgrade are logged and the
+// connection is closed.
+func (d *StubDoer) ReplayWebSocket(ctx context.Context, upgrader WebSocketUpgrader) error {
+	in, ok := ctx.Value(webSocketRequestKey{}).(*webSocketRequest)
+	if !ok {
+		return errors.New("vcr: no WebSocket request in context; install WebSocketMiddleware")
+	}
+	req := in.r
+	endpointName, vars, ok := d.Matcher.Match(req)
+	if !ok {
+		d.strictMiss(req, "")
+		return fmt.Errorf("vcr: unstubbed endpoint: %w", fs.ErrNotExist)
+	}
+	div := RequestDiversifier(d.Store.CurrentPolicy(), endpointName, req.URL.Query(), vars, nil, diversifierHeader(req))
+	match, meta, blob, err := d.lookup(req, endpointName, vars, div)
+	setStubMatch(req.Context(), match)
+	call := callFromContext(req.Context())
+	if err != nil {
+		call.resolve(CallMiss, match.Stub)
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, ErrSequenceExhausted) {
+			d.strictMiss(req, stubKey(endpointName, div))
+		}
+		return err
+	}
+	call.resolve(CallStub, match.Stub)
+	var messages []WebSocketMessage
+	if meta.Status != http.StatusSwitchingProtocols || json.Unmarshal(blob, &messages) != nil {
+		return fmt.Errorf("vcr: stub %s is not a WebSocket conversation: %w", match.Stub, fs.ErrNotExist)
+	}
+	if err := sleep(ctx, d.latency(endpointName).Delay(meta.Timings)); err != nil {
+		return err
+	}
+
+	conn, err := upgrader.Upgrade(in.w, req, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := replayConversation(ctx, conn, messages, d.Store.CurrentPolicy().WebSocketMatch(endpointName), d.StreamTiming); err != nil {
+		log.Error(ctx, err, log.KV{K: "vcr.endpoint.name", V: endpointName}, log.KV{K: "msg", V: "websocket replay failed"})
+	}
+	return nil
+}
+
+// replayConversation plays messages back over conn. See ReplayWebSocket.
+func replayConversation(ctx context.Context, conn *websocket.Conn, messages []WebSocketMessage, match, timed bool) error {
+	if !match {
+		// Keep reading so that control frames from the client are handled.
+		go func() {
+			for {
+				if _, _, err := conn.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+	}
+	deadline := func() time.Time { return time.Now().Add(time.Second) }
+	anchor, anchorAt := time.Now(), time.Duration(0)
+	for i, msg := range messages {
+		if msg.From == webSocketFromClient {
+			if !match {
+				continue
+			}
+			typ, data, err := conn.ReadMessage()
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if msg.Type == webSocketClose || !sameWebSocketMessage(msg, typ, data) {
+				_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "vcr: unexpected client message"), deadline())
+				return fmt.Errorf("vcr: client message %d does not match the recording", i+1)
+			}
+			anchor, anchorAt = time.Now(), msg.At
+			continue
+		}
+
+		if timed {
+			if err := sleep(ctx, time.Until(anchor.Add(msg.At-anchorAt))); err != nil {
+				return err
+			}
+		}
+		switch msg.Type {
+		case webSocketClose:
+			code := msg.Code
+			if code == 0 {
+				code = websocket.CloseNormalClosure
+			}
+			return conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, msg.Data), deadline())
+		case webSocketBinary:
+			data, err := base64.StdEncoding.DecodeString(msg.Data)
+			if err != nil {
+				return fmt.Errorf("vcr: message %d: %w", i+1, err)
+			}
+			if err := conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+				return err
+			}
+		default:
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(msg.Data)); err != nil {
+				return err
+			}
+		}
+	}
+	return conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), deadline())
+}
+
+// sameWebSocketMessage reports whether a client message matches the recorded
+// one. JSON text messages are compared in canonical form.
+func sameWebSocketMessage(recorded WebSocketMessage, typ int, data []byte) bool {
+	switch recorded.Type {
+	case webSocketText:
+		return typ == websocket.TextMessage && NormalizeBody([]byte(recorded.Data)) == NormalizeBody(data)
+	case webSocketBinary:
+		return typ == websocket.BinaryMessage && recorded.Data == base64.StdEncoding.EncodeToString(data)
+	}
+	return false
+}
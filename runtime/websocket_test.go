@@ -0,0 +1,193 @@
+package runtime
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsFrame encodes a single frame, masked with key when key is not nil.
+func wsFrame(fin bool, opcode byte, payload []byte, key []byte) []byte {
+	b0 := opcode
+	if fin {
+		b0 |= 0x80
+	}
+	out := []byte{b0, byte(len(payload))}
+	if key != nil {
+		out[1] |= 0x80
+		out = append(out, key...)
+	}
+	for i, c := range payload {
+		if key != nil {
+			c ^= key[i%4]
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+func TestWebSocketFrameParserReassemblesMessages(t *testing.T) {
+	key := []byte{1, 2, 3, 4}
+	var stream []byte
+	stream = append(stream, wsFrame(false, websocket.TextMessage, []byte(`{"a":`), key)...)
+	stream = append(stream, wsFrame(true, websocket.PingMessage, nil, key)...)
+	stream = append(stream, wsFrame(true, 0, []byte(`1}`), key)...)
+	stream = append(stream, wsFrame(true, websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "bye"), key)...)
+
+	var p webSocketFrameParser
+	var frames []webSocketFrame
+	for _, c := range stream {
+		frames = append(frames, p.feed([]byte{c})...)
+	}
+	if len(frames) != 2 {
+		t.Fatalf("unexpected frames: %+v", frames)
+	}
+	if frames[0].opcode != websocket.TextMessage || string(frames[0].payload) != `{"a":1}` {
+		t.Fatalf("unexpected text message: %+v", frames[0])
+	}
+	if frames[1].opcode != websocket.CloseMessage || string(frames[1].payload[2:]) != "bye" {
+		t.Fatalf("unexpected close message: %+v", frames[1])
+	}
+}
+
+func TestStubDoerReplaysWebSocketConversations(t *testing.T) {
+	store, err := NewWithStorage(memoryStorageWithPolicy(t, `{"upstream":"https://example.com"}`))
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	blob, _ := json.Marshal([]WebSocketMessage{
+		{At: 0, From: "client", Type: "text", Data: `{"sub":"a"}`},
+		{At: 10 * time.Millisecond, From: "server", Type: "text", Data: `{"n":1}`},
+		{At: 60 * time.Millisecond, From: "server", Type: "binary", Data: "AQI="},
+		{At: 70 * time.Millisecond, From: "server", Type: "close", Code: websocket.CloseGoingAway, Data: "done"},
+	})
+	if err := store.WriteStub("Watch", RequestSpec{Method: http.MethodGet, URL: "http://example.com/watch"}, ResponseMeta{
+		Status:   http.StatusSwitchingProtocols,
+		MimeType: "application/json",
+		Size:     len(blob),
+	}, blob); err != nil {
+		t.Fatalf("write stub: %v", err)
+	}
+
+	d := NewStubDoer(store, []Endpoint{{Name: "Watch", Method: http.MethodGet, Pattern: "/watch"}})
+	d.StreamTiming = true
+	upgrader := &websocket.Upgrader{}
+	srv := httptest.NewServer(WebSocketMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := d.ReplayWebSocket(r.Context(), upgrader); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})))
+	defer srv.Close()
+
+	start := time.Now()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/watch", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	typ, data, err := conn.ReadMessage()
+	if err != nil || typ != websocket.TextMessage || string(data) != `{"n":1}` {
+		t.Fatalf("unexpected first message: %d %q %v", typ, data, err)
+	}
+	typ, data, err = conn.ReadMessage()
+	if err != nil || typ != websocket.BinaryMessage || string(data) != "\x01\x02" {
+		t.Fatalf("unexpected second message: %d %q %v", typ, data, err)
+	}
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Fatalf("expected recorded timing, second message after %v", elapsed)
+	}
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("expected recorded close, got %v", err)
+	}
+}
+
+func TestStubDoerReplaysWebSocketByIncomingHeaders(t *testing.T) {
+	store, err := NewWithStorage(memoryStorageWithPolicy(t, `{"upstream":"https://example.com","endpoints":{"Watch":{"variant":{"headers":["X-Tenant"]}}}}`))
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	tenant := http.Header{"X-Tenant": {"acme"}}
+	div := RequestDiversifier(store.Policy, "Watch", nil, nil, nil, tenant)
+	blob, _ := json.Marshal([]WebSocketMessage{{From: "server", Type: "text", Data: "acme"}})
+	if err := store.WriteStub("Watch", RequestSpec{Method: http.MethodGet, URL: "http://example.com/watch", Headers: tenant}, ResponseMeta{
+		Status:   http.StatusSwitchingProtocols,
+		MimeType: "application/json",
+		Size:     len(blob),
+	}, blob, div); err != nil {
+		t.Fatalf("write stub: %v", err)
+	}
+
+	d := NewStubDoer(store, []Endpoint{{Name: "Watch", Method: http.MethodGet, Pattern: "/watch"}})
+	upgrader := &websocket.Upgrader{}
+	replay := WebSocketMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := d.ReplayWebSocket(r.Context(), upgrader); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		replay.ServeHTTP(w, r.WithContext(WithIncomingHeader(r.Context(), tenant)))
+	}))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/watch", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if _, data, err := conn.ReadMessage(); err != nil || string(data) != "acme" {
+		t.Fatalf("unexpected message: %q %v", data, err)
+	}
+}
+
+func TestRecordingTransportKeepsWebSocketStubs(t *testing.T) {
+	store, err := NewWithStorage(memoryStorageWithPolicy(t, `{"upstream":"https://example.com"}`))
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	blob := []byte(`[{"at":0,"from":"server","type":"text","data":"hello"}]`)
+	if err := store.WriteStub("Watch", RequestSpec{Method: http.MethodGet, URL: "http://example.com/watch"}, ResponseMeta{
+		Status:   http.StatusSwitchingProtocols,
+		MimeType: "application/json",
+		Size:     len(blob),
+	}, blob); err != nil {
+		t.Fatalf("write stub: %v", err)
+	}
+
+	endpoints := []Endpoint{{Name: "Watch", Method: http.MethodGet, Pattern: "/watch"}}
+	for _, mode := range []RecordMode{RecordModeNewEpisodes, RecordModeOnce} {
+		t.Run(string(mode), func(t *testing.T) {
+			upstream := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				client, server := net.Pipe()
+				_ = server.Close()
+				return &http.Response{StatusCode: http.StatusSwitchingProtocols, Header: http.Header{}, Body: client, Request: req}, nil
+			})
+			tr := NewRecordingTransport(nil, store, endpoints, upstream, 0)
+			tr.Mode = mode
+			req := mustRequest(t, http.MethodGet, "http://example.com/watch")
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", "websocket")
+			resp, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("round trip: %v", err)
+			}
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("expected the upgrade to pass through, got %d", resp.StatusCode)
+			}
+			_ = resp.Body.Close()
+
+			if _, body, err := store.ReadResponse("Watch"); err != nil || string(body) != string(blob) {
+				t.Fatalf("expected the recorded conversation to be kept, got %q %v", body, err)
+			}
+		})
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }